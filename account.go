@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// cachedAccount serves the account lookup req from the per-token cache when
+// it can, and fills the cache from Dropbox otherwise. Successful responses
+// carry an ETag over the body, so a client revalidating with If-None-Match
+// gets a 304 whether or not the body came from the cache. key must already be
+// hashed and start with the token's accountCachePrefix.
+func (s *server) cachedAccount(w http.ResponseWriter, r *http.Request, key string, req *http.Request) {
+	log := logger(r.Context()).With("upstream", "get_current_account")
+
+	rec, ok := s.accounts.get(key)
+	if ok {
+		log.Debug("served account from cache")
+	} else {
+		rec = newCapturedResponse()
+		s.proxyDropbox(rec, r, "get_current_account", req, log)
+		if rec.status == http.StatusOK {
+			sum := sha256.Sum256(rec.body.Bytes())
+			rec.header.Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+			// Browsers may keep it but must come back to revalidate,
+			// which the cache answers cheaply.
+			rec.header.Set("Cache-Control", "private, no-cache")
+			// Dropbox's request ID names this call only; later lookups
+			// served from the cache made no call of their own.
+			cached := &capturedResponse{header: rec.header.Clone(), status: rec.status}
+			cached.header.Del("X-Dropbox-Request-Id")
+			cached.body.Write(rec.body.Bytes())
+			s.accounts.set(key, cached, s.config(r.Context()).AccountCacheTTL)
+		}
+	}
+
+	if etag := rec.header.Get("ETag"); etag != "" && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", rec.header.Get("Cache-Control"))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	rec.replay(w)
+}
+
+// accountCachePrefix starts the cache key of every account lookup made with
+// token, whichever team member it selected, so revoking the token can drop
+// them all.
+func accountCachePrefix(token string) string {
+	return cacheKey("account", token) + ":"
+}
+
+// etagMatches applies If-None-Match's weak comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func accountStub(t *testing.T) *stubDropbox {
+	return newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/2/auth/token/revoke" {
+			io.WriteString(w, "null")
+			return
+		}
+		io.WriteString(w, `{"account_id":"dbid:1"}`)
+	})
+}
+
+func getAccount(h http.Handler, token string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/api/dropbox/account", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAccountCache(t *testing.T) {
+	stub := accountStub(t)
+	_, h, clock := newClockedTestServer(t, testConfig(t, stub.URL, "ACCOUNT_CACHE_TTL", "30s"))
+
+	first := getAccount(h, "tok")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("first lookup: status %d, ETag %q", first.Code, etag)
+	}
+	if second := getAccount(h, "tok"); second.Body.String() != first.Body.String() || stub.calls.Load() != 1 {
+		t.Errorf("second lookup reached dropbox: %d calls", stub.calls.Load())
+	}
+	if w := getAccount(h, "tok", "If-None-Match", etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("revalidation: status %d, body %q", w.Code, w.Body)
+	}
+
+	clock.Advance(31 * time.Second)
+	getAccount(h, "tok")
+	if n := stub.calls.Load(); n != 2 {
+		t.Errorf("lookup after TTL: %d dropbox calls, want 2", n)
+	}
+}
+
+func TestRevokeEvictsAccountCache(t *testing.T) {
+	stub := accountStub(t)
+	_, h := newTestServer(t, testConfig(t, stub.URL, "ACCOUNT_CACHE_TTL", "1h"))
+
+	getAccount(h, "tok")
+	getAccount(h, "tok", "Dropbox-API-Select-User", "dbmid:AAAA")
+	getAccount(h, "other")
+
+	w := do(h, "POST", "/api/dropbox/revoke", contentTypeJSON, `{"access_token":"tok"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("revoke: status %d, body %s", w.Code, w.Body)
+	}
+	before := stub.calls.Load()
+
+	getAccount(h, "tok")
+	getAccount(h, "tok", "Dropbox-API-Select-User", "dbmid:AAAA")
+	getAccount(h, "other")
+	if n := stub.calls.Load() - before; n != 2 {
+		t.Errorf("%d lookups reached dropbox after revoke, want the revoked token's 2", n)
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	for header, want := range map[string]bool{
+		`"abc"`:      true,
+		`W/"abc"`:    true,
+		`"x", "abc"`: true,
+		`*`:          true,
+		`"abcd"`:     false,
+		``:           false,
+		`"x", "y"`:   false,
+	} {
+		if got := etagMatches(header, `"abc"`); got != want {
+			t.Errorf("etagMatches(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestTeamSelectHeaders(t *testing.T) {
+	var got http.Header
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"account_id":"dbid:1"}`)
+	})
+	_, h := newTestServer(t, testConfig(t, stub.URL))
+
+	for _, tc := range []struct {
+		name   string
+		header []string
+		want   int
+	}{
+		{"none", nil, http.StatusOK},
+		{"user", []string{"Dropbox-API-Select-User", "dbmid:AAAA-_9"}, http.StatusOK},
+		{"admin", []string{"Dropbox-API-Select-Admin", "dbmid:BBBB"}, http.StatusOK},
+		{"both", []string{"Dropbox-API-Select-User", "dbmid:AAAA", "Dropbox-API-Select-Admin", "dbmid:BBBB"}, http.StatusBadRequest},
+		{"not a member ID", []string{"Dropbox-API-Select-User", "dbid:1"}, http.StatusBadRequest},
+	} {
+		got = nil
+		w := getAccount(h, "tok", tc.header...)
+		if w.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, w.Code, tc.want)
+			continue
+		}
+		if tc.want != http.StatusOK {
+			if got != nil {
+				t.Errorf("%s: rejected request reached dropbox", tc.name)
+			}
+			continue
+		}
+		for _, name := range teamSelectHeaders {
+			want := ""
+			for i := 0; i+1 < len(tc.header); i += 2 {
+				if tc.header[i] == name {
+					want = tc.header[i+1]
+				}
+			}
+			if _, sent := got[http.CanonicalHeaderKey(name)]; got.Get(name) != want || sent != (want != "") {
+				t.Errorf("%s: dropbox got %s %q, want %q", tc.name, name, got.Get(name), want)
+			}
+		}
+	}
+}
+
+func TestAccountCacheDropsRequestID(t *testing.T) {
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Dropbox-Request-Id", "dbx-first")
+		io.WriteString(w, `{"account_id":"dbid:1"}`)
+	})
+	_, h := newTestServer(t, testConfig(t, stub.URL, "ACCOUNT_CACHE_TTL", "1h"))
+
+	first := getAccount(h, "tok")
+	if got := first.Header().Get("X-Dropbox-Request-Id"); got != "dbx-first" {
+		t.Errorf("upstream lookup: X-Dropbox-Request-Id = %q, want Dropbox's", got)
+	}
+	cached := getAccount(h, "tok")
+	if got := cached.Header().Get("X-Dropbox-Request-Id"); got != "" || stub.calls.Load() != 1 {
+		t.Errorf("cached lookup: X-Dropbox-Request-Id = %q after %d calls, want none", got, stub.calls.Load())
+	}
+	if cached.Body.String() != first.Body.String() || cached.Header().Get("ETag") != first.Header().Get("ETag") {
+		t.Errorf("cached lookup differs: %q, ETag %q", cached.Body, cached.Header().Get("ETag"))
+	}
+}
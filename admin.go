@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+)
+
+// redactedConfig is the view of Config served by /admin/config. Secrets are
+// reduced to their last four characters at most; durations are rendered the
+// way they are written in the environment.
+type redactedConfig struct {
+	ClientID       string                      `json:"client_id"`
+	ClientSecret   string                      `json:"client_secret"`
+	RedirectURI    string                      `json:"redirect_uri"`
+	RedirectURIs   []string                    `json:"allowed_redirect_uris"`
+	Providers      map[string]redactedProvider `json:"providers"`
+	DropboxAPIURL  string                      `json:"dropbox_api_url"`
+	ListenAddr     string                      `json:"listen_addr"`
+	AdminAddr      string                      `json:"admin_addr,omitempty"`
+	AllowedOrigins []string                    `json:"allowed_origins"`
+	LogLevel       string                      `json:"log_level"`
+	RateLimitRPS   float64                     `json:"rate_limit_rps"`
+	RateLimitBurst int                         `json:"rate_limit_burst"`
+	TrustProxy     bool                        `json:"trust_proxy"`
+	APIKey         string                      `json:"api_key"`
+	StateSecretSet bool                        `json:"state_secret_set"`
+	StateTTL       string                      `json:"state_ttl"`
+	MaxBodyBytes   int64                       `json:"max_body_bytes"`
+	MaxUpstream    int64                       `json:"dropbox_max_response_bytes"`
+	UserAgent      string                      `json:"user_agent"`
+
+	DropboxTimeout       string `json:"dropbox_timeout"`
+	RetryMaxAttempts     int    `json:"dropbox_max_attempts"`
+	RetryBaseDelay       string `json:"dropbox_retry_base_delay"`
+	MaxIdleConns         int    `json:"dropbox_max_idle_conns"`
+	MaxIdleConnsPerHost  int    `json:"dropbox_max_idle_conns_per_host"`
+	IdleConnTimeout      string `json:"dropbox_idle_conn_timeout"`
+	DisableKeepAlives    bool   `json:"dropbox_disable_keep_alives"`
+	TCPKeepAlive         string `json:"dropbox_tcp_keep_alive"`
+	MaxConcurrency       int    `json:"dropbox_max_concurrency"`
+	UpstreamQueueTimeout string `json:"dropbox_queue_timeout"`
+
+	ShutdownTimeout   string `json:"shutdown_timeout"`
+	PreShutdownDelay  string `json:"pre_shutdown_delay"`
+	ReadHeaderTimeout string `json:"read_header_timeout"`
+	ReadTimeout       string `json:"read_timeout"`
+	WriteTimeout      string `json:"write_timeout"`
+	IdleTimeout       string `json:"idle_timeout"`
+	RequestTimeout    string `json:"request_timeout"`
+	BreakerThreshold  int    `json:"dropbox_breaker_threshold"`
+	BreakerCooldown   string `json:"dropbox_breaker_cooldown"`
+
+	MetricsEnabled bool   `json:"metrics_enabled"`
+	PprofEnabled   bool   `json:"pprof_enabled"`
+	H2CEnabled     bool   `json:"h2c_enabled"`
+	DryRun         bool   `json:"dry_run"`
+	DebugBodies    bool   `json:"debug_bodies"`
+	TLSEnabled     bool   `json:"tls_enabled"`
+	TLSMode        string `json:"tls_mode"`
+	FrontendURL    string `json:"frontend_url,omitempty"`
+
+	TokenCacheEnabled bool   `json:"token_cache_enabled"`
+	TokenCacheTTL     string `json:"token_cache_ttl"`
+	TokenCacheMargin  string `json:"token_cache_margin"`
+	AccountCacheTTL   string `json:"account_cache_ttl"`
+
+	HSTSMaxAge            string `json:"hsts_max_age"`
+	HSTSIncludeSubdomains bool   `json:"hsts_include_subdomains"`
+	HTTPRedirectAddr      string `json:"tls_http_addr,omitempty"`
+
+	ForwardedHeaders []string `json:"forwarded_headers"`
+
+	CORSMaxAge           string   `json:"cors_max_age"`
+	CORSAllowCredentials bool     `json:"cors_allow_credentials"`
+	CORSAllowedHeaders   []string `json:"cors_allowed_headers"`
+	CORSAllowedMethods   []string `json:"cors_allowed_methods,omitempty"`
+
+	TokenStore      string `json:"token_store,omitempty"`
+	TokenStorePath  string `json:"token_store_path,omitempty"`
+	RedisURL        string `json:"redis_url,omitempty"`
+	DropboxProxy    string `json:"dropbox_http_proxy,omitempty"`
+	AuditLog        string `json:"audit_log,omitempty"`
+	IdempotencyTTL  string `json:"idempotency_ttl"`
+	ExchangeDedup   string `json:"exchange_dedup_window"`
+	TracingEndpoint string `json:"tracing_endpoint,omitempty"`
+	ServiceName     string `json:"service_name"`
+}
+
+type redactedProvider struct {
+	TokenURL     string   `json:"token_url"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURI  string   `json:"redirect_uri"`
+	RedirectURIs []string `json:"allowed_redirect_uris"`
+
+	RateLimitRPS   float64 `json:"rate_limit_rps"`
+	RateLimitBurst int     `json:"rate_limit_burst"`
+}
+
+func redactConfig(cfg *Config) redactedConfig {
+	providers := make(map[string]redactedProvider, len(cfg.Providers))
+	for name, p := range cfg.Providers {
+		providers[name] = redactedProvider{
+			TokenURL:     p.TokenURL,
+			ClientID:     p.ClientID,
+			ClientSecret: redact(p.ClientSecret),
+			RedirectURI:  p.RedirectURI,
+			RedirectURIs: p.RedirectURIs,
+
+			RateLimitRPS:   p.RateLimitRPS,
+			RateLimitBurst: p.RateLimitBurst,
+		}
+	}
+
+	out := redactedConfig{
+		ClientID:       cfg.ClientID,
+		ClientSecret:   redact(cfg.ClientSecret),
+		RedirectURI:    cfg.RedirectURI,
+		RedirectURIs:   cfg.RedirectURIs,
+		Providers:      providers,
+		DropboxAPIURL:  cfg.DropboxAPIURL,
+		ListenAddr:     cfg.ListenAddr,
+		AdminAddr:      cfg.AdminAddr,
+		AllowedOrigins: cfg.AllowedOrigins,
+		LogLevel:       cfg.LogLevel.String(),
+		RateLimitRPS:   cfg.RateLimitRPS,
+		RateLimitBurst: cfg.RateLimitBurst,
+		TrustProxy:     cfg.TrustProxy,
+		APIKey:         redact(cfg.APIKey),
+		StateSecretSet: len(cfg.StateSecret) > 0,
+		StateTTL:       cfg.StateTTL.String(),
+		MaxBodyBytes:   cfg.MaxBodyBytes,
+		MaxUpstream:    cfg.MaxUpstreamBody,
+		UserAgent:      cfg.UserAgent,
+
+		DropboxTimeout:       cfg.DropboxTimeout.String(),
+		RetryMaxAttempts:     cfg.RetryMaxAttempts,
+		RetryBaseDelay:       cfg.RetryBaseDelay.String(),
+		MaxIdleConns:         cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:  cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:      cfg.IdleConnTimeout.String(),
+		DisableKeepAlives:    cfg.DisableKeepAlives,
+		TCPKeepAlive:         cfg.TCPKeepAlive.String(),
+		MaxConcurrency:       cfg.MaxUpstreamConcurrency,
+		UpstreamQueueTimeout: cfg.UpstreamQueueTimeout.String(),
+
+		ShutdownTimeout:   cfg.ShutdownTimeout.String(),
+		PreShutdownDelay:  cfg.PreShutdownDelay.String(),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout.String(),
+		ReadTimeout:       cfg.ReadTimeout.String(),
+		WriteTimeout:      cfg.WriteTimeout.String(),
+		IdleTimeout:       cfg.IdleTimeout.String(),
+		RequestTimeout:    cfg.RequestTimeout.String(),
+		BreakerThreshold:  cfg.BreakerThreshold,
+		BreakerCooldown:   cfg.BreakerCooldown.String(),
+
+		MetricsEnabled: cfg.MetricsEnabled,
+		PprofEnabled:   cfg.PprofEnabled,
+		H2CEnabled:     cfg.H2CEnabled,
+		DryRun:         cfg.DryRun,
+		DebugBodies:    cfg.DebugBodies,
+		TLSEnabled:     cfg.TLSEnabled(),
+		TLSMode:        cfg.TLSMode(),
+
+		TokenCacheEnabled: cfg.TokenCacheEnabled,
+		TokenCacheTTL:     cfg.TokenCacheTTL.String(),
+		TokenCacheMargin:  cfg.TokenCacheMargin.String(),
+		AccountCacheTTL:   cfg.AccountCacheTTL.String(),
+
+		HSTSMaxAge:            cfg.HSTSMaxAge.String(),
+		HSTSIncludeSubdomains: cfg.HSTSIncludeSubdomains,
+		HTTPRedirectAddr:      cfg.HTTPRedirectAddr,
+
+		ForwardedHeaders: cfg.ForwardedHeaders,
+
+		CORSMaxAge:           cfg.CORSMaxAge.String(),
+		CORSAllowCredentials: cfg.CORSAllowCredentials,
+		CORSAllowedHeaders:   cfg.CORSAllowedHeaders,
+		CORSAllowedMethods:   cfg.CORSAllowedMethods,
+
+		TokenStore:      cfg.TokenStore,
+		AuditLog:        cfg.AuditLog,
+		IdempotencyTTL:  cfg.IdempotencyTTL.String(),
+		ExchangeDedup:   cfg.ExchangeDedupWindow.String(),
+		TracingEndpoint: cfg.TracingEndpoint,
+		ServiceName:     cfg.ServiceName,
+	}
+	if cfg.TokenStore == "sqlite" {
+		out.TokenStorePath = cfg.TokenStorePath
+	}
+	if u, err := url.Parse(cfg.RedisURL); err == nil && cfg.RedisURL != "" {
+		out.RedisURL = u.Redacted()
+	}
+	if u, err := url.Parse(cfg.DropboxProxy); err == nil && cfg.DropboxProxy != "" {
+		out.DropboxProxy = u.Redacted()
+	}
+	if cfg.FrontendURL != nil {
+		out.FrontendURL = cfg.FrontendURL.String()
+	}
+	return out
+}
+
+// redact keeps the last four characters of a secret so two deployments can
+// be compared. Short secrets are masked entirely, since four characters would
+// give away too much of them.
+func redact(secret string) string {
+	switch {
+	case secret == "":
+		return ""
+	case len(secret) < 16:
+		return "****"
+	default:
+		return "****" + secret[len(secret)-4:]
+	}
+}
+
+// adminAllowed guards the admin endpoints. They sit behind requireAPIKey,
+// and refuse to answer at all when no key is configured, since that would
+// leave them open to anyone.
+func (s *server) adminAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if s.config(r.Context()).APIKey == "" {
+		writeError(w, r, errCodeForbidden, "admin endpoints require PROXY_API_KEY", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// pprofRoutes registers the runtime profiles. Like the rest of /admin they
+// need the API key. CPU profiles and traces are also cut off by
+// REQUEST_TIMEOUT, so keep ?seconds below it.
+func (s *server) pprofRoutes(mux *http.ServeMux) {
+	admin := func(h http.HandlerFunc) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if s.adminAllowed(w, r) {
+				h(w, r)
+			}
+		})
+	}
+	mux.Handle("GET /debug/pprof/", admin(pprof.Index))
+	mux.Handle("GET /debug/pprof/cmdline", admin(pprof.Cmdline))
+	mux.Handle("GET /debug/pprof/profile", admin(pprof.Profile))
+	mux.Handle("GET /debug/pprof/symbol", admin(pprof.Symbol))
+	mux.Handle("GET /debug/pprof/trace", admin(pprof.Trace))
+}
+
+// adminConfigHandler shows the configuration in effect for this request.
+func (s *server) adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAllowed(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(redactConfig(s.config(r.Context())))
+}
+
+// drainHandler takes the instance out of rotation ahead of a deploy: /readyz
+// starts failing so the load balancer stops sending traffic, while requests
+// keep being served until SIGTERM shuts the server down gracefully. DELETE
+// puts it back.
+func (s *server) drainHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAllowed(w, r) {
+		return
+	}
+
+	draining := r.Method != http.MethodDelete
+	if s.draining.Swap(draining) != draining {
+		logger(r.Context()).Info("readiness changed", "draining", draining)
+	}
+	if draining {
+		writeStatus(w, "draining", http.StatusOK)
+		return
+	}
+	writeStatus(w, "ok", http.StatusOK)
+}
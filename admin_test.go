@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func adminRequest(h http.Handler, method, path, key string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	if key != "" {
+		r.Header.Set("X-API-Key", key)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminConfigRedacted(t *testing.T) {
+	secret := "dropbox-app-secret-WXYZ"
+	cfg := testConfig(t, "http://dropbox.invalid",
+		"DROPBOX_CLIENT_SECRET", secret,
+		"PROXY_API_KEY", "admin-key-0123456789",
+		"REDIS_URL", "redis://:hunter2@cache:6379/0",
+		"WRITE_TIMEOUT", "45s")
+	_, h := newTestServer(t, cfg)
+
+	w := adminRequest(h, "GET", "/admin/config", "admin-key-0123456789")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	for _, leaked := range []string{secret, "admin-key-0123456789", "hunter2", string(cfg.StateSecret)} {
+		if strings.Contains(w.Body.String(), leaked) {
+			t.Errorf("response contains secret %q", leaked)
+		}
+	}
+
+	got := decodeJSON[redactedConfig](t, w)
+	if got.ClientSecret != "****WXYZ" || got.Providers[defaultProvider].ClientSecret != "****WXYZ" {
+		t.Errorf("client secret shown as %q and %q, want ****WXYZ", got.ClientSecret, got.Providers[defaultProvider].ClientSecret)
+	}
+	if got.ClientID != "client-id" || got.RedirectURI != "https://app.example/callback" || got.WriteTimeout != "45s" {
+		t.Errorf("plain settings = %q, %q, %q", got.ClientID, got.RedirectURI, got.WriteTimeout)
+	}
+	if !got.StateSecretSet || got.RedisURL != "redis://:xxxxx@cache:6379/0" {
+		t.Errorf("state_secret_set %v, redis_url %q", got.StateSecretSet, got.RedisURL)
+	}
+}
+
+func TestAdminConfigRequiresKey(t *testing.T) {
+	_, open := newTestServer(t, testConfig(t, "http://dropbox.invalid"))
+	if w := adminRequest(open, "GET", "/admin/config", ""); w.Code != http.StatusForbidden {
+		t.Errorf("without PROXY_API_KEY: status = %d, want 403", w.Code)
+	}
+
+	_, h := newTestServer(t, testConfig(t, "http://dropbox.invalid", "PROXY_API_KEY", "admin-key"))
+	for _, key := range []string{"", "wrong"} {
+		if w := adminRequest(h, "GET", "/admin/config", key); w.Code != http.StatusUnauthorized {
+			t.Errorf("key %q: status = %d, want 401", key, w.Code)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	for secret, want := range map[string]string{
+		"":                     "",
+		"short":                "****",
+		"0123456789abcde":      "****",
+		"0123456789abcdef":     "****cdef",
+		"a-much-longer-secret": "****cret",
+	} {
+		if got := redact(secret); got != want {
+			t.Errorf("redact(%q) = %q, want %q", secret, got, want)
+		}
+	}
+}
+
+func TestDrainTogglesReadiness(t *testing.T) {
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {})
+	_, h := newTestServer(t, testConfig(t, stub.URL, "PROXY_API_KEY", "admin-key"))
+
+	ready := func() int { return adminRequest(h, "GET", "/readyz", "").Code }
+	if got := ready(); got != http.StatusOK {
+		t.Fatalf("before drain: /readyz = %d", got)
+	}
+
+	if w := adminRequest(h, "POST", "/admin/drain", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("drain without the key: status %d, want 401", w.Code)
+	}
+	if w := adminRequest(h, "POST", "/admin/drain", "admin-key"); w.Code != http.StatusOK {
+		t.Fatalf("drain: status %d", w.Code)
+	}
+	if got := ready(); got != http.StatusServiceUnavailable {
+		t.Errorf("draining: /readyz = %d, want 503", got)
+	}
+	// Draining fails readiness only; the process is still live.
+	if w := adminRequest(h, "GET", "/healthz", ""); w.Code != http.StatusOK {
+		t.Errorf("draining: /healthz = %d", w.Code)
+	}
+
+	if w := adminRequest(h, "DELETE", "/admin/drain", "admin-key"); w.Code != http.StatusOK {
+		t.Fatalf("undrain: status %d", w.Code)
+	}
+	if got := ready(); got != http.StatusOK {
+		t.Errorf("after undrain: /readyz = %d", got)
+	}
+}
+
+func TestAdminListenerSplit(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	cfg := testConfig(t, stub.URL, "ADMIN_ADDR", "127.0.0.1:9090", "PROXY_API_KEY", "admin-key", "METRICS_ENABLED", "true")
+	s := newServer(cfg, http.DefaultClient, nil, nil, nil)
+	public, admin := s.routes()
+	if admin == nil {
+		t.Fatal("no admin handler with ADMIN_ADDR set")
+	}
+
+	for _, path := range []string{"/healthz", "/readyz", "/version", "/metrics", "/admin/config"} {
+		if w := adminRequest(admin, "GET", path, "admin-key"); w.Code != http.StatusOK {
+			t.Errorf("admin %s: status = %d, want 200", path, w.Code)
+		}
+		if w := adminRequest(public, "GET", path, "admin-key"); w.Code != http.StatusNotFound {
+			t.Errorf("public %s: status = %d, want 404", path, w.Code)
+		}
+	}
+
+	for name, h := range map[string]http.Handler{"public": public, "admin": admin} {
+		r := httptest.NewRequest("POST", "/api/dropbox/refresh", strings.NewReader(`{"refresh_token":"r"}`))
+		r.Header.Set("Content-Type", contentTypeJSON)
+		r.Header.Set("X-API-Key", "admin-key")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		want := http.StatusOK
+		if name == "admin" {
+			want = http.StatusNotFound
+		}
+		if w.Code != want {
+			t.Errorf("%s refresh: status = %d, want %d", name, w.Code, want)
+		}
+	}
+}
+
+func TestPprof(t *testing.T) {
+	cfg := testConfig(t, "http://dropbox.invalid", "ADMIN_ADDR", "127.0.0.1:9090", "PROXY_API_KEY", "admin-key", "PPROF_ENABLED", "true")
+	public, admin := newServer(cfg, http.DefaultClient, nil, nil, nil).routes()
+
+	w := adminRequest(admin, "GET", "/debug/pprof/heap?debug=1", "admin-key")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "heap profile") {
+		t.Errorf("heap profile: status %d, body starts %.40q", w.Code, w.Body)
+	}
+	if w := adminRequest(admin, "GET", "/debug/pprof/", "admin-key"); w.Code != http.StatusOK {
+		t.Errorf("index: status %d", w.Code)
+	}
+	if w := adminRequest(admin, "GET", "/debug/pprof/heap", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("without a key: status %d, want 401", w.Code)
+	}
+	if w := adminRequest(public, "GET", "/debug/pprof/heap", "admin-key"); w.Code != http.StatusNotFound {
+		t.Errorf("public listener: status %d, want 404", w.Code)
+	}
+
+	cfg = testConfig(t, "http://dropbox.invalid", "ADMIN_ADDR", "127.0.0.1:9090", "PROXY_API_KEY", "admin-key", "PPROF_ENABLED", "false")
+	_, admin = newServer(cfg, http.DefaultClient, nil, nil, nil).routes()
+	if w := adminRequest(admin, "GET", "/debug/pprof/heap", "admin-key"); w.Code != http.StatusNotFound {
+		t.Errorf("disabled: status %d, want 404", w.Code)
+	}
+}
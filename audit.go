@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditLog appends one JSON record per token operation to a sink, separate
+// from the request log so it can be retained under its own policy. Records
+// carry identifiers only; tokens, codes and secrets are never written. A nil
+// *auditLog records nothing.
+type auditLog struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// auditRecord is the audit line format. Its fields are the complete set of
+// what may be written; keep secrets out of it.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	ClientIP  string    `json:"client_ip"`
+	Provider  string    `json:"provider"`
+	Action    string    `json:"action"`
+	Status    int       `json:"status"`
+	AccountID string    `json:"account_id,omitempty"`
+}
+
+// openAuditLog opens AUDIT_LOG: "stdout" or a file path, which is appended
+// to. An empty sink disables auditing.
+func openAuditLog(sink string) (*auditLog, error) {
+	switch sink {
+	case "":
+		return nil, nil
+	case "stdout":
+		return &auditLog{out: os.Stdout}, nil
+	}
+
+	f, err := os.OpenFile(sink, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{out: f}, nil
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	if c, ok := a.out.(io.Closer); ok && a.out != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
+
+// audited wraps a token operation so its outcome is audited once the response
+// is written. Handlers report the account through auditAccount.
+func (s *server) audited(action string, next http.Handler) http.Handler {
+	if s.audit == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := &auditRecord{
+			Time:      s.clock.Now().UTC(),
+			RequestID: requestIDFrom(r.Context()),
+			Provider:  r.PathValue("provider"),
+			Action:    action,
+		}
+		if entry.Provider == "" {
+			// Routes without {provider} are Dropbox-only.
+			entry.Provider = "dropbox"
+		}
+		entry.ClientIP = clientIP(r, s.config(r.Context()).TrustProxy)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), auditKey, entry)))
+
+		entry.Status = rec.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		s.audit.write(entry)
+	})
+}
+
+func (a *auditLog) write(entry *auditRecord) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.out.Write(append(b, '\n')); err != nil {
+		slog.Error("failed to write audit record", "request_id", entry.RequestID, "error", err)
+	}
+}
+
+// auditAccount attaches the account from a successful token response to the
+// request's audit record, if it has one.
+func auditAccount(ctx context.Context, token *DropboxTokenResponse) {
+	if entry, ok := ctx.Value(auditKey).(*auditRecord); ok && token != nil {
+		entry.AccountID = token.AccountID
+	}
+}
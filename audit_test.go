@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditRecord(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	var sink bytes.Buffer
+	s, _ := newTestServer(t, testConfig(t, stub.URL))
+	s.audit = &auditLog{out: &sink}
+	h, _ := s.routes()
+
+	body := exchangeBody(s, "secret-auth-code", `,"code_verifier":"secret-verifier"`)
+	r := httptest.NewRequest("POST", "/api/dropbox/exchange", strings.NewReader(body))
+	r.RemoteAddr = "192.0.2.7:5555"
+	r.Header.Set("Content-Type", contentTypeJSON)
+	r.Header.Set(requestIDHeader, "audit-req-1")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	line := sink.String()
+	if strings.Count(line, "\n") != 1 {
+		t.Fatalf("want one audit line, got %q", line)
+	}
+	var rec map[string]any
+	if err := json.Unmarshal([]byte(line), &rec); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"request_id": "audit-req-1",
+		"client_ip":  "192.0.2.7",
+		"provider":   "dropbox",
+		"action":     "exchange",
+		"status":     float64(http.StatusOK),
+		"account_id": "dbid:1",
+	}
+	for key, value := range want {
+		if rec[key] != value {
+			t.Errorf("%s = %v, want %v", key, rec[key], value)
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, rec["time"].(string)); err != nil {
+		t.Errorf("time: %v", err)
+	}
+	if len(rec) != len(want)+1 {
+		t.Errorf("unexpected fields in %v", rec)
+	}
+	for _, secret := range []string{"secret-auth-code", "secret-verifier", "client-secret", "sl.access", `"refresh"`} {
+		if strings.Contains(line, secret) {
+			t.Errorf("audit line contains %s: %s", secret, line)
+		}
+	}
+}
+
+func TestAuditFailedRefresh(t *testing.T) {
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+	})
+	var sink bytes.Buffer
+	s, _ := newTestServer(t, testConfig(t, stub.URL))
+	s.audit = &auditLog{out: &sink}
+	h, _ := s.routes()
+
+	do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"secret-refresh"}`)
+	var rec auditRecord
+	if err := json.Unmarshal(sink.Bytes(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Action != "refresh" || rec.Status != http.StatusBadRequest || rec.AccountID != "" {
+		t.Errorf("record = %+v", rec)
+	}
+	if strings.Contains(sink.String(), "secret-refresh") {
+		t.Errorf("audit line contains the refresh token: %s", sink.String())
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import "golang.org/x/crypto/acme/autocert"
+
+// newCertManager obtains and renews certificates for the configured domains
+// from Let's Encrypt, keeping them in the cache directory so restarts don't
+// run into the issuance rate limits.
+func newCertManager(cfg Config) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.AutocertDomains...),
+		Cache:      autocert.DirCache(cfg.AutocertCacheDir),
+		Email:      cfg.AutocertEmail,
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+)
+
+// logStartup writes one line summarizing the configuration that is about to
+// serve, so an operator can check what is actually running. Only
+// non-sensitive values appear: secrets are reported as set or not, and URLs
+// that may carry credentials as enabled or not.
+func logStartup(cfg Config) {
+	providers := make([]string, 0, len(cfg.Providers))
+	for name := range cfg.Providers {
+		providers = append(providers, name)
+	}
+	sort.Strings(providers)
+
+	slog.Info("starting todosrv",
+		"version", version,
+		"listen_addr", cfg.ListenAddr,
+		"admin_addr", cfg.AdminAddr,
+		"tls", cfg.TLSMode(),
+		"providers", providers,
+		"client_id", cfg.ClientID,
+		"client_secret_set", cfg.ClientSecret != "",
+		"api_key_set", cfg.APIKey != "",
+		"allowed_origins", cfg.AllowedOrigins,
+		"log_level", cfg.LogLevel.String(),
+		slog.Group("timeouts",
+			"request", cfg.RequestTimeout.String(),
+			"dropbox", cfg.DropboxTimeout.String(),
+			"read_header", cfg.ReadHeaderTimeout.String(),
+			"read", cfg.ReadTimeout.String(),
+			"write", cfg.WriteTimeout.String(),
+			"idle", cfg.IdleTimeout.String(),
+			"shutdown", cfg.ShutdownTimeout.String(),
+		),
+		slog.Group("rate_limit",
+			"rps", cfg.RateLimitRPS,
+			"burst", cfg.RateLimitBurst,
+			"client_rps", cfg.ClientRateLimitRPS,
+			"client_burst", cfg.ClientRateLimitBurst,
+			"trust_proxy", cfg.TrustProxy,
+		),
+		slog.Group("features",
+			"metrics", cfg.MetricsEnabled,
+			"tracing", cfg.TracingEndpoint != "",
+			"token_cache", cfg.TokenCacheEnabled,
+			"token_store", cfg.TokenStore,
+			"redis", cfg.RedisURL != "",
+			"audit_log", cfg.AuditLog != "",
+			"callback", cfg.FrontendURL != nil,
+			"breaker", cfg.BreakerThreshold > 0,
+			"exchange_dedup", cfg.ExchangeDedupWindow > 0,
+			"self_test", cfg.SelfTest,
+			"pprof", cfg.PprofEnabled,
+			"h2c", cfg.H2CEnabled,
+			"dry_run", cfg.DryRun,
+			"debug_bodies", cfg.DebugBodies,
+		),
+	)
+}
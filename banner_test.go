@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestStartupBanner(t *testing.T) {
+	secrets := []string{"dropbox-app-secret", "proxy-api-key-0123", "hunter2", "0123456789abcdef0123456789abcdef"}
+	cfg := testConfig(t, "http://dropbox.invalid",
+		"DROPBOX_CLIENT_SECRET", secrets[0],
+		"PROXY_API_KEY", secrets[1],
+		"REDIS_URL", "redis://:"+secrets[2]+"@cache:6379/0",
+		"STATE_SECRET", secrets[3],
+		"LISTEN_ADDR", ":8080")
+	logs := captureLogs(t)
+	logStartup(cfg)
+
+	for _, secret := range secrets {
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("banner contains secret %q:\n%s", secret, logs)
+		}
+	}
+
+	var banner struct {
+		Msg             string   `json:"msg"`
+		Version         string   `json:"version"`
+		ListenAddr      string   `json:"listen_addr"`
+		TLS             string   `json:"tls"`
+		Providers       []string `json:"providers"`
+		ClientID        string   `json:"client_id"`
+		ClientSecretSet bool     `json:"client_secret_set"`
+		APIKeySet       bool     `json:"api_key_set"`
+		Timeouts        struct {
+			Request string `json:"request"`
+		} `json:"timeouts"`
+		RateLimit struct {
+			Burst int `json:"burst"`
+		} `json:"rate_limit"`
+		Features struct {
+			Redis bool `json:"redis"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(logs.Bytes(), &banner); err != nil {
+		t.Fatalf("banner is not one JSON line: %v\n%s", err, logs)
+	}
+	if banner.Msg != "starting todosrv" || banner.Version != version || banner.ListenAddr != ":8080" || banner.TLS != tlsModeOff {
+		t.Errorf("msg %q, version %q, listen_addr %q, tls %q", banner.Msg, banner.Version, banner.ListenAddr, banner.TLS)
+	}
+	if banner.ClientID != "client-id" || !banner.ClientSecretSet || !banner.APIKeySet || !banner.Features.Redis {
+		t.Errorf("client_id %q, client_secret_set %v, api_key_set %v, redis %v", banner.ClientID, banner.ClientSecretSet, banner.APIKeySet, banner.Features.Redis)
+	}
+	if len(banner.Providers) != 1 || banner.Providers[0] != defaultProvider || banner.Timeouts.Request == "" || banner.RateLimit.Burst != cfg.RateLimitBurst {
+		t.Errorf("providers %q, request timeout %q, burst %d", banner.Providers, banner.Timeouts.Request, banner.RateLimit.Burst)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// maxBatchSize bounds how many refreshes one request can ask for.
+	maxBatchSize = 100
+	// batchConcurrency is how many of a batch's refreshes run at once. The
+	// upstream semaphore still applies to each of them.
+	batchConcurrency = 4
+)
+
+// BatchRefreshRequest lists refresh tokens to refresh in one call.
+type BatchRefreshRequest struct {
+	RefreshTokens []string `json:"refresh_tokens"`
+}
+
+// BatchRefreshResult is one token's outcome, in the position of its token in
+// the request. Error holds the error body a single refresh would have
+// returned.
+type BatchRefreshResult struct {
+	Status int                   `json:"status"`
+	Token  *DropboxTokenResponse `json:"token,omitempty"`
+	Error  json.RawMessage       `json:"error,omitempty"`
+}
+
+// batchRefreshHandler refreshes several tokens, each exactly as refreshHandler
+// would, and reports every outcome separately. The batch itself only fails
+// when the request is malformed. The route's rate limits pay for the first
+// token and every further one is charged the same way, so a batch can't
+// refresh more than single requests could; once a bucket runs dry the rest
+// of the batch is answered with 429 without reaching Dropbox.
+func (s *server) batchRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := s.provider(w, r)
+	if !ok {
+		return
+	}
+
+	var req BatchRefreshRequest
+	if !s.decodeBody(w, r, &req) {
+		return
+	}
+	if len(req.RefreshTokens) == 0 {
+		writeError(w, r, errCodeInvalidRequest, "refresh_tokens is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.RefreshTokens) > maxBatchSize {
+		writeError(w, r, errCodeInvalidRequest, fmt.Sprintf("at most %d refresh_tokens per batch", maxBatchSize), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]BatchRefreshResult, len(req.RefreshTokens))
+	allowed := 1
+	for ; allowed < len(req.RefreshTokens); allowed++ {
+		ok, wait := s.allowExtra(r, provider)
+		if !ok {
+			logger(r.Context()).Warn("batch rate limited", "provider", provider.Name, "allowed", allowed, "size", len(results))
+			for i := allowed; i < len(results); i++ {
+				results[i] = rateLimitedResult(r, wait)
+			}
+			break
+		}
+	}
+
+	slots := make(chan struct{}, batchConcurrency)
+	var wg sync.WaitGroup
+	for i, refreshToken := range req.RefreshTokens[:allowed] {
+		slots <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-slots }()
+			results[i] = s.refreshOne(r, provider, refreshToken)
+		})
+	}
+	wg.Wait()
+
+	logger(r.Context()).Debug("refreshed batch", "provider", provider.Name, "size", len(results))
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(results)
+}
+
+func (s *server) refreshOne(r *http.Request, provider Provider, refreshToken string) BatchRefreshResult {
+	rec := newCapturedResponse()
+	if !validGrantValue(refreshToken) {
+		writeError(rec, r, errCodeInvalidRequest, "refresh_token is missing or malformed", http.StatusBadRequest)
+	} else if token := s.refresh(rec, r, provider, refreshToken); token != nil {
+		return BatchRefreshResult{Status: rec.status, Token: token}
+	}
+	return BatchRefreshResult{Status: rec.status, Error: json.RawMessage(rec.body.Bytes())}
+}
+
+func rateLimitedResult(r *http.Request, wait time.Duration) BatchRefreshResult {
+	rec := newCapturedResponse()
+	writeRateLimited(rec, r, wait, "rate limit exceeded")
+	return BatchRefreshResult{Status: rec.status, Error: json.RawMessage(rec.body.Bytes())}
+}
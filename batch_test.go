@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestBatchRefresh(t *testing.T) {
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("refresh_token") == "bad" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		tokenHandler(w, r)
+	})
+	_, h := newTestServer(t, testConfig(t, stub.URL))
+
+	w := do(h, "POST", "/api/dropbox/refresh/batch", contentTypeJSON, `{"refresh_tokens":["a","bad","b"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	results := decodeJSON[[]BatchRefreshResult](t, w)
+	want := []int{http.StatusOK, http.StatusBadRequest, http.StatusOK}
+	for i, res := range results {
+		if res.Status != want[i] {
+			t.Errorf("result %d status = %d, want %d", i, res.Status, want[i])
+		}
+	}
+}
+
+// Each token in a batch costs as much rate limit as a refresh of its own.
+func TestBatchRefreshChargesEachToken(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	cfg := testConfig(t, stub.URL, "RATE_LIMIT_RPS", "0.001", "RATE_LIMIT_BURST", "3")
+	_, h := newTestServer(t, cfg)
+
+	w := do(h, "POST", "/api/dropbox/refresh/batch", contentTypeJSON, `{"refresh_tokens":["a","b","c","d","e"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	results := decodeJSON[[]BatchRefreshResult](t, w)
+	want := []int{200, 200, 200, 429, 429}
+	for i, res := range results {
+		if res.Status != want[i] {
+			t.Errorf("result %d status = %d, want %d", i, res.Status, want[i])
+		}
+	}
+	if n := stub.calls.Load(); n != 3 {
+		t.Errorf("dropbox called %d times, want 3", n)
+	}
+
+	if w := do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"f"}`); w.Code != http.StatusTooManyRequests {
+		t.Errorf("refresh after batch: status = %d, want 429", w.Code)
+	}
+}
+
+func TestBatchRefreshChargesClientQuota(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	cfg := testConfig(t, stub.URL, "CLIENT_RATE_LIMIT_RPS", "0.001", "CLIENT_RATE_LIMIT_BURST", "2")
+	_, h := newTestServer(t, cfg)
+
+	w := do(h, "POST", "/api/dropbox/refresh/batch", contentTypeJSON, `{"refresh_tokens":["a","b","c"]}`)
+	results := decodeJSON[[]BatchRefreshResult](t, w)
+	if results[1].Status != http.StatusOK || results[2].Status != http.StatusTooManyRequests {
+		t.Errorf("statuses = %d, %d, %d", results[0].Status, results[1].Status, results[2].Status)
+	}
+}
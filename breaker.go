@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// breaker is a circuit breaker for Dropbox. After threshold consecutive
+// failures it opens and calls fail fast for cooldown; then a single probe is
+// let through, which closes the circuit on success or reopens it on failure.
+// A nil *breaker never opens.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time // zero while closed
+	probing  bool
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a call may go upstream. When it may not, it also
+// reports how long until it is worth retrying. Every allowed call must be
+// followed by record or abandon.
+func (b *breaker) allow(now time.Time) (bool, time.Duration) {
+	if b == nil {
+		return true, 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openedAt.IsZero() {
+		return true, 0
+	}
+	if wait := b.openedAt.Add(b.cooldown).Sub(now); wait > 0 {
+		return false, wait
+	}
+	if b.probing {
+		return false, time.Second
+	}
+
+	b.probing = true
+	slog.Info("circuit half-open, probing dropbox")
+	return true, 0
+}
+
+// record counts the outcome of an allowed call.
+func (b *breaker) record(failed bool, now time.Time) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+
+	if !failed {
+		if !b.openedAt.IsZero() {
+			slog.Info("circuit closed, dropbox recovered")
+		}
+		b.failures = 0
+		b.openedAt = time.Time{}
+		return
+	}
+
+	b.failures++
+	if b.openedAt.IsZero() && b.failures < b.threshold {
+		return
+	}
+	if b.openedAt.IsZero() {
+		slog.Warn("circuit open, failing dropbox calls fast", "failures", b.failures, "cooldown", b.cooldown.String())
+	}
+	b.openedAt = now
+}
+
+// abandon ends an allowed call that says nothing about Dropbox's health,
+// such as one the client cancelled.
+func (b *breaker) abandon() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBreakerTransitions(t *testing.T) {
+	b := newBreaker(3, 10*time.Second)
+	now := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+	call := func(failed bool) {
+		t.Helper()
+		if ok, _ := b.allow(now); !ok {
+			t.Fatalf("call refused at %v", now)
+		}
+		b.record(failed, now)
+	}
+
+	// Closed: failures below the threshold, and a success resets the count.
+	call(true)
+	call(true)
+	call(false)
+	call(true)
+	call(true)
+	if ok, _ := b.allow(now); !ok {
+		t.Fatal("opened before 3 consecutive failures")
+	}
+	b.record(true, now)
+
+	// Open: fail fast with the time left in the cooldown.
+	now = now.Add(4 * time.Second)
+	if ok, wait := b.allow(now); ok || wait != 6*time.Second {
+		t.Fatalf("open circuit: allow = %v, wait %v; want false, 6s", ok, wait)
+	}
+
+	// Half-open: one probe only, and a failed probe reopens.
+	now = now.Add(6 * time.Second)
+	if ok, _ := b.allow(now); !ok {
+		t.Fatal("no probe after the cooldown")
+	}
+	if ok, _ := b.allow(now); ok {
+		t.Fatal("second call let through while probing")
+	}
+	b.record(true, now)
+	if ok, wait := b.allow(now); ok || wait != 10*time.Second {
+		t.Fatalf("after a failed probe: allow = %v, wait %v; want a fresh cooldown", ok, wait)
+	}
+
+	// A successful probe closes the circuit.
+	now = now.Add(10 * time.Second)
+	call(false)
+	for range 2 {
+		call(true)
+	}
+	if ok, _ := b.allow(now); !ok {
+		t.Error("circuit did not close after a successful probe")
+	}
+}
+
+// An abandoned probe frees the slot for the next caller.
+func TestBreakerAbandonedProbe(t *testing.T) {
+	b := newBreaker(1, time.Second)
+	now := time.Now()
+	b.allow(now)
+	b.record(true, now)
+
+	now = now.Add(time.Second)
+	b.allow(now)
+	b.abandon()
+	if ok, _ := b.allow(now); !ok {
+		t.Error("abandoned probe still blocks")
+	}
+}
+
+func TestBreakerFailsFast(t *testing.T) {
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	cfg := testConfig(t, stub.URL, "DROPBOX_BREAKER_THRESHOLD", "2", "DROPBOX_BREAKER_COOLDOWN", "30s", "DROPBOX_MAX_ATTEMPTS", "1", "RATE_LIMIT_BURST", "100")
+	_, h, clock := newClockedTestServer(t, cfg)
+	refresh := func() *httptest.ResponseRecorder {
+		return do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"r"}`)
+	}
+
+	refresh()
+	refresh()
+	w := refresh()
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "30" {
+		t.Errorf("open circuit: status %d, Retry-After %q; want 503, 30", w.Code, w.Header().Get("Retry-After"))
+	}
+	if got := decodeJSON[map[string]string](t, w)["code"]; got != errCodeUpstreamUnavailable {
+		t.Errorf("code = %q", got)
+	}
+	if n := stub.calls.Load(); n != 2 {
+		t.Errorf("dropbox called %d times, want 2 before the circuit opened", n)
+	}
+
+	clock.Advance(30 * time.Second)
+	refresh()
+	if n := stub.calls.Load(); n != 3 {
+		t.Errorf("no probe after the cooldown: %d calls", n)
+	}
+}
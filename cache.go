@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+type cacheEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// ttlCache is a concurrency-safe map whose entries expire individually.
+// Expired entries are never returned; cleanup removes them from memory.
+type ttlCache[V any] struct {
+	mu      sync.Mutex
+	clock   Clock
+	entries map[string]cacheEntry[V]
+}
+
+func newTTLCache[V any](clock Clock) *ttlCache[V] {
+	return &ttlCache[V]{clock: clock, entries: make(map[string]cacheEntry[V])}
+}
+
+func (c *ttlCache[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || !c.clock.Now().Before(entry.expires) {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+func (c *ttlCache[V]) set(key string, value V, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = cacheEntry[V]{value: value, expires: c.clock.Now().Add(ttl)}
+}
+
+func (c *ttlCache[V]) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, key)
+}
+
+// deletePrefix removes every entry whose key starts with prefix.
+func (c *ttlCache[V]) deletePrefix(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *ttlCache[V]) evict(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// sweeper is implemented by in-memory stores that must be pruned in the
+// background.
+type sweeper interface {
+	cleanup(ctx context.Context, interval time.Duration)
+}
+
+// cleanup evicts expired entries every interval until ctx is done.
+func (c *ttlCache[V]) cleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.evict(c.clock.Now())
+		}
+	}
+}
+
+// cacheKey hashes its parts so secrets such as refresh tokens are never held
+// in memory as map keys.
+func cacheKey(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
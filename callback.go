@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// callbackHandler completes the authorization-code flow server-side: the
+// provider redirects the browser here, the code is exchanged, and the browser
+// is sent on to FRONTEND_URL with the tokens in the URL fragment, which
+// browsers never send to servers. Failures redirect with error and
+// error_description query parameters instead.
+func (s *server) callbackHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := s.provider(w, r)
+	if !ok {
+		return
+	}
+
+	log := logger(r.Context()).With("provider", provider.Name)
+	query := r.URL.Query()
+
+	if code := query.Get("error"); code != "" {
+		log.Info("authorization denied", "error", code)
+		s.redirectWithError(w, r, code, query.Get("error_description"))
+		return
+	}
+
+	if err := s.verifyState(r.Context(), query.Get("state"), s.clock.Now()); err != nil {
+		log.Warn("rejected callback state", "error", err)
+		s.redirectWithError(w, r, "invalid_state", "The sign-in request expired or was not started by this app.")
+		return
+	}
+
+	code := query.Get("code")
+	if !validGrantValue(code) {
+		s.redirectWithError(w, r, "invalid_request", "The authorization code is missing or malformed.")
+		return
+	}
+
+	data := url.Values{
+		"code":          {code},
+		"grant_type":    {"authorization_code"},
+		"client_id":     {provider.ClientID},
+		"client_secret": {provider.ClientSecret},
+		"redirect_uri":  {provider.RedirectURI},
+	}
+	if provider.Name == defaultProvider {
+		data.Set("token_access_type", defaultTokenAccessType)
+	}
+	if verifier, ok := s.storedVerifier(query.Get("state")); ok {
+		data.Set("code_verifier", verifier)
+	}
+
+	rec := newCapturedResponse()
+	token := s.exchange(rec, r, provider, data)
+	if token == nil {
+		// Either an oauthError from Dropbox or one of our own errors, whose
+		// machine-readable part is in code.
+		var upstream struct {
+			oauthError
+			Code string `json:"code"`
+		}
+		json.Unmarshal(rec.body.Bytes(), &upstream)
+		if upstream.Code != "" {
+			upstream.Error, upstream.ErrorDescription = upstream.Code, upstream.Error
+		}
+		if upstream.Error == "" {
+			upstream.Error = "exchange_failed"
+		}
+		s.redirectWithError(w, r, upstream.Error, upstream.ErrorDescription)
+		return
+	}
+	auditAccount(r.Context(), token)
+
+	fragment := url.Values{}
+	for key, value := range map[string]string{
+		"access_token":  token.AccessToken,
+		"token_type":    token.TokenType,
+		"refresh_token": token.RefreshToken,
+		"scope":         token.Scope,
+		"account_id":    token.AccountID,
+		"uid":           token.UID,
+		"session_id":    token.SessionID,
+		"expires_at":    token.ExpiresAt,
+	} {
+		if value != "" {
+			fragment.Set(key, value)
+		}
+	}
+	if token.ExpiresIn > 0 {
+		fragment.Set("expires_in", strconv.FormatInt(token.ExpiresIn, 10))
+	}
+
+	target := *s.config(r.Context()).FrontendURL
+	target.Fragment = ""
+	target.RawFragment = ""
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, target.String()+"#"+fragment.Encode(), http.StatusFound)
+}
+
+func (s *server) redirectWithError(w http.ResponseWriter, r *http.Request, code, description string) {
+	target := *s.config(r.Context()).FrontendURL
+	query := target.Query()
+	query.Set("error", code)
+	if description != "" {
+		query.Set("error_description", description)
+	}
+	target.RawQuery = query.Encode()
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const testFrontendURL = "https://app.example/signed-in?tab=files"
+
+func callback(h http.Handler, query url.Values) *http.Response {
+	return do(h, "GET", "/api/dropbox/callback?"+query.Encode(), "", "").Result()
+}
+
+// callbackRedirect parses the Location of a callback response.
+func callbackRedirect(t *testing.T, resp *http.Response) *url.URL {
+	t.Helper()
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Cache-Control") != "no-store" {
+		t.Fatalf("status %d, Cache-Control %q; want an uncached 302", resp.StatusCode, resp.Header.Get("Cache-Control"))
+	}
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loc.Scheme + "://" + loc.Host + loc.Path; got != "https://app.example/signed-in" {
+		t.Errorf("redirected to %s, want FRONTEND_URL", got)
+	}
+	return loc
+}
+
+func TestCallbackTokensInFragment(t *testing.T) {
+	stub, grant := grantRecorder(t)
+	s, h := newTestServer(t, testConfig(t, stub.URL, "FRONTEND_URL", testFrontendURL))
+
+	state := s.newState(context.Background(), s.clock.Now())
+	loc := callbackRedirect(t, callback(h, url.Values{"code": {"code-1"}, "state": {state}}))
+
+	if grant.Get("code") != "code-1" || grant.Get("grant_type") != "authorization_code" || grant.Get("redirect_uri") != "https://app.example/callback" {
+		t.Errorf("grant sent = %v", *grant)
+	}
+	if loc.RawQuery != "tab=files" {
+		t.Errorf("query %q, want FRONTEND_URL's own only", loc.RawQuery)
+	}
+	fragment, err := url.ParseQuery(loc.Fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"access_token":  "sl.access",
+		"refresh_token": "refresh",
+		"account_id":    "dbid:1",
+		"expires_in":    "14400",
+	} {
+		if got := fragment.Get(key); got != want {
+			t.Errorf("fragment %s = %q, want %q", key, got, want)
+		}
+	}
+	if fragment.Get("expires_at") == "" {
+		t.Error("fragment lacks expires_at")
+	}
+}
+
+func TestCallbackRejectsState(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	s, h, clock := newClockedTestServer(t, testConfig(t, stub.URL, "FRONTEND_URL", testFrontendURL, "STATE_TTL", "5m"))
+
+	expired := s.newState(context.Background(), clock.Now())
+	clock.Advance(6 * time.Minute)
+	for name, state := range map[string]string{
+		"missing": "",
+		"forged":  "AAAA.BBBB",
+		"expired": expired,
+	} {
+		loc := callbackRedirect(t, callback(h, url.Values{"code": {"code-1"}, "state": {state}}))
+		if got := loc.Query().Get("error"); got != "invalid_state" || loc.Fragment != "" {
+			t.Errorf("%s state: error %q, fragment %q", name, got, loc.Fragment)
+		}
+	}
+	if n := stub.calls.Load(); n != 0 {
+		t.Errorf("dropbox called %d times for rejected states", n)
+	}
+}
+
+func TestCallbackProviderError(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	_, h := newTestServer(t, testConfig(t, stub.URL, "FRONTEND_URL", testFrontendURL))
+
+	loc := callbackRedirect(t, callback(h, url.Values{"error": {"access_denied"}, "error_description": {"The user chose not to give your app access."}}))
+	query := loc.Query()
+	if query.Get("error") != "access_denied" || query.Get("error_description") != "The user chose not to give your app access." || query.Get("tab") != "files" {
+		t.Errorf("error redirect query = %v", query)
+	}
+	if n := stub.calls.Load(); n != 0 {
+		t.Errorf("dropbox called %d times after a denial", n)
+	}
+}
+
+func TestCallbackUpstreamFailure(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		handler func(http.ResponseWriter, *http.Request)
+		want    string
+	}{
+		{"invalid grant", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":"invalid_grant","error_description":"code doesn't exist or has expired"}`)
+		}, "invalid_grant"},
+		{"outage", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}, "server_error"},
+		{"unreachable", nil, errCodeUpstreamError},
+	} {
+		api := "http://" + freeAddr(t)
+		if tc.handler != nil {
+			api = newStubDropbox(t, tc.handler).URL
+		}
+		s := newServer(testConfig(t, api, "FRONTEND_URL", testFrontendURL, "DROPBOX_MAX_ATTEMPTS", "1"), http.DefaultClient, nil, nil, nil)
+		h, _ := s.routes()
+
+		state := s.newState(context.Background(), s.clock.Now())
+		loc := callbackRedirect(t, callback(h, url.Values{"code": {"code-1"}, "state": {state}}))
+		if got := loc.Query().Get("error"); got != tc.want || loc.Fragment != "" {
+			t.Errorf("%s: error %q, fragment %q; want %s and no tokens", tc.name, got, loc.Fragment, tc.want)
+		}
+	}
+}
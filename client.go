@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// newHTTPClient builds the client shared by every upstream call. Dial and TLS
+// handshake get their own, shorter budgets so an unreachable host fails fast
+// instead of consuming the whole request timeout. Almost all traffic goes to a
+// single host, so the per-host idle pool is what keeps bursts of refreshes
+// from paying for a new TLS handshake each. Requests go through
+// DROPBOX_HTTP_PROXY if set, otherwise the proxy the standard environment
+// variables name.
+//
+// DROPBOX_TIMEOUT covers a whole request, from dial to the end of the body;
+// the keep-alive settings only govern connections between requests. An idle
+// connection is dropped after DROPBOX_IDLE_CONN_TIMEOUT, so set it below any
+// idle limit the network enforces or a reused connection may already be dead.
+// With DROPBOX_DISABLE_KEEP_ALIVES every request dials and handshakes within
+// its own DROPBOX_TIMEOUT.
+func newHTTPClient(cfg Config) *http.Client {
+	connectTimeout := min(cfg.DropboxTimeout, 5*time.Second)
+
+	proxy := http.ProxyFromEnvironment
+	if cfg.DropboxProxy != "" {
+		// Validate has already parsed it.
+		u, _ := parseProxyURL(cfg.DropboxProxy)
+		proxy = http.ProxyURL(u)
+	}
+
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: cfg.TCPKeepAlive,
+		}).DialContext,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		DisableKeepAlives:     cfg.DisableKeepAlives,
+		TLSHandshakeTimeout:   connectTimeout,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+
+	return &http.Client{
+		Timeout:   cfg.DropboxTimeout,
+		Transport: transport,
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPClientSettings(t *testing.T) {
+	cfg := testConfig(t, "http://dropbox.invalid",
+		"DROPBOX_MAX_IDLE_CONNS", "50",
+		"DROPBOX_MAX_IDLE_CONNS_PER_HOST", "20",
+		"DROPBOX_IDLE_CONN_TIMEOUT", "45s")
+	transport := newHTTPClient(cfg).Transport.(*http.Transport)
+	if transport.MaxIdleConns != 50 || transport.MaxIdleConnsPerHost != 20 || transport.IdleConnTimeout != 45*time.Second {
+		t.Errorf("pool = %d idle, %d per host, %v timeout", transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+}
+
+// Sequential calls share one pooled connection unless
+// DROPBOX_DISABLE_KEEP_ALIVES makes each dial its own; an idle connection
+// outliving DROPBOX_IDLE_CONN_TIMEOUT is dropped rather than reused.
+func TestHTTPClientKeepAlives(t *testing.T) {
+	var dials atomic.Int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(tokenHandler))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dials.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	for _, tc := range []struct {
+		name  string
+		env   []string
+		pause time.Duration
+		dials int64
+	}{
+		{"defaults", nil, 0, 1},
+		{"keep-alives disabled", []string{"DROPBOX_DISABLE_KEEP_ALIVES", "true"}, 0, 3},
+		{"idle timeout", []string{"DROPBOX_IDLE_CONN_TIMEOUT", "20ms"}, 60 * time.Millisecond, 3},
+	} {
+		cfg := testConfig(t, srv.URL, tc.env...)
+		client := newHTTPClient(cfg)
+		if tr := client.Transport.(*http.Transport); tr.DisableKeepAlives != cfg.DisableKeepAlives || tr.IdleConnTimeout != cfg.IdleConnTimeout {
+			t.Errorf("%s: transport DisableKeepAlives %v, IdleConnTimeout %v", tc.name, tr.DisableKeepAlives, tr.IdleConnTimeout)
+		}
+		dials.Store(0)
+		for range 3 {
+			resp, err := client.Post(srv.URL+"/oauth2/token", contentTypeForm, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			time.Sleep(tc.pause)
+		}
+		client.CloseIdleConnections()
+		if n := dials.Load(); n != tc.dials {
+			t.Errorf("%s: %d connections for 3 calls, want %d", tc.name, n, tc.dials)
+		}
+	}
+
+	t.Setenv("DROPBOX_TCP_KEEP_ALIVE", "0s")
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "DROPBOX_TCP_KEEP_ALIVE") {
+		t.Errorf("DROPBOX_TCP_KEEP_ALIVE=0s: error %v", err)
+	}
+}
+
+// The default transport keeps 2 idle connections per host, so a burst of
+// parallel refreshes to Dropbox redoes the TLS handshake on most requests.
+// dials/op counts those handshakes, which wall time on a small machine can
+// hide. Compare with:
+//
+//	go test -run '^$' -bench Transport -cpu 16
+func BenchmarkDefaultTransport(b *testing.B) {
+	benchmarkTransport(b, func(Config) *http.Transport {
+		return http.DefaultTransport.(*http.Transport).Clone()
+	})
+}
+
+func BenchmarkTunedTransport(b *testing.B) {
+	benchmarkTransport(b, func(cfg Config) *http.Transport {
+		return newHTTPClient(cfg).Transport.(*http.Transport)
+	})
+}
+
+func benchmarkTransport(b *testing.B, transport func(Config) *http.Transport) {
+	var dials atomic.Int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(tokenHandler))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dials.Add(1)
+		}
+	}
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	tr := transport(testConfig(b, srv.URL))
+	tr.TLSClientConfig = &tls.Config{RootCAs: srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+	// Pooled connections are kept between requests but never carried over
+	// from another benchmark run.
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+
+	b.SetParallelism(4)
+	b.ResetTimer()
+	defer func() { b.ReportMetric(float64(dials.Load())/float64(b.N), "dials/op") }()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp, err := client.Post(srv.URL+"/oauth2/token", contentTypeForm, nil)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	})
+}
+
+func TestHTTPClientProxy(t *testing.T) {
+	var proxied atomic.Value
+	proxy := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		proxied.Store(r.URL.String())
+		tokenHandler(w, r)
+	})
+	cfg := testConfig(t, "http://dropbox.invalid", "DROPBOX_HTTP_PROXY", proxy.URL)
+	public, _ := newServer(cfg, newHTTPClient(cfg), nil, nil, nil).routes()
+
+	w := do(public, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"r"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	if got, _ := proxied.Load().(string); got != "http://dropbox.invalid/oauth2/token" {
+		t.Errorf("proxy saw %q, want the absolute Dropbox URL", got)
+	}
+}
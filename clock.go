@@ -0,0 +1,14 @@
+package main
+
+import "time"
+
+// Clock is the time source for expiry, TTL and rate-limit decisions, so
+// tests can move time forward instead of sleeping. Latency measurements keep
+// using time.Now directly.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// newClockedTestServer is newTestServer with a fake clock.
+func newClockedTestServer(t *testing.T, cfg Config) (*server, http.Handler, *fakeClock) {
+	t.Helper()
+	clock := newFakeClock()
+	s := newServerWithClock(cfg, http.DefaultClient, nil, nil, nil, clock)
+	public, _ := s.routes()
+	return s, public, clock
+}
+
+func TestTTLCacheExpiry(t *testing.T) {
+	clock := newFakeClock()
+	c := newTTLCache[string](clock)
+	c.set("k", "v", time.Minute)
+
+	clock.Advance(59 * time.Second)
+	if v, ok := c.get("k"); !ok || v != "v" {
+		t.Fatalf("get before expiry = %q, %v", v, ok)
+	}
+	clock.Advance(time.Second)
+	if _, ok := c.get("k"); ok {
+		t.Error("entry returned at its expiry")
+	}
+
+	c.evict(clock.Now())
+	if len(c.entries) != 0 {
+		t.Errorf("evict left %d entries", len(c.entries))
+	}
+}
+
+func TestTTLCacheIgnoresNonPositiveTTL(t *testing.T) {
+	c := newTTLCache[string](newFakeClock())
+	c.set("k", "v", 0)
+	if _, ok := c.get("k"); ok {
+		t.Error("zero TTL entry stored")
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	clock := newFakeClock()
+	l := newRateLimiter(newMemoryBuckets(clock), clock, 1, 2, false)
+
+	for i := range 2 {
+		if ok, _ := l.allow("ip"); !ok {
+			t.Fatalf("request %d refused within burst", i)
+		}
+	}
+	ok, wait := l.allow("ip")
+	if ok || wait != time.Second {
+		t.Fatalf("past burst = %v, wait %s; want refused with 1s wait", ok, wait)
+	}
+
+	clock.Advance(time.Second)
+	if ok, _ := l.allow("ip"); !ok {
+		t.Error("not refilled after a second")
+	}
+	if ok, _ := l.allow("ip"); ok {
+		t.Error("refilled more than one token")
+	}
+}
+
+func TestMemoryBucketsEvictFullBuckets(t *testing.T) {
+	clock := newFakeClock()
+	b := newMemoryBuckets(clock)
+	b.take("ip", 1, 2, clock.Now())
+
+	clock.Advance(time.Second)
+	b.evict(clock.Now())
+	if len(b.buckets) != 1 {
+		t.Fatal("evicted a bucket still refilling")
+	}
+	clock.Advance(2 * time.Second)
+	b.evict(clock.Now())
+	if len(b.buckets) != 0 {
+		t.Error("kept a full bucket")
+	}
+}
+
+func TestStateExpiry(t *testing.T) {
+	s, _, clock := newClockedTestServer(t, testConfig(t, "https://api.example", "STATE_TTL", "10m"))
+	ctx := context.Background()
+	state := s.newState(ctx, clock.Now())
+
+	clock.Advance(10 * time.Minute)
+	if err := s.verifyState(ctx, state, clock.Now()); err != nil {
+		t.Fatalf("state at its TTL: %v", err)
+	}
+	clock.Advance(time.Second)
+	if err := s.verifyState(ctx, state, clock.Now()); err != errStateExpired {
+		t.Errorf("state past its TTL: %v, want errStateExpired", err)
+	}
+}
+
+func TestTokenExpiresAtUsesClock(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	_, h, clock := newClockedTestServer(t, testConfig(t, stub.URL))
+
+	w := do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"r"}`)
+	got := decodeJSON[DropboxTokenResponse](t, w)
+	if want := clock.Now().Add(14400 * time.Second).Format(time.RFC3339); got.ExpiresAt != want {
+		t.Errorf("expires_at = %q, want %q", got.ExpiresAt, want)
+	}
+}
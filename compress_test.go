@@ -0,0 +1,147 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func gzipRequest(h http.Handler, method, path, acceptEncoding string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	if acceptEncoding != "" {
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// fixedBody serves size bytes of contentType, declaring the length as
+// handlers that know it do.
+func fixedBody(contentType string, size int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		w.WriteHeader(http.StatusCreated)
+		body := strings.Repeat("a", size)
+		// Several writes, so the buffering straddles the threshold.
+		io.WriteString(w, body[:size/2])
+		io.WriteString(w, body[size/2:])
+	})
+}
+
+func gunzip(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestGzip(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		contentType    string
+		size           int
+		acceptEncoding string
+		gzipped        bool
+	}{
+		{"large json", contentTypeJSON, 4096, "gzip, deflate", true},
+		{"large text", "text/plain; charset=utf-8", 4096, "br;q=1, *", true},
+		{"at the threshold", contentTypeJSON, gzipMinSize, "gzip", true},
+		{"under the threshold", contentTypeJSON, gzipMinSize - 1, "gzip", false},
+		{"gzip refused", contentTypeJSON, 4096, "gzip;q=0, identity", false},
+		{"no accept-encoding", contentTypeJSON, 4096, "", false},
+		{"binary", "application/octet-stream", 4096, "gzip", false},
+		{"no content type", "", 4096, "gzip", false},
+	} {
+		w := gzipRequest(withGzip(fixedBody(tc.contentType, tc.size)), "GET", "/", tc.acceptEncoding)
+		if w.Code != http.StatusCreated || w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s: status %d, Vary %q", tc.name, w.Code, w.Header().Get("Vary"))
+		}
+		if !tc.gzipped {
+			if w.Header().Get("Content-Encoding") != "" || w.Body.Len() != tc.size || w.Header().Get("Content-Length") != strconv.Itoa(tc.size) {
+				t.Errorf("%s: Content-Encoding %q, Content-Length %q, %d bytes; want it unchanged", tc.name, w.Header().Get("Content-Encoding"), w.Header().Get("Content-Length"), w.Body.Len())
+			}
+			continue
+		}
+		if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Content-Length") != "" {
+			t.Errorf("%s: Content-Encoding %q, Content-Length %q", tc.name, w.Header().Get("Content-Encoding"), w.Header().Get("Content-Length"))
+			continue
+		}
+		if body := gunzip(t, w); body != strings.Repeat("a", tc.size) {
+			t.Errorf("%s: decompressed %d bytes, want %d", tc.name, len(body), tc.size)
+		}
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"gzip":              true,
+		"deflate, gzip;q=1": true,
+		"*":                 true,
+		"gzip;q=0.5":        true,
+		"gzip;q=0":          false,
+		"gzip; q=0.0":       false,
+		"identity":          false,
+		"":                  false,
+	} {
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestGzipWithWriteError(t *testing.T) {
+	for _, size := range []int{10, 4096} {
+		message := strings.Repeat("m", size)
+		h := withGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeError(w, r, errCodeInvalidRequest, message, http.StatusBadRequest)
+		}))
+		w := gzipRequest(h, "POST", "/", "gzip")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%d-byte message: status %d", size, w.Code)
+		}
+		if size < gzipMinSize {
+			if w.Header().Get("Content-Encoding") != "" || w.Header().Get("Content-Length") != strconv.Itoa(w.Body.Len()) {
+				t.Errorf("small error: Content-Encoding %q, Content-Length %q for %d bytes", w.Header().Get("Content-Encoding"), w.Header().Get("Content-Length"), w.Body.Len())
+			}
+			continue
+		}
+		if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Content-Length") != "" {
+			t.Errorf("large error: Content-Encoding %q, Content-Length %q", w.Header().Get("Content-Encoding"), w.Header().Get("Content-Length"))
+			continue
+		}
+		if body := gunzip(t, w); !strings.Contains(body, `"code":"`+errCodeInvalidRequest+`"`) || !strings.Contains(body, message) {
+			t.Errorf("large error decompressed to %.60q", body)
+		}
+	}
+}
+
+// A preflight has no body to compress and must keep its CORS headers.
+func TestGzipWithPreflight(t *testing.T) {
+	_, h := newTestServer(t, testConfig(t, "http://dropbox.invalid"))
+
+	r := httptest.NewRequest(http.MethodOptions, "/api/dropbox/refresh", nil)
+	r.Header.Set("Origin", "http://localhost:4200")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("status %d, %d bytes, Content-Encoding %q; want a bare 204", w.Code, w.Body.Len(), w.Header().Get("Content-Encoding"))
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "http://localhost:4200" || !strings.Contains(w.Header().Get("Access-Control-Allow-Methods"), "POST") {
+		t.Errorf("CORS headers lost: %v", w.Header())
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// semaphore bounds concurrent upstream requests. A nil semaphore doesn't
+// limit anything.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+// acquire waits up to timeout for a slot. It gives up early if ctx is done.
+func (s semaphore) acquire(ctx context.Context, timeout time.Duration) (release func(), ok bool) {
+	if s == nil {
+		return func() {}, true
+	}
+
+	select {
+	case s <- struct{}{}:
+	default:
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case s <- struct{}{}:
+		case <-timer.C:
+			return nil, false
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+
+	var once sync.Once
+	return func() { once.Do(func() { <-s }) }, true
+}
+
+// releasingBody frees the upstream slot once the response body is closed, so
+// the slot covers reading the body and not just the round trip.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
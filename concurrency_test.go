@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamConcurrencyCap(t *testing.T) {
+	var inFlight, peak atomic.Int64
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(20 * time.Millisecond)
+		tokenHandler(w, r)
+	})
+	cfg := testConfig(t, stub.URL, "DROPBOX_MAX_CONCURRENCY", "3", "RATE_LIMIT_BURST", "100")
+	_, h := newTestServer(t, cfg)
+
+	var wg sync.WaitGroup
+	statuses := make([]int, 12)
+	for i := range statuses {
+		wg.Go(func() {
+			body := fmt.Sprintf(`{"refresh_token":"r%d"}`, i)
+			statuses[i] = do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, body).Code
+		})
+	}
+	wg.Wait()
+
+	if p := peak.Load(); p > 3 {
+		t.Errorf("%d concurrent dropbox calls, limit is 3", p)
+	}
+	for i, status := range statuses {
+		if status != http.StatusOK {
+			t.Errorf("request %d: status %d; queued requests should all succeed", i, status)
+		}
+	}
+}
+
+func TestUpstreamQueueTimeout(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+		tokenHandler(w, r)
+	})
+	cfg := testConfig(t, stub.URL, "DROPBOX_MAX_CONCURRENCY", "1", "DROPBOX_QUEUE_TIMEOUT", "10ms")
+	_, h := newTestServer(t, cfg)
+
+	first := make(chan int)
+	go func() {
+		first <- do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"a"}`).Code
+	}()
+	<-entered
+
+	w := do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"b"}`)
+	close(release)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("over the limit: status %d, Retry-After %q; want 503 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+	if status := <-first; status != http.StatusOK {
+		t.Errorf("request holding the slot: status %d", status)
+	}
+}
+
+func TestSemaphoreRelease(t *testing.T) {
+	s := newSemaphore(1)
+	release, ok := s.acquire(t.Context(), 0)
+	if !ok {
+		t.Fatal("empty semaphore refused")
+	}
+	if _, ok := s.acquire(t.Context(), time.Millisecond); ok {
+		t.Fatal("full semaphore granted a slot")
+	}
+	release()
+	release()
+	if _, ok := s.acquire(t.Context(), 0); !ok {
+		t.Error("slot not freed by release")
+	}
+	if _, ok := s.acquire(t.Context(), 0); ok {
+		t.Error("double release freed two slots")
+	}
+	if _, ok := newSemaphore(0).acquire(t.Context(), 0); !ok {
+		t.Error("unlimited semaphore refused")
+	}
+}
@@ -0,0 +1,904 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultDropboxAPIURL = "https://api.dropboxapi.com"
+
+type Config struct {
+	ClientID       string
+	ClientSecret   string
+	RedirectURI    string
+	RedirectURIs   []string
+	Providers      map[string]Provider
+	DropboxAPIURL  string
+	ListenAddr     string
+	AllowedOrigins []string
+	LogLevel       slog.Level
+	RateLimitRPS   float64
+	RateLimitBurst int
+
+	// ClientRateLimitRPS and ClientRateLimitBurst are the default per-client
+	// ID limits; see Provider.
+	ClientRateLimitRPS   float64
+	ClientRateLimitBurst int
+	TrustProxy           bool
+	APIKey               string
+	StateSecret          []byte
+	StateTTL             time.Duration
+	MaxBodyBytes         int64
+
+	DropboxTimeout   time.Duration
+	RetryMaxAttempts int
+	RetryBaseDelay   time.Duration
+	UserAgent        string
+
+	// MaxUpstreamBody caps how many bytes of a Dropbox response are read;
+	// anything larger is answered with a 502.
+	MaxUpstreamBody int64
+
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+
+	// DisableKeepAlives closes each Dropbox connection after one request.
+	// TCPKeepAlive is the probe interval on open connections, which keeps
+	// them alive through middleboxes that drop quiet sockets.
+	DisableKeepAlives bool
+	TCPKeepAlive      time.Duration
+
+	MaxUpstreamConcurrency int
+	UpstreamQueueTimeout   time.Duration
+
+	// PreShutdownDelay is how long a draining instance keeps serving before
+	// its listeners close, so load balancers can notice /readyz failing.
+	PreShutdownDelay time.Duration
+	ShutdownTimeout  time.Duration
+	MetricsEnabled   bool
+
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// AutocertEnabled obtains certificates for AutocertDomains from Let's
+	// Encrypt instead of reading TLS_CERT_FILE and TLS_KEY_FILE.
+	AutocertEnabled  bool
+	AutocertDomains  []string
+	AutocertCacheDir string
+	AutocertEmail    string
+
+	// HTTPRedirectAddr, when TLS is enabled, is a plain HTTP listener that
+	// redirects to HTTPS. In autocert mode it defaults to :80 and also
+	// answers the ACME challenge.
+	HTTPRedirectAddr string
+
+	// HSTSMaxAge and HSTSIncludeSubdomains shape the
+	// Strict-Transport-Security header sent on HTTPS responses.
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+
+	FrontendURL *url.URL
+
+	TokenCacheEnabled bool
+	TokenCacheTTL     time.Duration
+	TokenCacheMargin  time.Duration
+
+	// AccountCacheTTL is how long an account lookup is reused for the same
+	// access token. Zero disables the cache; ETags are sent either way.
+	AccountCacheTTL time.Duration
+
+	TracingEndpoint string
+	ServiceName     string
+	// TracingHeaders are sent with every span export, typically the
+	// collector's API key.
+	TracingHeaders http.Header
+
+	SelfTest         bool
+	SelfTestFailFast bool
+
+	IdempotencyTTL time.Duration
+
+	// ExchangeDedupWindow is how long an exchanged code is remembered so a
+	// double-submit is answered from the first result. Within the window,
+	// anyone resubmitting the same code with the same parameters receives
+	// the first caller's tokens rather than Dropbox's invalid_grant, so it
+	// is opt-in: zero, the default, disables it.
+	ExchangeDedupWindow time.Duration
+
+	TokenStore     string
+	TokenStorePath string
+
+	// AuditLog is where audit records go: "stdout", a file path, or empty
+	// for none.
+	AuditLog string
+
+	// AdminAddr, when set, is a second listener for the admin, health and
+	// metrics endpoints, which then leave ListenAddr.
+	AdminAddr string
+
+	// DebugBodies logs API request and response bodies with secrets masked;
+	// see withBodyLogging.
+	DebugBodies bool
+
+	// DryRun answers token grants with a canned token instead of calling
+	// Dropbox; see dryRunToken.
+	DryRun bool
+
+	// H2CEnabled accepts unencrypted HTTP/2 with prior knowledge on a plain
+	// HTTP public listener. With TLS, HTTP/2 is always negotiated.
+	H2CEnabled bool
+
+	// PprofEnabled serves net/http/pprof under /debug/pprof/ on AdminAddr.
+	PprofEnabled bool
+
+	// BreakerThreshold consecutive Dropbox failures open the circuit for
+	// BreakerCooldown. A zero threshold disables the breaker.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// RequestTimeout bounds each request, upstream calls included.
+	RequestTimeout time.Duration
+
+	// DropboxProxy, when set, is the forward proxy for every upstream
+	// request, in place of HTTPS_PROXY, HTTP_PROXY and NO_PROXY.
+	DropboxProxy string
+
+	// RedisURL, when set, moves rate-limit and token-cache state into Redis
+	// so replicas share it.
+	RedisURL string
+
+	// ForwardedHeaders are the Dropbox response headers relayed to clients,
+	// in canonical form.
+	ForwardedHeaders []string
+
+	CORSMaxAge           time.Duration
+	CORSAllowCredentials bool
+	CORSAllowedHeaders   []string
+
+	// CORSAllowedMethods overrides the methods derived from the routes.
+	CORSAllowedMethods []string
+}
+
+// The TLS modes; Validate makes sure at most one is configured.
+const (
+	tlsModeOff      = "off"
+	tlsModeFiles    = "files"
+	tlsModeAutocert = "autocert"
+)
+
+func (c Config) TLSMode() string {
+	switch {
+	case c.AutocertEnabled:
+		return tlsModeAutocert
+	case c.TLSCertFile != "" && c.TLSKeyFile != "":
+		return tlsModeFiles
+	default:
+		return tlsModeOff
+	}
+}
+
+func (c Config) TLSEnabled() bool {
+	return c.TLSMode() != tlsModeOff
+}
+
+// Validate reports every missing or out-of-range field at once so a first
+// run surfaces the whole list instead of failing one variable at a time.
+func (c Config) Validate() []error {
+	var errs []error
+
+	if c.ClientID == "" {
+		errs = append(errs, missingVarError("DROPBOX_CLIENT_ID"))
+	}
+	if c.ClientSecret == "" {
+		errs = append(errs, missingVarError("DROPBOX_CLIENT_SECRET"))
+	}
+	if c.RedirectURI == "" {
+		errs = append(errs, missingVarError("DROPBOX_REDIRECT_URI"))
+	} else if u, err := url.Parse(c.RedirectURI); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("DROPBOX_REDIRECT_URI: %q must be an absolute http or https URL", c.RedirectURI))
+	}
+
+	if c.RateLimitRPS < 0 {
+		errs = append(errs, errors.New("RATE_LIMIT_RPS: must not be negative"))
+	}
+	if c.RateLimitBurst < 1 {
+		errs = append(errs, errors.New("RATE_LIMIT_BURST: must be at least 1"))
+	}
+	if c.ClientRateLimitRPS < 0 {
+		errs = append(errs, errors.New("CLIENT_RATE_LIMIT_RPS: must not be negative"))
+	}
+	if c.ClientRateLimitBurst < 1 {
+		errs = append(errs, errors.New("CLIENT_RATE_LIMIT_BURST: must be at least 1"))
+	}
+	if c.StateTTL <= 0 {
+		errs = append(errs, errors.New("STATE_TTL: must be positive"))
+	}
+	if c.MaxBodyBytes < 1 {
+		errs = append(errs, errors.New("MAX_BODY_BYTES: must be positive"))
+	}
+	if c.MaxUpstreamBody < 1 {
+		errs = append(errs, errors.New("DROPBOX_MAX_RESPONSE_BYTES: must be positive"))
+	}
+	if c.DropboxTimeout <= 0 {
+		errs = append(errs, errors.New("DROPBOX_TIMEOUT: must be positive"))
+	}
+	if c.RetryMaxAttempts < 1 {
+		errs = append(errs, errors.New("DROPBOX_MAX_ATTEMPTS: must be at least 1"))
+	}
+	if c.RetryBaseDelay < 0 {
+		errs = append(errs, errors.New("DROPBOX_RETRY_BASE_DELAY: must not be negative"))
+	}
+	if c.MaxIdleConns < 0 {
+		errs = append(errs, errors.New("DROPBOX_MAX_IDLE_CONNS: must not be negative"))
+	}
+	if c.MaxIdleConnsPerHost < 0 {
+		errs = append(errs, errors.New("DROPBOX_MAX_IDLE_CONNS_PER_HOST: must not be negative"))
+	}
+	if c.IdleConnTimeout < 0 {
+		errs = append(errs, errors.New("DROPBOX_IDLE_CONN_TIMEOUT: must not be negative"))
+	}
+	if c.TCPKeepAlive <= 0 {
+		errs = append(errs, errors.New("DROPBOX_TCP_KEEP_ALIVE: must be positive"))
+	}
+	if c.MaxUpstreamConcurrency < 0 {
+		errs = append(errs, errors.New("DROPBOX_MAX_CONCURRENCY: must not be negative"))
+	}
+	if c.UpstreamQueueTimeout < 0 {
+		errs = append(errs, errors.New("DROPBOX_QUEUE_TIMEOUT: must not be negative"))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("SHUTDOWN_TIMEOUT: must be positive"))
+	}
+	if c.PreShutdownDelay < 0 {
+		errs = append(errs, errors.New("PRE_SHUTDOWN_DELAY: must not be negative"))
+	}
+
+	// Server timeouts default to READ_HEADER_TIMEOUT=5s, READ_TIMEOUT=10s,
+	// WRITE_TIMEOUT=30s and IDLE_TIMEOUT=120s. Zero would mean unlimited, which
+	// is exactly what they exist to prevent.
+	for _, t := range []struct {
+		key   string
+		value time.Duration
+	}{
+		{"READ_HEADER_TIMEOUT", c.ReadHeaderTimeout},
+		{"READ_TIMEOUT", c.ReadTimeout},
+		{"WRITE_TIMEOUT", c.WriteTimeout},
+		{"IDLE_TIMEOUT", c.IdleTimeout},
+	} {
+		if t.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s: must be positive", t.key))
+		}
+	}
+	if c.WriteTimeout > 0 && c.WriteTimeout <= c.DropboxTimeout {
+		errs = append(errs, fmt.Errorf("WRITE_TIMEOUT: %s must exceed DROPBOX_TIMEOUT (%s) or slow upstream responses are cut off", c.WriteTimeout, c.DropboxTimeout))
+	}
+
+	if c.TokenCacheEnabled && c.TokenCacheTTL <= 0 {
+		errs = append(errs, errors.New("TOKEN_CACHE_TTL: must be positive"))
+	}
+	if c.TokenCacheMargin < 0 {
+		errs = append(errs, errors.New("TOKEN_CACHE_MARGIN: must not be negative"))
+	}
+	if c.AccountCacheTTL < 0 {
+		errs = append(errs, errors.New("ACCOUNT_CACHE_TTL: must not be negative"))
+	}
+	if c.AdminAddr != "" && c.AdminAddr == c.ListenAddr {
+		errs = append(errs, errors.New("ADMIN_ADDR: must differ from the public listen address"))
+	}
+	if c.PprofEnabled && c.AdminAddr == "" {
+		errs = append(errs, errors.New("PPROF_ENABLED requires ADMIN_ADDR so profiles stay off the public listener"))
+	}
+	if c.BreakerThreshold < 0 {
+		errs = append(errs, errors.New("DROPBOX_BREAKER_THRESHOLD: must not be negative"))
+	}
+	if c.BreakerCooldown <= 0 {
+		errs = append(errs, errors.New("DROPBOX_BREAKER_COOLDOWN: must be positive"))
+	}
+	if c.RequestTimeout < 0 {
+		errs = append(errs, errors.New("REQUEST_TIMEOUT: must not be negative"))
+	}
+	if c.CORSMaxAge < 0 {
+		errs = append(errs, errors.New("CORS_MAX_AGE: must not be negative"))
+	}
+	for _, name := range c.ForwardedHeaders {
+		if slices.Contains(hopByHopHeaders, name) {
+			errs = append(errs, fmt.Errorf("FORWARDED_HEADERS: %s is a hop-by-hop header and can't be forwarded", name))
+		} else if !validHeaderName(name) {
+			errs = append(errs, fmt.Errorf("FORWARDED_HEADERS: %q is not a valid header name", name))
+		}
+	}
+	if c.HSTSMaxAge < 0 {
+		errs = append(errs, errors.New("HSTS_MAX_AGE: must not be negative"))
+	}
+	// Origins are matched exactly and echoed back, so a "*" would match
+	// nothing rather than everything.
+	if slices.Contains(c.AllowedOrigins, "*") {
+		errs = append(errs, errors.New("ALLOWED_ORIGINS: wildcards are not supported, list each origin"))
+	}
+	switch c.TokenStore {
+	case "", "memory", "sqlite":
+	default:
+		errs = append(errs, fmt.Errorf("TOKEN_STORE: %q must be memory or sqlite", c.TokenStore))
+	}
+	if c.IdempotencyTTL <= 0 {
+		errs = append(errs, errors.New("IDEMPOTENCY_TTL: must be positive"))
+	}
+	if c.ExchangeDedupWindow < 0 {
+		errs = append(errs, errors.New("EXCHANGE_DEDUP_WINDOW: must not be negative"))
+	}
+	if c.DropboxProxy != "" {
+		if _, err := parseProxyURL(c.DropboxProxy); err != nil {
+			errs = append(errs, fmt.Errorf("DROPBOX_HTTP_PROXY: %w", err))
+		}
+	} else if req, err := http.NewRequest(http.MethodPost, c.DropboxAPIURL, nil); err == nil {
+		// A malformed HTTPS_PROXY would otherwise only surface on the first
+		// upstream call.
+		if _, err := http.ProxyFromEnvironment(req); err != nil {
+			errs = append(errs, fmt.Errorf("HTTPS_PROXY/HTTP_PROXY: %w", err))
+		}
+	}
+	if c.RedisURL != "" {
+		if _, err := newRedisClient(c.RedisURL); err != nil {
+			errs = append(errs, fmt.Errorf("REDIS_URL: %w", err))
+		}
+	}
+
+	switch {
+	case c.AutocertEnabled && (c.TLSCertFile != "" || c.TLSKeyFile != ""):
+		errs = append(errs, errors.New("TLS_AUTOCERT_ENABLED and TLS_CERT_FILE/TLS_KEY_FILE are alternative TLS modes; set only one"))
+	case c.AutocertEnabled:
+		if len(c.AutocertDomains) == 0 {
+			errs = append(errs, errors.New("TLS_AUTOCERT_DOMAINS is required with TLS_AUTOCERT_ENABLED"))
+		}
+		if c.AutocertCacheDir == "" {
+			errs = append(errs, errors.New("TLS_AUTOCERT_CACHE_DIR is required with TLS_AUTOCERT_ENABLED"))
+		}
+	case c.TLSMode() == tlsModeFiles:
+		if _, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile); err != nil {
+			errs = append(errs, fmt.Errorf("TLS_CERT_FILE/TLS_KEY_FILE: %w", err))
+		}
+	case c.TLSCertFile != "" || c.TLSKeyFile != "":
+		errs = append(errs, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+	}
+	if c.HTTPRedirectAddr != "" && (c.HTTPRedirectAddr == c.ListenAddr || c.HTTPRedirectAddr == c.AdminAddr) {
+		errs = append(errs, errors.New("TLS_HTTP_ADDR must differ from LISTEN_ADDR/PORT and ADMIN_ADDR"))
+	}
+
+	return errs
+}
+
+// LoadConfig reads the configuration from the environment, fills in the
+// defaults and validates the result. Every problem is collected instead of
+// stopping at the first; the returned error joins them, and configErrors
+// splits it again. All variables are read through getenv, so ENV_PREFIX
+// applies to each of them. It runs at startup and again on SIGHUP.
+func LoadConfig() (Config, error) {
+	cfg := Config{
+		ClientID:       getenv("DROPBOX_CLIENT_ID"),
+		RedirectURI:    getenv("DROPBOX_REDIRECT_URI"),
+		AllowedOrigins: parseOrigins(getenv("ALLOWED_ORIGINS")),
+		TLSCertFile:    getenv("TLS_CERT_FILE"),
+		TLSKeyFile:     getenv("TLS_KEY_FILE"),
+	}
+
+	var errs []error
+	note := func(key string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+	secret := func(key string) string {
+		value, err := getenvSecret(key)
+		note(key+"_FILE", err)
+		return value
+	}
+	cfg.ClientSecret = secret("DROPBOX_CLIENT_SECRET")
+	cfg.APIKey = secret("PROXY_API_KEY")
+	cfg.StateSecret = []byte(secret("STATE_SECRET"))
+	cfg.RedisURL = secret("REDIS_URL")
+
+	var err error
+	cfg.RedirectURIs, err = parseRedirectURIs(getenv("ALLOWED_REDIRECT_URIS"))
+	note("ALLOWED_REDIRECT_URIS", err)
+	cfg.ListenAddr, err = parseListenAddr(listenAddrFromEnv())
+	note("LISTEN_ADDR/PORT", err)
+	if addr := getenv("ADMIN_ADDR"); addr != "" {
+		cfg.AdminAddr, err = parseListenAddr(addr)
+		note("ADMIN_ADDR", err)
+	}
+	cfg.DebugBodies, err = envBool("DEBUG_BODIES", false)
+	note("DEBUG_BODIES", err)
+	cfg.DryRun, err = envBool("DRY_RUN", false)
+	note("DRY_RUN", err)
+	cfg.H2CEnabled, err = envBool("H2C_ENABLED", false)
+	note("H2C_ENABLED", err)
+	cfg.PprofEnabled, err = envBool("PPROF_ENABLED", false)
+	note("PPROF_ENABLED", err)
+	cfg.DropboxAPIURL, err = parseBaseURL(envOrDefault("DROPBOX_API_URL", defaultDropboxAPIURL))
+	note("DROPBOX_API_URL", err)
+	note("LOG_LEVEL", cfg.LogLevel.UnmarshalText([]byte(envOrDefault("LOG_LEVEL", "info"))))
+	cfg.RateLimitRPS, err = envFloat("RATE_LIMIT_RPS", 5)
+	note("RATE_LIMIT_RPS", err)
+	cfg.RateLimitBurst, err = envInt("RATE_LIMIT_BURST", 10)
+	note("RATE_LIMIT_BURST", err)
+	cfg.ClientRateLimitRPS, err = envFloat("CLIENT_RATE_LIMIT_RPS", 0)
+	note("CLIENT_RATE_LIMIT_RPS", err)
+	cfg.ClientRateLimitBurst, err = envInt("CLIENT_RATE_LIMIT_BURST", 50)
+	note("CLIENT_RATE_LIMIT_BURST", err)
+	cfg.TrustProxy, err = envBool("TRUST_PROXY", false)
+	note("TRUST_PROXY", err)
+	cfg.StateTTL, err = envDuration("STATE_TTL", 10*time.Minute)
+	note("STATE_TTL", err)
+	cfg.MaxBodyBytes, err = envInt64("MAX_BODY_BYTES", 64<<10)
+	note("MAX_BODY_BYTES", err)
+	cfg.RetryMaxAttempts, err = envInt("DROPBOX_MAX_ATTEMPTS", 3)
+	note("DROPBOX_MAX_ATTEMPTS", err)
+	cfg.RetryBaseDelay, err = envDuration("DROPBOX_RETRY_BASE_DELAY", 200*time.Millisecond)
+	note("DROPBOX_RETRY_BASE_DELAY", err)
+	cfg.DropboxTimeout, err = envDuration("DROPBOX_TIMEOUT", 10*time.Second)
+	note("DROPBOX_TIMEOUT", err)
+	cfg.UserAgent = envOrDefault("DROPBOX_USER_AGENT", defaultUserAgent())
+	cfg.MaxUpstreamBody, err = envInt64("DROPBOX_MAX_RESPONSE_BYTES", 1<<20)
+	note("DROPBOX_MAX_RESPONSE_BYTES", err)
+	cfg.MaxIdleConns, err = envInt("DROPBOX_MAX_IDLE_CONNS", 100)
+	note("DROPBOX_MAX_IDLE_CONNS", err)
+	cfg.MaxIdleConnsPerHost, err = envInt("DROPBOX_MAX_IDLE_CONNS_PER_HOST", 20)
+	note("DROPBOX_MAX_IDLE_CONNS_PER_HOST", err)
+	cfg.IdleConnTimeout, err = envDuration("DROPBOX_IDLE_CONN_TIMEOUT", 90*time.Second)
+	note("DROPBOX_IDLE_CONN_TIMEOUT", err)
+	cfg.DisableKeepAlives, err = envBool("DROPBOX_DISABLE_KEEP_ALIVES", false)
+	note("DROPBOX_DISABLE_KEEP_ALIVES", err)
+	cfg.TCPKeepAlive, err = envDuration("DROPBOX_TCP_KEEP_ALIVE", 30*time.Second)
+	note("DROPBOX_TCP_KEEP_ALIVE", err)
+	cfg.MaxUpstreamConcurrency, err = envInt("DROPBOX_MAX_CONCURRENCY", 32)
+	note("DROPBOX_MAX_CONCURRENCY", err)
+	cfg.UpstreamQueueTimeout, err = envDuration("DROPBOX_QUEUE_TIMEOUT", 2*time.Second)
+	note("DROPBOX_QUEUE_TIMEOUT", err)
+	cfg.TokenCacheEnabled, err = envBool("TOKEN_CACHE_ENABLED", false)
+	note("TOKEN_CACHE_ENABLED", err)
+	cfg.TokenCacheTTL, err = envDuration("TOKEN_CACHE_TTL", time.Minute)
+	note("TOKEN_CACHE_TTL", err)
+	cfg.TokenCacheMargin, err = envDuration("TOKEN_CACHE_MARGIN", time.Minute)
+	note("TOKEN_CACHE_MARGIN", err)
+	cfg.AccountCacheTTL, err = envDuration("ACCOUNT_CACHE_TTL", 30*time.Second)
+	note("ACCOUNT_CACHE_TTL", err)
+	if frontend := getenv("FRONTEND_URL"); frontend != "" {
+		_, err = parseBaseURL(frontend)
+		note("FRONTEND_URL", err)
+		cfg.FrontendURL, _ = url.Parse(frontend)
+	}
+	cfg.PreShutdownDelay, err = envDuration("PRE_SHUTDOWN_DELAY", 0)
+	note("PRE_SHUTDOWN_DELAY", err)
+	cfg.ShutdownTimeout, err = envDuration("SHUTDOWN_TIMEOUT", 5*time.Second)
+	note("SHUTDOWN_TIMEOUT", err)
+	cfg.MetricsEnabled, err = envBool("METRICS_ENABLED", false)
+	note("METRICS_ENABLED", err)
+	cfg.ReadHeaderTimeout, err = envDuration("READ_HEADER_TIMEOUT", 5*time.Second)
+	note("READ_HEADER_TIMEOUT", err)
+	cfg.ReadTimeout, err = envDuration("READ_TIMEOUT", 10*time.Second)
+	note("READ_TIMEOUT", err)
+	cfg.WriteTimeout, err = envDuration("WRITE_TIMEOUT", 30*time.Second)
+	note("WRITE_TIMEOUT", err)
+	cfg.IdleTimeout, err = envDuration("IDLE_TIMEOUT", 120*time.Second)
+	note("IDLE_TIMEOUT", err)
+
+	cfg.AutocertEnabled, err = envBool("TLS_AUTOCERT_ENABLED", false)
+	note("TLS_AUTOCERT_ENABLED", err)
+	cfg.AutocertDomains = parseDomains(getenv("TLS_AUTOCERT_DOMAINS"))
+	cfg.AutocertCacheDir = getenv("TLS_AUTOCERT_CACHE_DIR")
+	cfg.AutocertEmail = getenv("TLS_AUTOCERT_EMAIL")
+	redirectAddr := getenv("TLS_HTTP_ADDR")
+	if redirectAddr == "" && cfg.AutocertEnabled {
+		redirectAddr = ":80"
+	}
+	if redirectAddr != "" {
+		cfg.HTTPRedirectAddr, err = parseListenAddr(redirectAddr)
+		note("TLS_HTTP_ADDR", err)
+	}
+	cfg.HSTSMaxAge, err = envDuration("HSTS_MAX_AGE", 365*24*time.Hour)
+	note("HSTS_MAX_AGE", err)
+	cfg.HSTSIncludeSubdomains, err = envBool("HSTS_INCLUDE_SUBDOMAINS", false)
+	note("HSTS_INCLUDE_SUBDOMAINS", err)
+
+	cfg.RequestTimeout, err = envDuration("REQUEST_TIMEOUT", 8*time.Second)
+	note("REQUEST_TIMEOUT", err)
+	cfg.BreakerThreshold, err = envInt("DROPBOX_BREAKER_THRESHOLD", 5)
+	note("DROPBOX_BREAKER_THRESHOLD", err)
+	cfg.BreakerCooldown, err = envDuration("DROPBOX_BREAKER_COOLDOWN", 30*time.Second)
+	note("DROPBOX_BREAKER_COOLDOWN", err)
+	cfg.CORSMaxAge, err = envDuration("CORS_MAX_AGE", 10*time.Minute)
+	note("CORS_MAX_AGE", err)
+	cfg.CORSAllowCredentials, err = envBool("CORS_ALLOW_CREDENTIALS", false)
+	note("CORS_ALLOW_CREDENTIALS", err)
+	cfg.CORSAllowedHeaders = parseHeaderNames(getenv("CORS_ALLOWED_HEADERS"))
+	cfg.CORSAllowedMethods = parseMethods(getenv("CORS_ALLOWED_METHODS"))
+	cfg.ForwardedHeaders = defaultForwardedHeaders
+	if value := getenv("FORWARDED_HEADERS"); value != "" {
+		cfg.ForwardedHeaders = parseHeaderNames(value)
+	}
+	cfg.TokenStore = getenv("TOKEN_STORE")
+	cfg.TokenStorePath = envOrDefault("TOKEN_STORE_PATH", "todosrv.db")
+	cfg.DropboxProxy = getenv("DROPBOX_HTTP_PROXY")
+	cfg.AuditLog = getenv("AUDIT_LOG")
+	cfg.IdempotencyTTL, err = envDuration("IDEMPOTENCY_TTL", 10*time.Minute)
+	note("IDEMPOTENCY_TTL", err)
+	cfg.ExchangeDedupWindow, err = envDuration("EXCHANGE_DEDUP_WINDOW", 0)
+	note("EXCHANGE_DEDUP_WINDOW", err)
+	cfg.SelfTest, err = envBool("STARTUP_SELF_TEST", false)
+	note("STARTUP_SELF_TEST", err)
+	cfg.SelfTestFailFast, err = envBool("STARTUP_SELF_TEST_FAIL_FAST", false)
+	note("STARTUP_SELF_TEST_FAIL_FAST", err)
+
+	// The standard OpenTelemetry variables, so collectors configured for
+	// other services work unchanged.
+	if endpoint := getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); endpoint != "" {
+		cfg.TracingEndpoint, err = parseBaseURL(endpoint)
+		note("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", err)
+	} else if endpoint := getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		cfg.TracingEndpoint, err = parseBaseURL(endpoint)
+		note("OTEL_EXPORTER_OTLP_ENDPOINT", err)
+		cfg.TracingEndpoint += "/v1/traces"
+	}
+	cfg.ServiceName = envOrDefault("OTEL_SERVICE_NAME", "todo-srv")
+	if headers := getenv("OTEL_EXPORTER_OTLP_TRACES_HEADERS"); headers != "" {
+		cfg.TracingHeaders, err = parseOTLPHeaders(headers)
+		note("OTEL_EXPORTER_OTLP_TRACES_HEADERS", err)
+	} else {
+		cfg.TracingHeaders, err = parseOTLPHeaders(getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+		note("OTEL_EXPORTER_OTLP_HEADERS", err)
+	}
+
+	providers, providerErrs := loadProviders(cfg)
+	cfg.Providers = providers
+	errs = append(errs, providerErrs...)
+
+	return cfg, errors.Join(append(errs, cfg.Validate()...)...)
+}
+
+// missingVarError reports a required variable that isn't set.
+type missingVarError string
+
+func (e missingVarError) Error() string { return string(e) + " is required" }
+
+// configErrors lists the individual problems in an error from LoadConfig.
+func configErrors(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
+
+// keepRestartOnly copies from cur the settings that are only read at startup,
+// by the listener, the HTTP client or while building the routes, and returns
+// the names of those whose new value was ignored.
+func (c *Config) keepRestartOnly(cur *Config) []string {
+	var ignored []string
+	keepSetting(&ignored, "LISTEN_ADDR/PORT", &c.ListenAddr, cur.ListenAddr)
+	keepSetting(&ignored, "RATE_LIMIT_RPS", &c.RateLimitRPS, cur.RateLimitRPS)
+	keepSetting(&ignored, "RATE_LIMIT_BURST", &c.RateLimitBurst, cur.RateLimitBurst)
+	keepSetting(&ignored, "TRUST_PROXY", &c.TrustProxy, cur.TrustProxy)
+	keepSetting(&ignored, "DROPBOX_TIMEOUT", &c.DropboxTimeout, cur.DropboxTimeout)
+	keepSetting(&ignored, "DROPBOX_MAX_IDLE_CONNS", &c.MaxIdleConns, cur.MaxIdleConns)
+	keepSetting(&ignored, "DROPBOX_MAX_IDLE_CONNS_PER_HOST", &c.MaxIdleConnsPerHost, cur.MaxIdleConnsPerHost)
+	keepSetting(&ignored, "DROPBOX_IDLE_CONN_TIMEOUT", &c.IdleConnTimeout, cur.IdleConnTimeout)
+	keepSetting(&ignored, "DROPBOX_DISABLE_KEEP_ALIVES", &c.DisableKeepAlives, cur.DisableKeepAlives)
+	keepSetting(&ignored, "DROPBOX_TCP_KEEP_ALIVE", &c.TCPKeepAlive, cur.TCPKeepAlive)
+	keepSetting(&ignored, "DROPBOX_MAX_CONCURRENCY", &c.MaxUpstreamConcurrency, cur.MaxUpstreamConcurrency)
+	keepSetting(&ignored, "SHUTDOWN_TIMEOUT", &c.ShutdownTimeout, cur.ShutdownTimeout)
+	keepSetting(&ignored, "PRE_SHUTDOWN_DELAY", &c.PreShutdownDelay, cur.PreShutdownDelay)
+	keepSetting(&ignored, "METRICS_ENABLED", &c.MetricsEnabled, cur.MetricsEnabled)
+	keepSetting(&ignored, "READ_HEADER_TIMEOUT", &c.ReadHeaderTimeout, cur.ReadHeaderTimeout)
+	keepSetting(&ignored, "READ_TIMEOUT", &c.ReadTimeout, cur.ReadTimeout)
+	keepSetting(&ignored, "WRITE_TIMEOUT", &c.WriteTimeout, cur.WriteTimeout)
+	keepSetting(&ignored, "IDLE_TIMEOUT", &c.IdleTimeout, cur.IdleTimeout)
+	keepSetting(&ignored, "TLS_CERT_FILE", &c.TLSCertFile, cur.TLSCertFile)
+	keepSetting(&ignored, "TLS_KEY_FILE", &c.TLSKeyFile, cur.TLSKeyFile)
+	keepSetting(&ignored, "TLS_AUTOCERT_ENABLED", &c.AutocertEnabled, cur.AutocertEnabled)
+	keepSetting(&ignored, "TLS_AUTOCERT_CACHE_DIR", &c.AutocertCacheDir, cur.AutocertCacheDir)
+	keepSetting(&ignored, "TLS_AUTOCERT_EMAIL", &c.AutocertEmail, cur.AutocertEmail)
+	keepSetting(&ignored, "TLS_HTTP_ADDR", &c.HTTPRedirectAddr, cur.HTTPRedirectAddr)
+	keepSetting(&ignored, "TOKEN_CACHE_ENABLED", &c.TokenCacheEnabled, cur.TokenCacheEnabled)
+	keepSetting(&ignored, "TOKEN_STORE", &c.TokenStore, cur.TokenStore)
+	keepSetting(&ignored, "TOKEN_STORE_PATH", &c.TokenStorePath, cur.TokenStorePath)
+	keepSetting(&ignored, "REDIS_URL", &c.RedisURL, cur.RedisURL)
+	keepSetting(&ignored, "ADMIN_ADDR", &c.AdminAddr, cur.AdminAddr)
+	keepSetting(&ignored, "PPROF_ENABLED", &c.PprofEnabled, cur.PprofEnabled)
+	keepSetting(&ignored, "H2C_ENABLED", &c.H2CEnabled, cur.H2CEnabled)
+	keepSetting(&ignored, "DROPBOX_HTTP_PROXY", &c.DropboxProxy, cur.DropboxProxy)
+	keepSetting(&ignored, "DROPBOX_BREAKER_THRESHOLD", &c.BreakerThreshold, cur.BreakerThreshold)
+	keepSetting(&ignored, "DROPBOX_BREAKER_COOLDOWN", &c.BreakerCooldown, cur.BreakerCooldown)
+	keepSetting(&ignored, "AUDIT_LOG", &c.AuditLog, cur.AuditLog)
+	keepSetting(&ignored, "OTEL_EXPORTER_OTLP_ENDPOINT", &c.TracingEndpoint, cur.TracingEndpoint)
+	keepSetting(&ignored, "OTEL_SERVICE_NAME", &c.ServiceName, cur.ServiceName)
+
+	var next, prev string
+	if c.FrontendURL != nil {
+		next = c.FrontendURL.String()
+	}
+	if cur.FrontendURL != nil {
+		prev = cur.FrontendURL.String()
+	}
+	if next != prev {
+		ignored = append(ignored, "FRONTEND_URL")
+	}
+	c.FrontendURL = cur.FrontendURL
+
+	if !maps.EqualFunc(c.TracingHeaders, cur.TracingHeaders, slices.Equal) {
+		ignored = append(ignored, "OTEL_EXPORTER_OTLP_HEADERS")
+		c.TracingHeaders = cur.TracingHeaders
+	}
+
+	if !slices.Equal(c.AutocertDomains, cur.AutocertDomains) {
+		ignored = append(ignored, "TLS_AUTOCERT_DOMAINS")
+		c.AutocertDomains = cur.AutocertDomains
+	}
+
+	return ignored
+}
+
+func keepSetting[T comparable](ignored *[]string, name string, next *T, cur T) {
+	if *next != cur {
+		*ignored = append(*ignored, name)
+		*next = cur
+	}
+}
+
+// parseProxyURL accepts an http, https or socks5 proxy URL.
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") || u.Host == "" {
+		return nil, fmt.Errorf("%q must be an http, https or socks5 URL", u.Redacted())
+	}
+	return u, nil
+}
+
+// getenv reads a configuration variable. A command-line flag for it wins.
+// With ENV_PREFIX set, the prefixed name comes next and the plain one is the
+// fallback, so several services can share an environment without breaking
+// existing deployments.
+func getenv(key string) string {
+	if value, ok := flagValues[key]; ok {
+		return value
+	}
+	if prefix := os.Getenv("ENV_PREFIX"); prefix != "" {
+		if value, ok := os.LookupEnv(prefix + key); ok {
+			return value
+		}
+	}
+	return os.Getenv(key)
+}
+
+// getenvSecret reads a sensitive variable. A command-line flag for it wins.
+// Next, when KEY_FILE is set, the secret is the content of that file, as
+// mounted by Docker or Kubernetes secrets, without trailing whitespace; it
+// wins over KEY itself. The file is read again on every reload, so a rotated
+// secret is picked up on SIGHUP.
+func getenvSecret(key string) (string, error) {
+	if value, ok := flagValues[key]; ok {
+		return value, nil
+	}
+	path := getenv(key + "_FILE")
+	if path == "" {
+		return getenv(key), nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimRight(string(b), " \t\r\n")
+	if value == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return value, nil
+}
+
+func envOrDefault(key, fallback string) string {
+	if value := getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func envFloat(key string, fallback float64) (float64, error) {
+	value := getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+func envInt(key string, fallback int) (int, error) {
+	value := getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
+
+func envInt64(key string, fallback int64) (int64, error) {
+	value := getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func envBool(key string, fallback bool) (bool, error) {
+	value := getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+func envDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value := getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// listenAddrFromEnv prefers LISTEN_ADDR to PORT. A flag for either one beats
+// the environment for both, so -port wins over an inherited LISTEN_ADDR.
+func listenAddrFromEnv() string {
+	for _, key := range []string{"LISTEN_ADDR", "PORT"} {
+		if addr := flagValues[key]; addr != "" {
+			return addr
+		}
+	}
+	if addr := getenv("LISTEN_ADDR"); addr != "" {
+		return addr
+	}
+	return getenv("PORT")
+}
+
+// parseListenAddr accepts "3000", ":3000" or "host:3000" and returns a
+// host:port suitable for http.Server. An empty value yields ":3000".
+func parseListenAddr(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return ":3000", nil
+	}
+
+	if !strings.Contains(value, ":") {
+		value = ":" + value
+	}
+
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return "", fmt.Errorf("%q: %w", value, err)
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("%q: port must be a number between 1 and 65535", value)
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// parseBaseURL checks value is an absolute http(s) URL and strips any
+// trailing slash so paths can be appended directly.
+func parseBaseURL(value string) (string, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%q must be an absolute http or https URL", value)
+	}
+	return strings.TrimRight(value, "/"), nil
+}
+
+// parseRedirectURIs splits a comma-separated list of extra redirect URIs.
+// Custom schemes are allowed for mobile and desktop apps, but every entry must
+// be absolute and fragment-free as OAuth requires.
+func parseRedirectURIs(value string) ([]string, error) {
+	var uris []string
+	for _, uri := range strings.Split(value, ",") {
+		uri = strings.TrimSpace(uri)
+		if uri == "" {
+			continue
+		}
+		if u, err := url.Parse(uri); err != nil || !u.IsAbs() || u.Fragment != "" {
+			return nil, fmt.Errorf("%q must be an absolute URI without a fragment", uri)
+		}
+		uris = append(uris, uri)
+	}
+	return uris, nil
+}
+
+// parseHeaderNames splits a comma-separated list of header names into
+// canonical form. An empty value yields nil.
+func parseHeaderNames(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	return names
+}
+
+// parseOTLPHeaders reads the OpenTelemetry exporter headers format: a comma
+// separated list of name=value pairs with URL-encoded values.
+func parseOTLPHeaders(value string) (http.Header, error) {
+	headers := http.Header{}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, raw, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !validHeaderName(name) {
+			return nil, fmt.Errorf("%q is not a name=value pair", strings.TrimSpace(pair))
+		}
+		v, err := url.PathUnescape(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		headers.Add(name, v)
+	}
+	return headers, nil
+}
+
+// parseMethods splits a comma-separated list of HTTP methods, uppercased. An
+// empty value yields nil.
+func parseMethods(value string) []string {
+	var methods []string
+	for _, method := range strings.Split(value, ",") {
+		if method = strings.ToUpper(strings.TrimSpace(method)); method != "" {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// parseDomains splits a comma-separated host name list, lowercased.
+func parseDomains(value string) []string {
+	var domains []string
+	for _, domain := range strings.Split(value, ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// parseOrigins splits a comma-separated origin list. An empty value keeps the
+// local Angular dev server as the only allowed origin.
+func parseOrigins(value string) []string {
+	var origins []string
+	for _, origin := range strings.Split(value, ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+
+	if len(origins) == 0 {
+		return []string{"http://localhost:4200"}
+	}
+	return origins
+}
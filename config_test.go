@@ -0,0 +1,366 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeSecret(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSecretFromFile(t *testing.T) {
+	withFlags(t)
+	path := writeSecret(t, "from-file\n\n")
+	cfg := testConfig(t, "https://api.example",
+		"DROPBOX_CLIENT_SECRET", "inline",
+		"DROPBOX_CLIENT_SECRET_FILE", path,
+		"PROXY_API_KEY_FILE", writeSecret(t, "key \t\r\n"),
+	)
+	if cfg.ClientSecret != "from-file" {
+		t.Errorf("ClientSecret = %q, want the file's content", cfg.ClientSecret)
+	}
+	if cfg.APIKey != "key" {
+		t.Errorf("APIKey = %q, want trailing whitespace trimmed", cfg.APIKey)
+	}
+}
+
+func TestSecretFlagBeatsFile(t *testing.T) {
+	withFlags(t, "-client-secret", "from-flag")
+	cfg := testConfig(t, "https://api.example", "DROPBOX_CLIENT_SECRET_FILE", writeSecret(t, "from-file"))
+	if cfg.ClientSecret != "from-flag" {
+		t.Errorf("ClientSecret = %q, want the flag value", cfg.ClientSecret)
+	}
+}
+
+func TestProviderSecretFromFile(t *testing.T) {
+	withFlags(t)
+	cfg := testConfig(t, "https://api.example",
+		"PROVIDERS", "box",
+		"BOX_CLIENT_ID", "box-id",
+		"BOX_REDIRECT_URI", "https://app.example/box",
+		"BOX_TOKEN_URL", "https://box.example/token",
+		"BOX_CLIENT_SECRET_FILE", writeSecret(t, "box-secret\n"),
+	)
+	if got := cfg.Providers["box"].ClientSecret; got != "box-secret" {
+		t.Errorf("box ClientSecret = %q", got)
+	}
+}
+
+func TestSecretFileErrors(t *testing.T) {
+	withFlags(t)
+	for name, path := range map[string]string{
+		"missing": filepath.Join(t.TempDir(), "nope"),
+		"empty":   writeSecret(t, " \n"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("DROPBOX_CLIENT_SECRET_FILE", path)
+			_, err := loadTestEnv(t)
+			if err == nil || !strings.Contains(err.Error(), "DROPBOX_CLIENT_SECRET_FILE") {
+				t.Errorf("LoadConfig error = %v, want DROPBOX_CLIENT_SECRET_FILE reported", err)
+			}
+		})
+	}
+}
+
+// loadTestEnv runs LoadConfig with only the required variables set.
+func loadTestEnv(t *testing.T) (Config, error) {
+	t.Helper()
+	t.Setenv("DROPBOX_CLIENT_ID", "client-id")
+	t.Setenv("DROPBOX_REDIRECT_URI", "https://app.example/callback")
+	return LoadConfig()
+}
+
+func TestWildcardOriginRejected(t *testing.T) {
+	t.Setenv("DROPBOX_CLIENT_SECRET", "client-secret")
+	t.Setenv("ALLOWED_ORIGINS", "https://app.example,*")
+	_, err := loadTestEnv(t)
+	if err == nil || !strings.Contains(err.Error(), "ALLOWED_ORIGINS") {
+		t.Fatalf("LoadConfig error = %v, want ALLOWED_ORIGINS rejected", err)
+	}
+}
+
+func TestDropboxAPIURL(t *testing.T) {
+	for _, tc := range []struct {
+		value, want string
+		ok          bool
+	}{
+		{"", defaultDropboxAPIURL, true},
+		{"http://127.0.0.1:4999/", "http://127.0.0.1:4999", true},
+		{"https://dropbox.internal/proxy", "https://dropbox.internal/proxy", true},
+		{"ftp://dropbox.internal", "", false},
+		{"/relative", "", false},
+	} {
+		t.Run(tc.value, func(t *testing.T) {
+			t.Setenv("DROPBOX_CLIENT_SECRET", "client-secret")
+			t.Setenv("DROPBOX_API_URL", tc.value)
+			cfg, err := loadTestEnv(t)
+			if !tc.ok {
+				if err == nil || !strings.Contains(err.Error(), "DROPBOX_API_URL") {
+					t.Errorf("error = %v, want DROPBOX_API_URL rejected", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.DropboxAPIURL != tc.want {
+				t.Errorf("DropboxAPIURL = %q, want %q", cfg.DropboxAPIURL, tc.want)
+			}
+			if p := cfg.Providers[defaultProvider]; p.TokenURL != tc.want+"/oauth2/token" {
+				t.Errorf("token URL = %q", p.TokenURL)
+			}
+		})
+	}
+}
+
+func TestServerTimeoutsMustBeLimits(t *testing.T) {
+	t.Setenv("DROPBOX_CLIENT_SECRET", "client-secret")
+	t.Setenv("READ_TIMEOUT", "0s")
+	t.Setenv("WRITE_TIMEOUT", "5s")
+	t.Setenv("DROPBOX_TIMEOUT", "10s")
+	_, err := loadTestEnv(t)
+	for _, want := range []string{"READ_TIMEOUT: must be positive", "WRITE_TIMEOUT: 5s must exceed DROPBOX_TIMEOUT"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("error = %v, want %q", err, want)
+		}
+	}
+}
+
+func TestEnvPrefix(t *testing.T) {
+	t.Setenv("ENV_PREFIX", "TODOSRV_")
+	t.Setenv("TODOSRV_DROPBOX_CLIENT_ID", "prefixed-id")
+	t.Setenv("DROPBOX_CLIENT_ID", "plain-id")
+	t.Setenv("TODOSRV_DROPBOX_CLIENT_SECRET", "prefixed-secret")
+	t.Setenv("DROPBOX_REDIRECT_URI", "https://app.example/callback")
+	t.Setenv("LOG_LEVEL", "warn")
+	t.Setenv("TODOSRV_ALLOWED_ORIGINS", "")
+	t.Setenv("ALLOWED_ORIGINS", "https://plain.example")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ClientID != "prefixed-id" || cfg.ClientSecret != "prefixed-secret" {
+		t.Errorf("prefixed: client %q, secret %q", cfg.ClientID, cfg.ClientSecret)
+	}
+	if cfg.RedirectURI != "https://app.example/callback" || cfg.LogLevel != slog.LevelWarn {
+		t.Errorf("unprefixed fallback: redirect %q, log level %s", cfg.RedirectURI, cfg.LogLevel)
+	}
+	// Set but empty still counts as set, so a prefix can blank a shared value.
+	if !slices.Equal(cfg.AllowedOrigins, []string{"http://localhost:4200"}) {
+		t.Errorf("AllowedOrigins = %q, want the default", cfg.AllowedOrigins)
+	}
+}
+
+func TestWithoutEnvPrefix(t *testing.T) {
+	t.Setenv("ENV_PREFIX", "")
+	t.Setenv("TODOSRV_LOG_LEVEL", "error")
+	t.Setenv("DROPBOX_CLIENT_SECRET", "client-secret")
+	t.Setenv("LOG_LEVEL", "warn")
+	cfg, err := loadTestEnv(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.LogLevel != slog.LevelWarn {
+		t.Errorf("LogLevel = %s; prefixed variables apply only with ENV_PREFIX", cfg.LogLevel)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	required := map[string]string{
+		"DROPBOX_CLIENT_ID":     "client-id",
+		"DROPBOX_CLIENT_SECRET": "client-secret",
+		"DROPBOX_REDIRECT_URI":  "https://app.example/callback",
+	}
+	tests := []struct {
+		name    string
+		unset   string
+		missing string
+	}{
+		{name: "complete"},
+		{name: "no client id", unset: "DROPBOX_CLIENT_ID", missing: "DROPBOX_CLIENT_ID"},
+		{name: "no client secret", unset: "DROPBOX_CLIENT_SECRET", missing: "DROPBOX_CLIENT_SECRET"},
+		{name: "no redirect uri", unset: "DROPBOX_REDIRECT_URI", missing: "DROPBOX_REDIRECT_URI"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range required {
+				if key == tt.unset {
+					value = ""
+				}
+				t.Setenv(key, value)
+			}
+
+			cfg, err := LoadConfig()
+			if tt.missing != "" {
+				var missing missingVarError
+				if !errors.As(err, &missing) || string(missing) != tt.missing {
+					t.Errorf("error = %v, want %s reported missing", err, tt.missing)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if cfg.ListenAddr != ":3000" || cfg.DropboxAPIURL != defaultDropboxAPIURL || cfg.LogLevel != slog.LevelInfo {
+				t.Errorf("listen %q, api %q, log level %s", cfg.ListenAddr, cfg.DropboxAPIURL, cfg.LogLevel)
+			}
+			if cfg.MaxBodyBytes != 64<<10 || cfg.RetryMaxAttempts != 3 || cfg.ShutdownTimeout != 5*time.Second || cfg.StateTTL <= 0 {
+				t.Errorf("max body %d, attempts %d, shutdown %v, state TTL %v", cfg.MaxBodyBytes, cfg.RetryMaxAttempts, cfg.ShutdownTimeout, cfg.StateTTL)
+			}
+			if !slices.Equal(cfg.AllowedOrigins, []string{"http://localhost:4200"}) {
+				t.Errorf("AllowedOrigins = %q", cfg.AllowedOrigins)
+			}
+		})
+	}
+}
+
+// writeTestCert writes a self-signed certificate for localhost and
+// 127.0.0.1, returning the cert and key file paths.
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLSModeSelection(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	cacheDir := t.TempDir()
+	tests := []struct {
+		name     string
+		env      []string
+		mode     string
+		redirect string
+		err      string
+	}{
+		{name: "plain http", mode: tlsModeOff},
+		{name: "cert files", env: []string{"TLS_CERT_FILE", certFile, "TLS_KEY_FILE", keyFile}, mode: tlsModeFiles},
+		{name: "cert files with redirect", env: []string{"TLS_CERT_FILE", certFile, "TLS_KEY_FILE", keyFile, "TLS_HTTP_ADDR", ":8080"}, mode: tlsModeFiles, redirect: ":8080"},
+		{
+			name:     "autocert",
+			env:      []string{"TLS_AUTOCERT_ENABLED", "true", "TLS_AUTOCERT_DOMAINS", "Proxy.Example", "TLS_AUTOCERT_CACHE_DIR", cacheDir},
+			mode:     tlsModeAutocert,
+			redirect: ":80",
+		},
+		{
+			name: "autocert and files",
+			env:  []string{"TLS_AUTOCERT_ENABLED", "true", "TLS_AUTOCERT_DOMAINS", "proxy.example", "TLS_AUTOCERT_CACHE_DIR", cacheDir, "TLS_CERT_FILE", certFile, "TLS_KEY_FILE", keyFile},
+			err:  "alternative TLS modes",
+		},
+		{name: "autocert without domains", env: []string{"TLS_AUTOCERT_ENABLED", "true", "TLS_AUTOCERT_CACHE_DIR", cacheDir}, err: "TLS_AUTOCERT_DOMAINS is required"},
+		{name: "autocert without cache", env: []string{"TLS_AUTOCERT_ENABLED", "true", "TLS_AUTOCERT_DOMAINS", "proxy.example"}, err: "TLS_AUTOCERT_CACHE_DIR is required"},
+		{name: "cert without key", env: []string{"TLS_CERT_FILE", certFile}, err: "must be set together"},
+		{name: "unreadable cert", env: []string{"TLS_CERT_FILE", keyFile, "TLS_KEY_FILE", keyFile}, err: "TLS_CERT_FILE/TLS_KEY_FILE:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"TLS_CERT_FILE", "TLS_KEY_FILE", "TLS_AUTOCERT_ENABLED", "TLS_AUTOCERT_DOMAINS", "TLS_AUTOCERT_CACHE_DIR", "TLS_HTTP_ADDR"} {
+				t.Setenv(key, "")
+			}
+			for i := 0; i+1 < len(tt.env); i += 2 {
+				t.Setenv(tt.env[i], tt.env[i+1])
+			}
+			t.Setenv("DROPBOX_CLIENT_SECRET", "client-secret")
+
+			cfg, err := loadTestEnv(t)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error = %v, want it to mention %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.TLSMode() != tt.mode || cfg.HTTPRedirectAddr != tt.redirect {
+				t.Errorf("mode %q, redirect %q; want %q, %q", cfg.TLSMode(), cfg.HTTPRedirectAddr, tt.mode, tt.redirect)
+			}
+			if tt.mode == tlsModeAutocert && !slices.Equal(cfg.AutocertDomains, []string{"proxy.example"}) {
+				t.Errorf("AutocertDomains = %q", cfg.AutocertDomains)
+			}
+		})
+	}
+}
+
+func TestMissingVariablesReportedTogether(t *testing.T) {
+	withFlags(t)
+	for _, key := range []string{"DROPBOX_CLIENT_ID", "DROPBOX_CLIENT_SECRET", "DROPBOX_REDIRECT_URI"} {
+		t.Setenv(key, "")
+	}
+	t.Setenv("RATE_LIMIT_RPS", "fast")
+
+	_, err := LoadConfig()
+	var missing []string
+	invalid := 0
+	for _, err := range configErrors(err) {
+		var name missingVarError
+		if errors.As(err, &name) {
+			missing = append(missing, string(name))
+		} else {
+			invalid++
+		}
+	}
+	if want := "DROPBOX_CLIENT_ID DROPBOX_CLIENT_SECRET DROPBOX_REDIRECT_URI"; strings.Join(missing, " ") != want {
+		t.Errorf("missing = %v, want %s", missing, want)
+	}
+	if invalid != 1 {
+		t.Errorf("%d other errors, want the bad RATE_LIMIT_RPS alongside the missing ones", invalid)
+	}
+
+	var report strings.Builder
+	reportConfigErrors(&report, ".env", configErrors(err))
+	for _, want := range []string{"  - DROPBOX_CLIENT_ID\n", "  - DROPBOX_CLIENT_SECRET\n", "  - DROPBOX_REDIRECT_URI\n", "RATE_LIMIT_RPS", ".env"} {
+		if !strings.Contains(report.String(), want) {
+			t.Errorf("report lacks %q:\n%s", want, report.String())
+		}
+	}
+}
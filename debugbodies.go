@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// debugBodyLimit bounds each logged body, after redaction.
+const debugBodyLimit = 2048
+
+// debugBodyCapture bounds how much of a response is kept for logging, so a
+// large relayed body can't balloon memory. Bodies cut off here are too
+// incomplete to parse and are logged by size only.
+const debugBodyCapture = 64 << 10
+
+// redactedBodyFields are masked wherever they appear in a logged body.
+var redactedBodyFields = []string{
+	"refresh_token", "refresh_tokens", "access_token", "id_token",
+	"client_secret", "code_verifier", "token", "session_id",
+}
+
+// redactedRequestFields adds the authorization code. Only requests carry
+// one; in a response "code" is the error envelope's and is worth seeing.
+var redactedRequestFields = append([]string{"code"}, redactedBodyFields...)
+
+// withBodyLogging logs API request and response bodies under DEBUG_BODIES,
+// with the secret fields masked. Only bodies that parse as JSON or a form
+// are logged; anything else is reported by size, since it can't be redacted
+// field by field. It must sit inside withGzip so it sees plain responses.
+func (s *server) withBodyLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.config(r.Context())
+		if !cfg.DebugBodies || !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Read no more than decodeBody would accept, and hand the handler
+		// the same bytes followed by whatever is left.
+		reqBody, _ := io.ReadAll(io.LimitReader(r.Body, cfg.MaxBodyBytes))
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(reqBody), r.Body), r.Body}
+
+		rec := &bodyRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		log := logger(r.Context())
+		log.Info("debug request body", "path", r.URL.Path, "body", redactBody(r.Header.Get("Content-Type"), reqBody, false, redactedRequestFields))
+		log.Info("debug response body", "path", r.URL.Path, "status", rec.status,
+			"body", redactBody(rec.Header().Get("Content-Type"), rec.body.Bytes(), rec.truncated, redactedBodyFields))
+	})
+}
+
+// bodyRecorder keeps the first debugBodyCapture bytes of a response.
+type bodyRecorder struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (r *bodyRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *bodyRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if room := debugBodyCapture - r.body.Len(); room < len(b) {
+		r.body.Write(b[:max(room, 0)])
+		r.truncated = true
+	} else {
+		r.body.Write(b)
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *bodyRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// redactBody renders body for the log with the given fields masked.
+func redactBody(contentType string, body []byte, truncated bool, fields []string) string {
+	if len(body) == 0 {
+		return ""
+	}
+	summary := fmt.Sprintf("[%d bytes, not logged]", len(body))
+	if truncated {
+		return summary
+	}
+
+	var out []byte
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case contentTypeForm:
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return summary
+		}
+		for key := range values {
+			if slices.Contains(fields, key) {
+				values[key] = []string{"[redacted]"}
+			}
+		}
+		out = []byte(values.Encode())
+	default:
+		var v any
+		if err := json.Unmarshal(body, &v); err != nil {
+			return summary
+		}
+		out, _ = json.Marshal(redactJSON(v, fields))
+	}
+
+	if len(out) > debugBodyLimit {
+		return string(out[:debugBodyLimit]) + "...[truncated]"
+	}
+	return string(out)
+}
+
+func redactJSON(v any, fields []string) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if slices.Contains(fields, key) {
+				v[key] = "[redacted]"
+			} else {
+				v[key] = redactJSON(value, fields)
+			}
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = redactJSON(value, fields)
+		}
+	}
+	return v
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactBody(t *testing.T) {
+	tests := []struct {
+		name, contentType, body string
+		fields                  []string
+		want                    string
+	}{
+		{
+			name:        "request json",
+			contentType: contentTypeJSON,
+			body:        `{"code":"c","refresh_token":"r","session_id":"s","redirect_uri":"u"}`,
+			fields:      redactedRequestFields,
+			want:        `{"code":"[redacted]","redirect_uri":"u","refresh_token":"[redacted]","session_id":"[redacted]"}`,
+		},
+		{
+			name:        "request form",
+			contentType: contentTypeForm,
+			body:        "code=c&client_secret=x&state=s",
+			fields:      redactedRequestFields,
+			want:        "client_secret=%5Bredacted%5D&code=%5Bredacted%5D&state=s",
+		},
+		{
+			name:        "response keeps error code",
+			contentType: contentTypeJSON,
+			body:        `{"code":"invalid_request","error":"bad"}`,
+			fields:      redactedBodyFields,
+			want:        `{"code":"invalid_request","error":"bad"}`,
+		},
+		{
+			name:        "nested token",
+			contentType: contentTypeJSON,
+			body:        `[{"status":200,"token":{"access_token":"a"}}]`,
+			fields:      redactedBodyFields,
+			want:        `[{"status":200,"token":"[redacted]"}]`,
+		},
+		{
+			name:        "unparseable",
+			contentType: "text/plain",
+			body:        "secret",
+			fields:      redactedBodyFields,
+			want:        "[6 bytes, not logged]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactBody(tt.contentType, []byte(tt.body), false, tt.fields); got != tt.want {
+				t.Errorf("redactBody = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactBodyTruncated(t *testing.T) {
+	got := redactBody(contentTypeJSON, []byte(`{"access_token":"a"`), true, redactedBodyFields)
+	if strings.Contains(got, "access_token") {
+		t.Errorf("truncated body logged: %s", got)
+	}
+}
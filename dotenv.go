@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// fromDotEnv records the variables loadDotEnv set, as opposed to ones that
+// were in the real environment. Only main's goroutines touch it, one at a
+// time.
+var fromDotEnv = make(map[string]bool)
+
+// loadDotEnv sets variables from a KEY=value file without overriding anything
+// already present in the real environment. Variables an earlier call set are
+// updated, or unset when their line is gone, so loading again picks up edits.
+// A missing file is not an error.
+func loadDotEnv(path string) error {
+	seen := make(map[string]bool)
+
+	f, err := os.Open(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		err = setDotEnv(f, path, seen)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	for key := range fromDotEnv {
+		if !seen[key] {
+			os.Unsetenv(key)
+			delete(fromDotEnv, key)
+		}
+	}
+	return nil
+}
+
+func setDotEnv(f *os.File, path string, seen map[string]bool) error {
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		key, value, ok, err := parseDotEnvLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		if !ok {
+			continue
+		}
+		seen[key] = true
+		if _, set := os.LookupEnv(key); !set || fromDotEnv[key] {
+			os.Setenv(key, value)
+			fromDotEnv[key] = true
+		}
+	}
+	return scanner.Err()
+}
+
+// parseDotEnvLine understands blank lines, # comments, an optional "export "
+// prefix, and single- or double-quoted values. ok is false for lines that
+// carry no assignment.
+func parseDotEnvLine(line string) (key, value string, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false, nil
+	}
+	line = strings.TrimPrefix(line, "export ")
+
+	key, value, found := strings.Cut(line, "=")
+	key = strings.TrimSpace(key)
+	if !found || key == "" || strings.ContainsAny(key, " \t") {
+		return "", "", false, errors.New("expected KEY=value")
+	}
+
+	value = strings.TrimSpace(value)
+	switch {
+	case strings.HasPrefix(value, `"`):
+		end := closingQuote(value)
+		if end < 0 {
+			return "", "", false, errors.New("unterminated double-quoted value")
+		}
+		value, err = strconv.Unquote(value[:end+1])
+		if err != nil {
+			return "", "", false, err
+		}
+	case strings.HasPrefix(value, "'"):
+		end := strings.Index(value[1:], "'")
+		if end < 0 {
+			return "", "", false, errors.New("unterminated single-quoted value")
+		}
+		value = value[1 : end+1]
+	default:
+		if i := strings.Index(value, " #"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+	}
+
+	return key, value, true, nil
+}
+
+// closingQuote returns the index of the double quote ending the string that
+// starts at s[0], skipping backslash escapes.
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseDotEnvLine(t *testing.T) {
+	for _, tc := range []struct {
+		line, key, value string
+		ok               bool
+		err              string
+	}{
+		{line: ""},
+		{line: "   \t"},
+		{line: "# LOG_LEVEL=debug"},
+		{line: "  # indented comment"},
+		{line: "KEY=value", key: "KEY", value: "value", ok: true},
+		{line: " KEY = value ", key: "KEY", value: "value", ok: true},
+		{line: "KEY=", key: "KEY", value: "", ok: true},
+		{line: "export KEY=value", key: "KEY", value: "value", ok: true},
+		{line: "KEY=a=b", key: "KEY", value: "a=b", ok: true},
+		{line: `KEY="two words"`, key: "KEY", value: "two words", ok: true},
+		{line: `KEY="say \"hi\"\n\ttab"`, key: "KEY", value: "say \"hi\"\n\ttab", ok: true},
+		{line: `KEY="quoted" # comment`, key: "KEY", value: "quoted", ok: true},
+		{line: `KEY='it "is" raw \n'`, key: "KEY", value: `it "is" raw \n`, ok: true},
+		{line: "KEY=value # comment", key: "KEY", value: "value", ok: true},
+		{line: "KEY=value#not-a-comment", key: "KEY", value: "value#not-a-comment", ok: true},
+		{line: `KEY="value # kept"`, key: "KEY", value: "value # kept", ok: true},
+		{line: `KEY="unterminated`, err: "unterminated double-quoted value"},
+		{line: `KEY="escaped end\"`, err: "unterminated double-quoted value"},
+		{line: `KEY='unterminated`, err: "unterminated single-quoted value"},
+		{line: "no assignment", err: "expected KEY=value"},
+		{line: "=value", err: "expected KEY=value"},
+		{line: "TWO WORDS=value", err: "expected KEY=value"},
+	} {
+		key, value, ok, err := parseDotEnvLine(tc.line)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%q: error %v, want %q", tc.line, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || key != tc.key || value != tc.value || ok != tc.ok {
+			t.Errorf("%q: got %q=%q ok=%v err=%v, want %q=%q ok=%v", tc.line, key, value, ok, err, tc.key, tc.value, tc.ok)
+		}
+	}
+}
+
+func TestDotEnvErrorLine(t *testing.T) {
+	path, write := useDotEnv(t)
+	write("# settings\nTODOSRV_TEST_OK=1\n\nTODOSRV_TEST_BAD='open\n")
+
+	err := loadDotEnv(path)
+	if want := path + ":4: unterminated single-quoted value"; err == nil || err.Error() != want {
+		t.Errorf("error %v, want %q", err, want)
+	}
+}
+
+func TestDotEnvPrecedenceAndReload(t *testing.T) {
+	t.Setenv("TODOSRV_TEST_REAL", "from-environment")
+	for _, key := range []string{"TODOSRV_TEST_KEPT", "TODOSRV_TEST_REMOVED"} {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+	path, write := useDotEnv(t)
+
+	write("TODOSRV_TEST_REAL=from-file\nTODOSRV_TEST_KEPT=one\nTODOSRV_TEST_REMOVED=gone-soon\n")
+	if err := loadDotEnv(path); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"TODOSRV_TEST_REAL":    "from-environment",
+		"TODOSRV_TEST_KEPT":    "one",
+		"TODOSRV_TEST_REMOVED": "gone-soon",
+	} {
+		if got := os.Getenv(key); got != want {
+			t.Errorf("first load: %s = %q, want %q", key, got, want)
+		}
+	}
+
+	write("TODOSRV_TEST_KEPT=two\n")
+	if err := loadDotEnv(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("TODOSRV_TEST_KEPT"); got != "two" {
+		t.Errorf("edited key = %q, want two", got)
+	}
+	if got, set := os.LookupEnv("TODOSRV_TEST_REMOVED"); set {
+		t.Errorf("removed key still set to %q", got)
+	}
+	if got := os.Getenv("TODOSRV_TEST_REAL"); got != "from-environment" {
+		t.Errorf("real variable = %q, want it untouched when gone from the file", got)
+	}
+	if strings.Contains(strings.Join(os.Environ(), "\n"), "from-file") {
+		t.Error("file value leaked over the real environment")
+	}
+}
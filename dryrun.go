@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// secretFormFields are the token grant fields kept out of the dry-run log.
+var secretFormFields = []string{"client_secret", "code", "refresh_token", "code_verifier"}
+
+// dryRunToken answers a token grant under DRY_RUN without contacting
+// Dropbox: the form that would have been sent is logged with its secrets
+// redacted, and a canned token is returned. The response carries
+// X-Dry-Run: true and every log line says dry run, so neither can pass for
+// the real thing.
+func dryRunToken(w http.ResponseWriter, provider Provider, data url.Values, log *slog.Logger, now time.Time) *DropboxTokenResponse {
+	form := make(map[string]string, len(data))
+	for key := range data {
+		form[key] = data.Get(key)
+	}
+	for _, key := range secretFormFields {
+		if _, ok := form[key]; ok {
+			form[key] = "[redacted]"
+		}
+	}
+	log.Warn("dry run: not calling dropbox", "url", provider.TokenURL, "form", form)
+
+	token := &DropboxTokenResponse{
+		AccessToken:  "dry-run-access-token",
+		TokenType:    "bearer",
+		ExpiresIn:    14400,
+		RefreshToken: "dry-run-refresh-token",
+		AccountID:    "dbid:dry-run",
+		UID:          "dry-run",
+	}
+	if data.Get("grant_type") == "refresh_token" {
+		token.RefreshToken = ""
+	}
+	token.ExpiresAt = now.UTC().Add(time.Duration(token.ExpiresIn) * time.Second).Format(time.RFC3339)
+
+	w.Header().Set("X-Dry-Run", "true")
+	writeToken(w, token)
+	return token
+}
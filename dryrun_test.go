@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDryRunMakesNoHTTPCall(t *testing.T) {
+	logs := captureLogs(t)
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		t.Errorf("dry run sent %s %s", r.Method, r.URL)
+		return nil, errors.New("dry run must not call out")
+	})}
+	cfg := testConfig(t, "http://dropbox.invalid", "DRY_RUN", "true", "DROPBOX_CLIENT_SECRET", "app-secret-XYZ")
+	s := newServer(cfg, client, nil, nil, nil)
+	h, _ := s.routes()
+
+	for _, tc := range []struct {
+		path, body, refresh string
+	}{
+		{"/api/dropbox/exchange", exchangeBody(s, "code-1", ""), "dry-run-refresh-token"},
+		{"/api/dropbox/refresh", `{"refresh_token":"secret-refresh-token"}`, ""},
+	} {
+		w := do(h, "POST", tc.path, contentTypeJSON, tc.body)
+		if w.Code != http.StatusOK || w.Header().Get("X-Dry-Run") != "true" {
+			t.Errorf("%s: status %d, X-Dry-Run %q", tc.path, w.Code, w.Header().Get("X-Dry-Run"))
+			continue
+		}
+		token := decodeJSON[DropboxTokenResponse](t, w)
+		if token.AccessToken != "dry-run-access-token" || token.RefreshToken != tc.refresh || token.ExpiresAt == "" {
+			t.Errorf("%s: token = %+v", tc.path, token)
+		}
+	}
+
+	if !strings.Contains(logs.String(), "dry run: not calling dropbox") {
+		t.Errorf("dry run not logged:\n%s", logs)
+	}
+	for _, secret := range []string{"app-secret-XYZ", "secret-refresh-token"} {
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("logs contain %q", secret)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// flagValues holds the command-line overrides, keyed by the environment
+// variable each flag stands for. getenv consults it first, so the precedence
+// is flag, then environment, then the built-in default, and a SIGHUP reload
+// keeps the flags.
+var flagValues = map[string]string{}
+
+// healthcheckMode and healthcheckPath are set by -healthcheck and
+// -healthcheck-path, which turn the process into a probe of a running server.
+var (
+	healthcheckMode bool
+	healthcheckPath string
+)
+
+// configFlags maps flags to the variables they override. Only the settings
+// worth changing for a quick local run have one.
+var configFlags = []struct {
+	name, env, usage string
+	bool             bool
+}{
+	{name: "env-file", env: "ENV_FILE", usage: "env file to load"},
+	{name: "port", env: "PORT", usage: "port to listen on"},
+	{name: "listen-addr", env: "LISTEN_ADDR", usage: "address to listen on, overriding -port"},
+	{name: "client-id", env: "DROPBOX_CLIENT_ID", usage: "Dropbox app key"},
+	{name: "client-secret", env: "DROPBOX_CLIENT_SECRET", usage: "Dropbox app secret; visible to other local users, prefer the environment"},
+	{name: "redirect-uri", env: "DROPBOX_REDIRECT_URI", usage: "OAuth redirect URI registered with Dropbox"},
+	{name: "api-url", env: "DROPBOX_API_URL", usage: "Dropbox API base URL"},
+	{name: "allowed-origins", env: "ALLOWED_ORIGINS", usage: "comma-separated CORS origins, matched exactly"},
+	{name: "frontend-url", env: "FRONTEND_URL", usage: "where the OAuth callback sends the browser"},
+	{name: "log-level", env: "LOG_LEVEL", usage: "debug, info, warn or error"},
+	{name: "rate-limit-rps", env: "RATE_LIMIT_RPS", usage: "requests per second per client IP"},
+	{name: "rate-limit-burst", env: "RATE_LIMIT_BURST", usage: "burst size per client IP"},
+	{name: "trust-proxy", env: "TRUST_PROXY", usage: "trust X-Forwarded-For and X-Forwarded-Proto", bool: true},
+	{name: "request-timeout", env: "REQUEST_TIMEOUT", usage: "deadline for each request"},
+	{name: "token-store", env: "TOKEN_STORE", usage: "memory or sqlite to enable sessions"},
+	{name: "token-store-path", env: "TOKEN_STORE_PATH", usage: "sqlite database path"},
+	{name: "redis-url", env: "REDIS_URL", usage: "Redis for shared rate-limit and cache state"},
+	{name: "audit-log", env: "AUDIT_LOG", usage: "stdout or a file path for audit records"},
+	{name: "tls-cert", env: "TLS_CERT_FILE", usage: "TLS certificate file"},
+	{name: "tls-key", env: "TLS_KEY_FILE", usage: "TLS private key file"},
+}
+
+// envFlag records a flag's value under its environment variable.
+type envFlag struct {
+	env  string
+	bool bool
+}
+
+func (f envFlag) String() string { return "" }
+
+func (f envFlag) Set(value string) error {
+	flagValues[f.env] = value
+	return nil
+}
+
+func (f envFlag) IsBoolFlag() bool { return f.bool }
+
+// parseFlags reads the command line into flagValues. Values are checked
+// with the rest of the configuration by LoadConfig.
+func parseFlags(args []string) error {
+	fs := flag.NewFlagSet("todosrv", flag.ContinueOnError)
+	for _, f := range configFlags {
+		fs.Var(envFlag{env: f.env, bool: f.bool}, f.name, fmt.Sprintf("%s (%s)", f.usage, f.env))
+	}
+	fs.BoolVar(&healthcheckMode, "healthcheck", false, "probe the running server and exit 0 if healthy, without serving")
+	fs.StringVar(&healthcheckPath, "healthcheck-path", "/healthz", "endpoint -healthcheck probes, such as /readyz")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: todosrv [flags]\n\n"+
+			"Every setting is read from the environment; a flag overrides the\n"+
+			"variable shown with it. Unset settings take their defaults.\n\n")
+		fs.PrintDefaults()
+	}
+	return fs.Parse(args)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log/slog"
+	"maps"
+	"testing"
+)
+
+// withFlags parses args for the duration of the test.
+func withFlags(t *testing.T, args ...string) {
+	t.Helper()
+	saved := maps.Clone(flagValues)
+	t.Cleanup(func() { flagValues = saved })
+	flagValues = map[string]string{}
+	if err := parseFlags(args); err != nil {
+		t.Fatalf("parseFlags: %v", err)
+	}
+}
+
+func TestFlagPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		env  []string
+		args []string
+		want slog.Level
+	}{
+		{name: "default", want: slog.LevelInfo},
+		{name: "environment", env: []string{"LOG_LEVEL", "warn"}, want: slog.LevelWarn},
+		{name: "flag beats environment", env: []string{"LOG_LEVEL", "warn"}, args: []string{"-log-level", "error"}, want: slog.LevelError},
+		{name: "flag beats default", args: []string{"-log-level=debug"}, want: slog.LevelDebug},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LOG_LEVEL", "")
+			withFlags(t, tt.args...)
+			cfg := testConfig(t, "https://api.example", tt.env...)
+			if cfg.LogLevel != tt.want {
+				t.Errorf("LogLevel = %s, want %s", cfg.LogLevel, tt.want)
+			}
+		})
+	}
+}
+
+func TestListenAddrPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		env  []string
+		args []string
+		want string
+	}{
+		{name: "default", want: ":3000"},
+		{name: "port", env: []string{"PORT", "4000"}, want: ":4000"},
+		{name: "listen addr beats port", env: []string{"PORT", "4000", "LISTEN_ADDR", "127.0.0.1:5000"}, want: "127.0.0.1:5000"},
+		{name: "port flag beats listen addr env", env: []string{"LISTEN_ADDR", ":3001"}, args: []string{"-port", "4000"}, want: ":4000"},
+		{name: "listen addr flag beats port flag", args: []string{"-port", "4000", "-listen-addr", ":5000"}, want: ":5000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PORT", "")
+			t.Setenv("LISTEN_ADDR", "")
+			withFlags(t, tt.args...)
+			if cfg := testConfig(t, "https://api.example", tt.env...); cfg.ListenAddr != tt.want {
+				t.Errorf("ListenAddr = %q, want %q", cfg.ListenAddr, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIDFlagBeatsEnvironment(t *testing.T) {
+	withFlags(t, "-client-id", "from-flag")
+	if cfg := testConfig(t, "https://api.example", "DROPBOX_CLIENT_ID", "from-env"); cfg.ClientID != "from-flag" {
+		t.Errorf("ClientID = %q, want the flag value", cfg.ClientID)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"sync"
+)
+
+// capturedResponse buffers a handler's response so it can be replayed to any
+// number of clients.
+type capturedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+
+	token *DropboxTokenResponse
+}
+
+func newCapturedResponse() *capturedResponse {
+	return &capturedResponse{header: make(http.Header)}
+}
+
+func (c *capturedResponse) Header() http.Header { return c.header }
+
+func (c *capturedResponse) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	return c.body.Write(b)
+}
+
+func (c *capturedResponse) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+func (c *capturedResponse) replay(w http.ResponseWriter) {
+	for key, values := range c.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(c.status)
+	w.Write(c.body.Bytes())
+}
+
+type flightCall struct {
+	done chan struct{}
+	res  *capturedResponse
+}
+
+// flightGroup collapses concurrent calls with the same key into one, in the
+// spirit of golang.org/x/sync/singleflight.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*flightCall)}
+}
+
+// do runs fn once per key at a time; callers arriving while it runs wait for
+// and share its result. fn runs on its own goroutine so every caller,
+// including the one that started it, can stop waiting when its ctx ends. A
+// nil result means fn panicked or ctx ended first.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() *capturedResponse) (res *capturedResponse, shared bool) {
+	g.mu.Lock()
+	call, shared := g.calls[key]
+	if !shared {
+		call = &flightCall{done: make(chan struct{})}
+		g.calls[key] = call
+		go g.run(key, call, fn)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.res, shared
+	case <-ctx.Done():
+		return nil, shared
+	}
+}
+
+func (g *flightGroup) run(key string, call *flightCall, fn func() *capturedResponse) {
+	defer func() {
+		if p := recover(); p != nil {
+			slog.Error("panic in shared call", "panic", p, "stack", string(debug.Stack()))
+		}
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.res = fn()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentRefreshesShareOneCall(t *testing.T) {
+	release := make(chan struct{})
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		tokenHandler(w, r)
+	})
+	_, h := newTestServer(t, testConfig(t, stub.URL, "RATE_LIMIT_BURST", "100"))
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 10)
+	for i := range bodies {
+		wg.Go(func() {
+			w := do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"same"}`)
+			if w.Code != http.StatusOK {
+				t.Errorf("request %d: status %d", i, w.Code)
+			}
+			bodies[i] = w.Body.String()
+		})
+	}
+	// Give every request time to join the flight before Dropbox answers.
+	for stub.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := stub.calls.Load(); n != 1 {
+		t.Errorf("%d dropbox calls for 10 identical refreshes, want 1", n)
+	}
+	for i, body := range bodies {
+		if body != bodies[0] {
+			t.Errorf("request %d got %q, request 0 got %q", i, body, bodies[0])
+		}
+	}
+}
+
+// The shared call isn't tied to the client that started it: that client
+// leaving mustn't fail the others.
+func TestFlightOutlivesItsStarter(t *testing.T) {
+	g := newFlightGroup()
+	started, release := make(chan struct{}), make(chan struct{})
+	fn := func() *capturedResponse {
+		close(started)
+		<-release
+		res := newCapturedResponse()
+		res.WriteHeader(http.StatusTeapot)
+		return res
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	starter := make(chan *capturedResponse)
+	go func() {
+		res, _ := g.do(ctx, "k", fn)
+		starter <- res
+	}()
+	<-started
+	cancel()
+	if res := <-starter; res != nil {
+		t.Errorf("canceled caller got %v, want nil", res)
+	}
+
+	waiter := make(chan *capturedResponse)
+	go func() {
+		res, shared := g.do(context.Background(), "k", nil)
+		if !shared {
+			t.Error("second caller started its own call")
+		}
+		waiter <- res
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	if res := <-waiter; res == nil || res.status != http.StatusTeapot {
+		t.Errorf("waiter got %+v, want the shared result", res)
+	}
+}
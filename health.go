@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readinessChecker caches the result of a Dropbox reachability probe so
+// frequent orchestrator probes don't turn into a request per probe.
+type readinessChecker struct {
+	client  *http.Client
+	clock   Clock
+	url     string
+	ttl     time.Duration
+	timeout time.Duration
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+func newReadinessChecker(client *http.Client, clock Clock, url string) *readinessChecker {
+	return &readinessChecker{
+		client:  client,
+		clock:   clock,
+		url:     url,
+		ttl:     5 * time.Second,
+		timeout: 2 * time.Second,
+	}
+}
+
+func (c *readinessChecker) check(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.checkedAt.IsZero() && c.clock.Now().Sub(c.checkedAt) < c.ttl {
+		return c.err
+	}
+
+	c.err = c.probe(ctx)
+	c.checkedAt = c.clock.Now()
+	return c.err
+}
+
+// probe only cares that Dropbox answers; any HTTP status means the host is
+// reachable.
+func (c *readinessChecker) probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// healthHandler is registered outside withCORS so probes from any origin
+// succeed. It never touches Dropbox.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	writeStatus(w, "ok", http.StatusOK)
+}
+
+func (s *server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if s.draining.Load() {
+		w.Header().Set("Cache-Control", "no-store")
+		writeError(w, r, errCodeDraining, "instance is draining", http.StatusServiceUnavailable)
+		return
+	}
+	if err := s.readiness.check(r.Context()); err != nil {
+		w.Header().Set("Cache-Control", "no-store")
+		writeError(w, r, errCodeUpstreamUnavailable, "dropbox unreachable", http.StatusServiceUnavailable)
+		return
+	}
+	writeStatus(w, "ok", http.StatusOK)
+}
+
+func writeStatus(w http.ResponseWriter, status string, code int) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": status,
+	})
+}
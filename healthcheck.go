@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// healthcheckTimeout bounds the whole probe, so a hung server reads as
+// unhealthy before the orchestrator's own timeout kills the check.
+const healthcheckTimeout = 5 * time.Second
+
+// runHealthcheck probes path on the server started with cfg, as a container
+// healthcheck that needs no curl in the image. The probes live on ADMIN_ADDR
+// when it is set and on the public listener otherwise, reached over loopback
+// when the listener binds every interface. A non-nil error means unhealthy.
+func runHealthcheck(cfg Config, path string, out io.Writer) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("healthcheck path %q must start with /", path)
+	}
+
+	addr, scheme := cfg.ListenAddr, "http"
+	if cfg.AdminAddr != "" {
+		addr = cfg.AdminAddr
+	} else if cfg.TLSEnabled() {
+		scheme = "https"
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+
+	client := &http.Client{
+		Timeout: healthcheckTimeout,
+		Transport: &http.Transport{
+			// The certificate names the public host, not the loopback
+			// address the probe dials.
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+		// Redirects would point at the public name; the probe wants this
+		// instance's own answer.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	url := scheme + "://" + net.JoinHostPort(host, port) + path
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s %s", url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	fmt.Fprintf(out, "%s: %s %s\n", url, resp.Status, strings.TrimSpace(string(body)))
+	return nil
+}
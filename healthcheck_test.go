@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func healthStub(t *testing.T, tls bool) (addr string) {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, `{"status":"ok"}`) })
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, `{"code":"draining"}`)
+	})
+	mux.HandleFunc("GET /moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://proxy.example/healthz", http.StatusMovedPermanently)
+	})
+	srv := httptest.NewUnstartedServer(mux)
+	if tls {
+		srv.StartTLS()
+	} else {
+		srv.Start()
+	}
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+func TestHealthcheck(t *testing.T) {
+	addr := healthStub(t, false)
+	_, port, _ := net.SplitHostPort(addr)
+
+	var out bytes.Buffer
+	if err := runHealthcheck(Config{ListenAddr: ":" + port}, "/healthz", &out); err != nil {
+		t.Fatalf("healthy: %v", err)
+	}
+	if want := "http://127.0.0.1:" + port + "/healthz: 200 OK"; !strings.HasPrefix(out.String(), want) {
+		t.Errorf("output %q, want it to start %q", out.String(), want)
+	}
+
+	err := runHealthcheck(Config{ListenAddr: addr}, "/readyz", io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "503") || !strings.Contains(err.Error(), "draining") {
+		t.Errorf("unready: error %v, want the status and body", err)
+	}
+	if err := runHealthcheck(Config{ListenAddr: addr}, "/moved", io.Discard); err == nil {
+		t.Error("redirect followed instead of failing the check")
+	}
+	if err := runHealthcheck(Config{ListenAddr: addr}, "healthz", io.Discard); err == nil {
+		t.Error("relative path accepted")
+	}
+	if err := runHealthcheck(Config{ListenAddr: freeAddr(t)}, "/healthz", io.Discard); err == nil {
+		t.Error("nothing listening, yet healthy")
+	}
+}
+
+func TestHealthcheckListenerChoice(t *testing.T) {
+	plain, tls := healthStub(t, false), healthStub(t, true)
+
+	// ADMIN_ADDR holds the probes and stays plain HTTP, even with TLS on the
+	// public listener.
+	cfg := Config{ListenAddr: tls, AdminAddr: plain, TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"}
+	if err := runHealthcheck(cfg, "/healthz", io.Discard); err != nil {
+		t.Errorf("admin listener: %v", err)
+	}
+	cfg.AdminAddr = ""
+	if err := runHealthcheck(cfg, "/healthz", io.Discard); err != nil {
+		t.Errorf("public listener over TLS: %v", err)
+	}
+}
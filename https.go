@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// isHTTPS reports whether the client connection was TLS. Behind a trusted
+// proxy the proxy's X-Forwarded-Proto wins, since it saw the client.
+func isHTTPS(r *http.Request, trustProxy bool) bool {
+	if proto := r.Header.Get("X-Forwarded-Proto"); trustProxy && proto != "" {
+		return proto == "https"
+	}
+	return r.TLS != nil
+}
+
+func (c Config) hstsHeader() string {
+	value := "max-age=" + strconv.FormatInt(int64(c.HSTSMaxAge.Seconds()), 10)
+	if c.HSTSIncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	return value
+}
+
+// withHTTPSRedirect sends plain HTTP requests that reached the public listener
+// through a trusted proxy to HTTPS. Without TLS it does nothing, so local
+// plain-HTTP development is unaffected.
+func (s *server) withHTTPSRedirect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.config(r.Context())
+		if !cfg.TLSEnabled() || isHTTPS(r, cfg.TrustProxy) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.Redirect(w, r, "https://"+r.Host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// redirectToHTTPS serves TLS_HTTP_ADDR, pointing each request at the same
+// host on the HTTPS listener.
+func (s *server) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if _, port, _ := net.SplitHostPort(s.config(r.Context()).ListenAddr); port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPSRedirect(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	cfg := testConfig(t, "http://dropbox.invalid",
+		"TLS_CERT_FILE", certFile, "TLS_KEY_FILE", keyFile, "TRUST_PROXY", "true",
+		"HSTS_MAX_AGE", "1h", "HSTS_INCLUDE_SUBDOMAINS", "true")
+	_, h := newTestServer(t, cfg)
+
+	r := httptest.NewRequest("GET", "http://proxy.example/healthz?full=1", nil)
+	r.Header.Set("X-Forwarded-Proto", "http")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "https://proxy.example/healthz?full=1" {
+		t.Errorf("plain http: status %d, Location %q", w.Code, w.Header().Get("Location"))
+	}
+
+	r = httptest.NewRequest("GET", "https://proxy.example/healthz", nil)
+	r.TLS = &tls.ConnectionState{}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Strict-Transport-Security") != "max-age=3600; includeSubDomains" {
+		t.Errorf("https: status %d, Strict-Transport-Security %q", w.Code, w.Header().Get("Strict-Transport-Security"))
+	}
+}
+
+// Without TLS neither the redirect nor HSTS applies, so local development
+// over plain HTTP keeps working.
+func TestHTTPSRedirectInertWithoutTLS(t *testing.T) {
+	_, h := newTestServer(t, testConfig(t, "http://dropbox.invalid", "TRUST_PROXY", "true"))
+
+	r := httptest.NewRequest("GET", "http://localhost/healthz", nil)
+	r.Header.Set("X-Forwarded-Proto", "http")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Strict-Transport-Security") != "" {
+		t.Errorf("status %d, Strict-Transport-Security %q", w.Code, w.Header().Get("Strict-Transport-Security"))
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	for _, tc := range []struct {
+		listen, want string
+	}{
+		{":443", "https://proxy.example/api/pkce?x=1"},
+		{":8443", "https://proxy.example:8443/api/pkce?x=1"},
+	} {
+		s, _ := newTestServer(t, testConfig(t, "http://dropbox.invalid", "LISTEN_ADDR", tc.listen))
+		r := httptest.NewRequest("GET", "http://proxy.example:8080/api/pkce?x=1", nil)
+		w := httptest.NewRecorder()
+		s.redirectToHTTPS(w, r)
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != tc.want {
+			t.Errorf("LISTEN_ADDR %s: status %d, Location %q, want %s", tc.listen, w.Code, w.Header().Get("Location"), tc.want)
+		}
+	}
+}
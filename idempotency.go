@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotentResponse is a finished exchange kept for replay. fingerprint
+// identifies the request it answered, so a key reused for a different code is
+// refused rather than answered with someone else's tokens.
+type idempotentResponse struct {
+	fingerprint string
+	res         *capturedResponse
+}
+
+// idempotentExchange runs an exchange at most once per Idempotency-Key within
+// IDEMPOTENCY_TTL; see replayableExchange. It returns the token written to w,
+// or nil.
+func (s *server) idempotentExchange(w http.ResponseWriter, r *http.Request, provider Provider, data url.Values, idemKey string) *DropboxTokenResponse {
+	if !validRequestID(idemKey) {
+		writeError(w, r, errCodeInvalidRequest, "invalid "+idempotencyKeyHeader, http.StatusBadRequest)
+		return nil
+	}
+
+	key := cacheKey("exchange", provider.Name, idemKey)
+	token, ok := s.replayableExchange(w, r, provider, data, s.idempotent, key, s.config(r.Context()).IdempotencyTTL)
+	if !ok {
+		writeError(w, r, errCodeIdempotencyConflict, idempotencyKeyHeader+" was already used for a different request", http.StatusUnprocessableEntity)
+	}
+	return token
+}
+
+// dedupedExchange answers a code submitted again within EXCHANGE_DEDUP_WINDOW
+// with the first submission's response, so a double-submit doesn't reach
+// Dropbox and fail with invalid_grant. A repeat that differs in anything but
+// the code gets a 409, since the code has already been spent.
+func (s *server) dedupedExchange(w http.ResponseWriter, r *http.Request, provider Provider, data url.Values) *DropboxTokenResponse {
+	key := cacheKey("code", provider.Name, data.Get("code"))
+	token, ok := s.replayableExchange(w, r, provider, data, s.seenCodes, key, s.config(r.Context()).ExchangeDedupWindow)
+	if !ok {
+		writeError(w, r, errCodeCodeReused, "code was already exchanged by a different request", http.StatusConflict)
+	}
+	return token
+}
+
+// replayableExchange runs the exchange for key once and keeps its response in
+// cache for ttl. Repeats, including ones arriving while the first is still in
+// flight, get the first response verbatim plus Idempotent-Replayed: true.
+// Responses that failed before Dropbox could consume the code (5xx) are not
+// kept, so a retry still reaches Dropbox. It reports false, having written
+// nothing, when key was used for a request with different parameters.
+func (s *server) replayableExchange(w http.ResponseWriter, r *http.Request, provider Provider, data url.Values, cache *ttlCache[idempotentResponse], key string, ttl time.Duration) (*DropboxTokenResponse, bool) {
+	fingerprint := cacheKey(data.Get("code"), data.Get("redirect_uri"), data.Get("code_verifier"), data.Get("token_access_type"))
+
+	if cached, ok := cache.get(key); ok {
+		if cached.fingerprint != fingerprint {
+			return nil, false
+		}
+		logger(r.Context()).Debug("replayed exchange")
+		w.Header().Set("Idempotent-Replayed", "true")
+		cached.res.replay(w)
+		return cached.res.token, true
+	}
+
+	res, shared := s.exchanges.do(r.Context(), key+fingerprint, func() *capturedResponse {
+		rec := newCapturedResponse()
+		rec.token = s.exchange(rec, r.WithContext(context.WithoutCancel(r.Context())), provider, data)
+		if rec.status < http.StatusInternalServerError {
+			cache.set(key, idempotentResponse{fingerprint: fingerprint, res: rec}, ttl)
+		}
+		return rec
+	})
+	if res == nil {
+		writeUpstreamError(w, r, "failed to contact dropbox")
+		return nil, true
+	}
+	if shared {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	res.replay(w)
+	return res.token, true
+}
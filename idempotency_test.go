@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func exchangeWithKey(h http.Handler, body, key string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/api/dropbox/exchange", strings.NewReader(body))
+	r.Header.Set("Content-Type", contentTypeJSON)
+	r.Header.Set(idempotencyKeyHeader, key)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestIdempotencyKeyReplays(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	s, h := newTestServer(t, testConfig(t, stub.URL))
+	body := exchangeBody(s, "code-1", "")
+
+	first := exchangeWithKey(h, body, "key-1")
+	if first.Code != http.StatusOK || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first: status %d, Idempotent-Replayed %q", first.Code, first.Header().Get("Idempotent-Replayed"))
+	}
+	second := exchangeWithKey(h, body, "key-1")
+	if second.Code != http.StatusOK || second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("repeat: status %d, Idempotent-Replayed %q", second.Code, second.Header().Get("Idempotent-Replayed"))
+	}
+	if second.Body.String() != first.Body.String() {
+		t.Errorf("repeat body %q differs from %q", second.Body, first.Body)
+	}
+	if n := stub.calls.Load(); n != 1 {
+		t.Errorf("dropbox called %d times, want 1", n)
+	}
+
+	w := exchangeWithKey(h, exchangeBody(s, "code-2", ""), "key-1")
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("key reused for another code: status %d, want 422", w.Code)
+	}
+	if got := decodeJSON[map[string]string](t, w)["code"]; got != errCodeIdempotencyConflict {
+		t.Errorf("code = %q", got)
+	}
+}
+
+// A 5xx means Dropbox never consumed the code, so the same key may try again.
+func TestIdempotencyKeySkipsServerErrors(t *testing.T) {
+	stub := flakyDropbox(t, 1, http.StatusServiceUnavailable)
+	s, h := newTestServer(t, testConfig(t, stub.URL, "DROPBOX_MAX_ATTEMPTS", "1"))
+	body := exchangeBody(s, "code-1", "")
+
+	if w := exchangeWithKey(h, body, "key-1"); w.Code != http.StatusBadGateway {
+		t.Fatalf("first: status %d, want 502", w.Code)
+	}
+	if w := exchangeWithKey(h, body, "key-1"); w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("retry: status %d, Idempotent-Replayed %q; want a fresh 200", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+}
+
+func TestIdempotencyKeyFormat(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	s, h := newTestServer(t, testConfig(t, stub.URL))
+
+	if w := exchangeWithKey(h, exchangeBody(s, "code-1", ""), "has spaces"); w.Code != http.StatusBadRequest {
+		t.Errorf("malformed key: status %d, want 400", w.Code)
+	}
+	if n := stub.calls.Load(); n != 0 {
+		t.Errorf("dropbox called %d times", n)
+	}
+}
+
+func TestExchangeDedupWindow(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	s, h, clock := newClockedTestServer(t, testConfig(t, stub.URL, "EXCHANGE_DEDUP_WINDOW", "1m"))
+
+	first := do(h, "POST", "/api/dropbox/exchange", contentTypeJSON, exchangeBody(s, "code-1", ""))
+	if first.Code != http.StatusOK {
+		t.Fatalf("first: status %d, body %s", first.Code, first.Body)
+	}
+	again := do(h, "POST", "/api/dropbox/exchange", contentTypeJSON, exchangeBody(s, "code-1", ""))
+	if again.Code != http.StatusOK || again.Header().Get("Idempotent-Replayed") != "true" || again.Body.String() != first.Body.String() {
+		t.Errorf("double-submit: status %d, Idempotent-Replayed %q, body %s", again.Code, again.Header().Get("Idempotent-Replayed"), again.Body)
+	}
+
+	w := do(h, "POST", "/api/dropbox/exchange", contentTypeJSON, exchangeBody(s, "code-1", `,"code_verifier":"other"`))
+	if w.Code != http.StatusConflict {
+		t.Errorf("same code, different request: status %d, want 409", w.Code)
+	}
+	if got := decodeJSON[map[string]string](t, w)["code"]; got != errCodeCodeReused {
+		t.Errorf("code = %q, want %s", got, errCodeCodeReused)
+	}
+	if n := stub.calls.Load(); n != 1 {
+		t.Errorf("dropbox called %d times within the window, want 1", n)
+	}
+
+	clock.Advance(time.Minute + time.Second)
+	if w := do(h, "POST", "/api/dropbox/exchange", contentTypeJSON, exchangeBody(s, "code-1", `,"code_verifier":"other"`)); w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("after the window: status %d, Idempotent-Replayed %q; want a fresh exchange", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+	if n := stub.calls.Load(); n != 2 {
+		t.Errorf("dropbox called %d times, want 2", n)
+	}
+}
+
+// Without EXCHANGE_DEDUP_WINDOW a resubmitted code goes to Dropbox, which
+// rejects it, instead of being answered with the first caller's tokens.
+func TestExchangeDedupOffByDefault(t *testing.T) {
+	used := map[string]bool{}
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		code := r.PostForm.Get("code")
+		if used[code] {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		used[code] = true
+		tokenHandler(w, r)
+	})
+	s, h := newTestServer(t, testConfig(t, stub.URL))
+
+	if w := do(h, "POST", "/api/dropbox/exchange", contentTypeJSON, exchangeBody(s, "code-1", "")); w.Code != http.StatusOK {
+		t.Fatalf("first: status %d, body %s", w.Code, w.Body)
+	}
+	w := do(h, "POST", "/api/dropbox/exchange", contentTypeJSON, exchangeBody(s, "code-1", ""))
+	if w.Code != http.StatusBadRequest || w.Header().Get("Idempotent-Replayed") != "" || strings.Contains(w.Body.String(), "sl.access") {
+		t.Errorf("resubmit: status %d, Idempotent-Replayed %q, body %s; want Dropbox's invalid_grant", w.Code, w.Header().Get("Idempotent-Replayed"), w.Body)
+	}
+	if n := stub.calls.Load(); n != 2 {
+		t.Errorf("dropbox called %d times, want both submissions", n)
+	}
+}
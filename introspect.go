@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// IntrospectResponse is the normalized answer to an introspection request.
+// The Dropbox account payload is not passed through.
+type IntrospectResponse struct {
+	Active    bool   `json:"active"`
+	AccountID string `json:"account_id,omitempty"`
+}
+
+// introspectHandler lets a resource server check an access token by asking
+// Dropbox who it belongs to. A token Dropbox rejects is reported as inactive
+// rather than as an error; only failures to get an answer are errors.
+func (s *server) introspectHandler(w http.ResponseWriter, r *http.Request) {
+	var req IntrospectRequest
+	if !s.decodeBody(w, r, &req) {
+		return
+	}
+	if req.Token == "" {
+		writeError(w, r, errCodeInvalidRequest, "token is required", http.StatusBadRequest)
+		return
+	}
+
+	log := logger(r.Context()).With("upstream", "get_current_account")
+
+	upstream, err := http.NewRequestWithContext(r.Context(), http.MethodPost, s.config(r.Context()).DropboxAPIURL+"/2/users/get_current_account", nil)
+	if err != nil {
+		log.Error("failed to build dropbox request", "error", err)
+		writeError(w, r, errCodeUpstreamError, "failed to contact dropbox", http.StatusBadGateway)
+		return
+	}
+	upstream.Header.Set("Authorization", "Bearer "+req.Token)
+
+	resp, raw, log, ok := s.fetchDropbox(w, r, "get_current_account", upstream, log)
+	if !ok {
+		return
+	}
+	defer resp.Body.Close()
+
+	// Malformed, expired and revoked tokens all land on 400 or 401, and
+	// Dropbox answers a token it can't parse at all in plain text, so the
+	// status alone decides before the body is looked at.
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+		log.Debug("token inactive", "status", resp.StatusCode)
+		writeIntrospection(w, IntrospectResponse{})
+		return
+	}
+
+	body, ok := s.dropboxJSON(w, r, "get_current_account", resp, raw, log)
+	if !ok {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Error("dropbox account lookup failed", "status", resp.StatusCode)
+		writeError(w, r, errCodeUpstreamError, "dropbox account lookup failed", http.StatusBadGateway)
+		return
+	}
+	var account struct {
+		AccountID string `json:"account_id"`
+	}
+	if err := json.NewDecoder(body).Decode(&account); err != nil || account.AccountID == "" {
+		log.Error("failed to decode dropbox account", "error", err)
+		writeError(w, r, errCodeUpstreamError, "invalid dropbox response", http.StatusBadGateway)
+		return
+	}
+	writeIntrospection(w, IntrospectResponse{Active: true, AccountID: account.AccountID})
+}
+
+func writeIntrospection(w http.ResponseWriter, out IntrospectResponse) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(out)
+}
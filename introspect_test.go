@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestIntrospect(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		wantStatus  int
+		want        IntrospectResponse
+	}{
+		{name: "active", status: 200, contentType: "application/json", body: `{"account_id":"dbid:1"}`, wantStatus: 200, want: IntrospectResponse{Active: true, AccountID: "dbid:1"}},
+		{name: "expired", status: 401, contentType: "application/json", body: `{"error_summary":"expired_access_token/"}`, wantStatus: 200},
+		{name: "garbage token", status: 400, contentType: "text/plain; charset=utf-8", body: "Error in call to API function \"users/get_current_account\": Invalid authorization value", wantStatus: 200},
+		{name: "dropbox down", status: 503, contentType: "text/html", body: "<html>down</html>", wantStatus: 502},
+		{name: "undecodable account", status: 200, contentType: "application/json", body: `{}`, wantStatus: 502},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("Authorization"); got != "Bearer tok" {
+					t.Errorf("Authorization = %q", got)
+				}
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			})
+			_, h := newTestServer(t, testConfig(t, stub.URL))
+
+			w := do(h, "POST", "/api/dropbox/token/introspect", contentTypeJSON, `{"token":"tok"}`)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code == http.StatusOK {
+				if got := decodeJSON[IntrospectResponse](t, w); got != tt.want {
+					t.Errorf("response = %+v, want %+v", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -2,158 +2,275 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 )
 
-type Config struct {
-	ClientID     string
-	ClientSecret string
-	RedirectURI  string
-}
+// logLevel is shared with reload so LOG_LEVEL can change without replacing
+// the logger.
+var logLevel slog.LevelVar
 
-type AuthCodeRequest struct {
-	Code string `json:"code"`
-}
+func main() {
+	if err := parseFlags(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		os.Exit(2)
+	}
 
-type RefreshRequest struct {
-	RefreshToken string `json:"refresh_token"`
-}
+	envFile := envOrDefault("ENV_FILE", ".env")
+	if err := loadDotEnv(envFile); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load env file: %v\n", err)
+		os.Exit(1)
+	}
 
-var (
-	cfg    Config
-	client *http.Client
-)
+	cfg, err := LoadConfig()
+	if err != nil {
+		reportConfigErrors(os.Stderr, envFile, configErrors(err))
+		os.Exit(1)
+	}
 
-func main() {
-	cfg = Config {
-		ClientID: os.Getenv("DROPBOX_CLIENT_ID"),
-		ClientSecret: os.Getenv("DROPBOX_CLIENT_SECRET"),
-		RedirectURI: os.Getenv("DROPBOX_REDIRECT_URI"),
+	if healthcheckMode {
+		if err := runHealthcheck(cfg, healthcheckPath, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Unhealthy: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	logLevel.Set(cfg.LogLevel)
+	logHandler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: &logLevel})
+	slog.SetDefault(slog.New(logHandler))
+
+	if len(cfg.StateSecret) == 0 {
+		cfg.StateSecret = make([]byte, 32)
+		rand.Read(cfg.StateSecret)
+		slog.Warn("STATE_SECRET not set, using a random per-process secret; states will not survive restarts or work across instances")
+	}
+	logStartup(cfg)
+	if cfg.DryRun {
+		slog.Warn("DRY_RUN enabled: token grants return canned tokens and never reach dropbox")
+	}
+	if cfg.DebugBodies {
+		slog.Warn("DEBUG_BODIES enabled: API bodies are logged with secrets masked; do not use in production")
 	}
 
-	if cfg.ClientID == "" {
-		panic("Missing required environment variables: DROPBOX_CLIENT_ID")
+	store, err := openTokenStore(cfg)
+	if err != nil {
+		slog.Error("failed to open token store", "error", err)
+		os.Exit(1)
+	}
+	if closer, ok := store.(io.Closer); ok {
+		defer closer.Close()
 	}
 
-	if (cfg.ClientSecret == "") {
-		panic("Missing required environment variable: DROPBOX_CLIENT_SECRET")
+	var redis *redisClient
+	if cfg.RedisURL != "" {
+		// Validate has already parsed the URL.
+		redis, _ = newRedisClient(cfg.RedisURL)
+		defer redis.Close()
 	}
 
-	if (cfg.RedirectURI == "") {
-		panic("Missing required environment variable: DROPBOX_REDIRECT_URI")
+	audit, err := openAuditLog(cfg.AuditLog)
+	if err != nil {
+		slog.Error("failed to open audit log", "error", err)
+		os.Exit(1)
 	}
+	defer audit.Close()
 
-	client = &http.Client{Timeout: 10 * time.Second }
+	app := newServer(cfg, newHTTPClient(cfg), store, redis, audit)
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/api/dropbox/exchange", exchangeHanlder)
-	mux.HandleFunc("/api/dropbox/refresh", refreshHandler)
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
 
-	srv := &http.Server{
-		Addr: ":3000",
-		Handler: withCORS(mux),
-	}
+	app.start(background)
 
-	go func ()  {
-		fmt.Println("Server running on http://localhost:3000")
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			panic(err)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			app.reload(envFile)
 		}
 	}()
 
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	fmt.Println("Shutting down server...")
-	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
-	defer cancel()
-
-	if err := srv.Shutdown(ctx); err != nil {
-		panic(err)
+	public, admin := app.routes()
+	newHTTPServer := func(addr string, handler http.Handler) *http.Server {
+		return newHTTPServer(cfg, addr, handler, logHandler)
 	}
-
-	fmt.Println("Server stopped")
-}
-
-func exchangeHanlder(w http.ResponseWriter, r *http.Request) {
-	var req AuthCodeRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeError(w, "invalid request body", http.StatusBadRequest)
-		return
+	srv := newHTTPServer(cfg.ListenAddr, public)
+	// HTTP/2 is negotiated over TLS through ALPN, including with the
+	// autocert TLSConfig, since ServeTLS adds h2 to its NextProtos. Plain
+	// HTTP/2 (h2c, prior knowledge only) is opt-in, for testing.
+	srv.Protocols = new(http.Protocols)
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(true)
+	if cfg.H2CEnabled && !cfg.TLSEnabled() {
+		srv.Protocols.SetUnencryptedHTTP2(true)
 	}
 
-	data := url.Values {
-		"code": {req.Code},
-		"grant_type": {"authorization_code"},
-		"client_id": {cfg.ClientID},
-		"client_secret": {cfg.ClientSecret},
-		"redirect_uri": {cfg.RedirectURI},
+	// With TLS a plain HTTP listener redirects to HTTPS; in autocert mode it
+	// also answers the ACME challenge.
+	var redirect http.Handler = http.HandlerFunc(app.redirectToHTTPS)
+	if cfg.TLSMode() == tlsModeAutocert {
+		certs := newCertManager(cfg)
+		srv.TLSConfig = certs.TLSConfig()
+		redirect = certs.HTTPHandler(redirect)
+	}
+	var redirectSrv *http.Server
+	if cfg.TLSEnabled() && cfg.HTTPRedirectAddr != "" {
+		redirectSrv = newHTTPServer(cfg.HTTPRedirectAddr, redirect)
+		go func() {
+			slog.Info("http redirect server running", "addr", cfg.HTTPRedirectAddr)
+			if err := redirectSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("http redirect server failed", "error", err)
+				os.Exit(1)
+			}
+		}()
 	}
 
-	callDropbox(w, data)
-}
+	go func() {
+		slog.Info("server running", "addr", cfg.ListenAddr, "tls", cfg.TLSMode())
+
+		var err error
+		switch cfg.TLSMode() {
+		case tlsModeFiles:
+			err = srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+		case tlsModeAutocert:
+			err = srv.ListenAndServeTLS("", "")
+		default:
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			slog.Error("server failed", "error", err)
+			os.Exit(1)
+		}
+	}()
 
-func refreshHandler(w http.ResponseWriter, r *http.Request) {
-	var req RefreshRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeError(w, "invalid request body", http.StatusBadRequest)
-		return
+	// The admin listener is meant for a private network, so it stays plain
+	// HTTP even when the public one uses TLS.
+	var adminSrv *http.Server
+	if admin != nil {
+		adminSrv = newHTTPServer(cfg.AdminAddr, admin)
+		go func() {
+			slog.Info("admin server running", "addr", cfg.AdminAddr)
+			if err := adminSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("admin server failed", "error", err)
+				os.Exit(1)
+			}
+		}()
 	}
 
-	data := url.Values{
-		"refresh_token": {req.RefreshToken},
-		"grant_type": {"refresh_token"},
-		"client_id": {cfg.ClientID},
-		"client_secret" : {cfg.ClientSecret},
+	if cfg.SelfTest {
+		app.background.Go(func() {
+			if err := app.selfTest(background); err != nil {
+				slog.Error("startup self-test failed", "error", err)
+				if cfg.SelfTestFailFast {
+					os.Exit(1)
+				}
+				return
+			}
+			slog.Info("startup self-test passed")
+		})
 	}
 
-	callDropbox(w, data)
-}
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
 
+	// Shutdown runs in a fixed order: fail readiness, give load balancers
+	// PRE_SHUTDOWN_DELAY to notice while still serving, close the listeners
+	// within SHUTDOWN_TIMEOUT, then stop the background tasks.
+	slog.Info("shutting down: marking instance not ready")
+	app.draining.Store(true)
+	if cfg.PreShutdownDelay > 0 {
+		slog.Info("shutting down: waiting for load balancers", "delay", cfg.PreShutdownDelay.String())
+		select {
+		case <-time.After(cfg.PreShutdownDelay):
+		case <-quit:
+			slog.Warn("shutting down: second signal, skipping the remaining delay")
+		}
+	}
 
-func writeError(w http.ResponseWriter, message string, status int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(map[string]string{
-		"error": message,
-	})
-}
+	slog.Info("shutting down: closing listeners", "timeout", cfg.ShutdownTimeout.String())
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
 
-func callDropbox(w http.ResponseWriter, data url.Values) {
-	resp, err := client.PostForm("https://api.dropboxapi.com/oauth2/token", data)
-	if err != nil {
-		writeError(w, "failed to contact dropbox", http.StatusBadGateway)
-		return
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("shutdown failed", "error", err)
+		os.Exit(1)
+	}
+	if redirectSrv != nil {
+		if err := redirectSrv.Shutdown(ctx); err != nil {
+			slog.Error("http redirect shutdown failed", "error", err)
+			os.Exit(1)
+		}
+	}
+	// The admin listener goes last so probes and metrics cover the whole
+	// public shutdown.
+	if adminSrv != nil {
+		if err := adminSrv.Shutdown(ctx); err != nil {
+			slog.Error("admin shutdown failed", "error", err)
+			os.Exit(1)
+		}
 	}
 
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
+	slog.Info("shutting down: stopping background tasks")
+	stopBackground()
+	if err := app.wait(ctx); err != nil {
+		slog.Error("background tasks did not stop in time", "error", err)
+		os.Exit(1)
+	}
 
-	w.Header().Set("Content-Type", "application_json")
-	w.WriteHeader(resp.StatusCode)
-	w.Write(body)
+	slog.Info("server stopped")
 }
 
-func withCORS(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:4200")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+// newHTTPServer builds a listener's server with cfg's timeouts, logging the
+// server's own errors through logHandler.
+func newHTTPServer(cfg Config, addr string, handler http.Handler, logHandler slog.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		ErrorLog:          slog.NewLogLogger(logHandler, slog.LevelError),
+	}
+}
 
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
-			return 
+// reportConfigErrors explains why the configuration was rejected, with the
+// unset required variables first since a first run usually lacks several.
+func reportConfigErrors(w io.Writer, envFile string, errs []error) {
+	var missing []string
+	var invalid []error
+	for _, err := range errs {
+		if name, ok := err.(missingVarError); ok {
+			missing = append(missing, string(name))
+		} else {
+			invalid = append(invalid, err)
 		}
+	}
 
-		next.ServeHTTP(w, r)
-	})
-}
\ No newline at end of file
+	if len(missing) > 0 {
+		fmt.Fprintln(w, "Missing required configuration:")
+		for _, name := range missing {
+			fmt.Fprintf(w, "  - %s\n", name)
+		}
+		fmt.Fprintf(w, "Set them in the environment or in %s; run with -h for the flags.\n", envFile)
+	}
+	if len(invalid) > 0 {
+		fmt.Fprintln(w, "Invalid configuration:")
+		for _, err := range invalid {
+			fmt.Fprintf(w, "  - %v\n", err)
+		}
+	}
+}
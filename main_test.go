@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// runMainEnv makes the test binary run main instead of the tests, so a test
+// can signal a real server process.
+const runMainEnv = "TODOSRV_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		os.Args = os.Args[:1]
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// mainCommand prepares the test binary to run main with the required
+// variables plus env, each a NAME=value pair.
+func mainCommand(t *testing.T, env ...string) *exec.Cmd {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("starts a server process")
+	}
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(),
+		runMainEnv+"=1",
+		"ENV_FILE="+t.TempDir()+"/.env",
+		"DROPBOX_CLIENT_ID=client-id",
+		"DROPBOX_CLIENT_SECRET=client-secret",
+		"DROPBOX_REDIRECT_URI=https://app.example/callback",
+	)
+	cmd.Env = append(cmd.Env, env...)
+	return cmd
+}
+
+// startMain starts cmd, killing it at the end of the test, and returns a
+// channel that receives its exit status.
+func startMain(t *testing.T, cmd *exec.Cmd) <-chan error {
+	t.Helper()
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	t.Cleanup(func() { cmd.Process.Kill() })
+	return exited
+}
+
+// waitHealthy polls base's /healthz until the server answers.
+func waitHealthy(t *testing.T, client *http.Client, base string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if resp, err := client.Get(base + "/healthz"); err == nil {
+			resp.Body.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server did not start")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestShutdownOnSIGTERM starts the real binary, sends SIGTERM while a slow
+// Dropbox call is in flight, and expects that call to finish and the process
+// to exit cleanly within SHUTDOWN_TIMEOUT.
+func TestShutdownOnSIGTERM(t *testing.T) {
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		tokenHandler(w, r)
+	})
+
+	addr := freeAddr(t)
+	cmd := mainCommand(t,
+		"LISTEN_ADDR="+addr,
+		"DROPBOX_API_URL="+stub.URL,
+		"SHUTDOWN_TIMEOUT=3s",
+		"LOG_LEVEL=error",
+	)
+	exited := startMain(t, cmd)
+	base := "http://" + addr
+	waitHealthy(t, http.DefaultClient, base)
+
+	refreshed := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(base+"/api/dropbox/refresh", contentTypeJSON, strings.NewReader(`{"refresh_token":"r"}`))
+		if err != nil {
+			refreshed <- 0
+			return
+		}
+		resp.Body.Close()
+		refreshed <- resp.StatusCode
+	}()
+	for stub.calls.Load() == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	start := time.Now()
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("exit: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server still running 5s after SIGTERM")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("shutdown took %v, longer than SHUTDOWN_TIMEOUT", elapsed)
+	}
+	if status := <-refreshed; status != http.StatusOK {
+		t.Errorf("in-flight refresh: status %d, want 200", status)
+	}
+}
+
+// TestShutdownSequence expects SIGTERM to fail readiness first, keep serving
+// through PRE_SHUTDOWN_DELAY, then close the listeners and stop, logging each
+// step in that order.
+func TestShutdownSequence(t *testing.T) {
+	const delay = 400 * time.Millisecond
+	stub := newStubDropbox(t, tokenHandler)
+	addr, adminAddr := freeAddr(t), freeAddr(t)
+	cmd := mainCommand(t,
+		"LISTEN_ADDR="+addr,
+		"ADMIN_ADDR="+adminAddr,
+		"DROPBOX_API_URL="+stub.URL,
+		"PRE_SHUTDOWN_DELAY="+delay.String(),
+	)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	exited := startMain(t, cmd)
+	base, adminBase := "http://"+addr, "http://"+adminAddr
+	waitHealthy(t, http.DefaultClient, adminBase)
+
+	status := func(url string) int {
+		resp, err := http.Get(url)
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := status(adminBase + "/readyz"); got != http.StatusOK {
+		t.Fatalf("readyz before SIGTERM: %d", got)
+	}
+
+	signaled := time.Now()
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(delay / 2); status(adminBase+"/readyz") != http.StatusServiceUnavailable; {
+		if time.Now().After(deadline) {
+			t.Fatal("readyz still passing after SIGTERM")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := status(base + "/api/pkce"); got != http.StatusOK {
+		t.Errorf("public listener during the delay: %d, want 200", got)
+	}
+
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("exit: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server still running 5s after SIGTERM")
+	}
+	if elapsed := time.Since(signaled); elapsed < delay {
+		t.Errorf("exited %v after SIGTERM, before PRE_SHUTDOWN_DELAY", elapsed)
+	}
+
+	var steps []string
+	var delayStart, listenersClosed time.Time
+	for line := range strings.Lines(stdout.String()) {
+		var entry struct {
+			Time time.Time `json:"time"`
+			Msg  string    `json:"msg"`
+		}
+		if json.Unmarshal([]byte(line), &entry) != nil {
+			continue
+		}
+		switch entry.Msg {
+		case "shutting down: waiting for load balancers":
+			delayStart = entry.Time
+		case "shutting down: closing listeners":
+			listenersClosed = entry.Time
+		}
+		if strings.HasPrefix(entry.Msg, "shutting down") || entry.Msg == "server stopped" {
+			steps = append(steps, entry.Msg)
+		}
+	}
+	want := []string{
+		"shutting down: marking instance not ready",
+		"shutting down: waiting for load balancers",
+		"shutting down: closing listeners",
+		"shutting down: stopping background tasks",
+		"server stopped",
+	}
+	if !slices.Equal(steps, want) {
+		t.Errorf("shutdown steps:\n%s\nwant:\n%s", strings.Join(steps, "\n"), strings.Join(want, "\n"))
+	}
+	if gap := listenersClosed.Sub(delayStart); gap < delay {
+		t.Errorf("listeners closed %v into the delay, want at least %v", gap, delay)
+	}
+}
+
+func TestWaitForBackgroundTasks(t *testing.T) {
+	s := &server{}
+	ctx, stop := context.WithCancel(context.Background())
+	s.background.Go(func() { <-ctx.Done() })
+	stop()
+	if err := s.wait(context.Background()); err != nil {
+		t.Errorf("wait after stop: %v", err)
+	}
+
+	stuck := make(chan struct{})
+	defer close(stuck)
+	s.background.Go(func() { <-stuck })
+	timeout, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.wait(timeout); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait on a stuck task = %v, want deadline exceeded", err)
+	}
+}
+
+func TestHTTPServerTimeouts(t *testing.T) {
+	srv := newHTTPServer(testConfig(t, "http://dropbox.invalid"), ":0", http.NotFoundHandler(), slog.DiscardHandler)
+	for name, got := range map[string]time.Duration{
+		"ReadHeaderTimeout": srv.ReadHeaderTimeout,
+		"ReadTimeout":       srv.ReadTimeout,
+		"WriteTimeout":      srv.WriteTimeout,
+		"IdleTimeout":       srv.IdleTimeout,
+	} {
+		if got <= 0 {
+			t.Errorf("%s = %v, want a limit", name, got)
+		}
+	}
+
+	cfg := testConfig(t, "http://dropbox.invalid", "READ_HEADER_TIMEOUT", "2s", "IDLE_TIMEOUT", "1m")
+	srv = newHTTPServer(cfg, ":0", http.NotFoundHandler(), slog.DiscardHandler)
+	if srv.ReadHeaderTimeout != 2*time.Second || srv.IdleTimeout != time.Minute {
+		t.Errorf("ReadHeaderTimeout %v, IdleTimeout %v from the environment", srv.ReadHeaderTimeout, srv.IdleTimeout)
+	}
+}
+
+// TestHTTP2OverTLS expects the public listener to negotiate HTTP/2 through
+// ALPN when serving TLS, while HTTP/1.1 clients keep working.
+func TestHTTP2OverTLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	addr := freeAddr(t)
+	startMain(t, mainCommand(t, "LISTEN_ADDR="+addr, "TLS_CERT_FILE="+certFile, "TLS_KEY_FILE="+keyFile, "LOG_LEVEL=error"))
+
+	pemCert, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pemCert)
+	client := func(h2 bool) *http.Client {
+		tr := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, ForceAttemptHTTP2: h2}
+		t.Cleanup(tr.CloseIdleConnections)
+		return &http.Client{Transport: tr}
+	}
+	base := "https://" + addr
+	waitHealthy(t, client(false), base)
+
+	for _, h2 := range []bool{true, false} {
+		resp, err := client(h2).Get(base + "/healthz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		want := 1
+		if h2 {
+			want = 2
+		}
+		if resp.StatusCode != http.StatusOK || resp.ProtoMajor != want {
+			t.Errorf("h2 %v: status %d over %s, want 200 over HTTP/%d", h2, resp.StatusCode, resp.Proto, want)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	total  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(defaultBuckets))
+	}
+	for i, le := range defaultBuckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.total++
+}
+
+type requestKey struct {
+	endpoint string
+	code     int
+}
+
+type failureKey struct {
+	op, kind string
+}
+
+// Upstream failure kinds, the fixed label set of todosrv_dropbox_failures_total.
+const (
+	failureConnection      = "connection"
+	failureTimeout         = "timeout"
+	failureClientError     = "4xx"
+	failureServerError     = "5xx"
+	failureInvalidResponse = "invalid_response"
+)
+
+// classifyUpstream names the kind of failure behind a Dropbox call's outcome,
+// or returns "" if it succeeded.
+func classifyUpstream(resp *http.Response, err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return failureTimeout
+	case err != nil:
+		return failureConnection
+	case resp.StatusCode >= 500:
+		return failureServerError
+	case resp.StatusCode >= 400:
+		return failureClientError
+	}
+	return ""
+}
+
+// metrics is a small Prometheus text-format registry. Labels are limited to
+// route patterns, status codes and upstream operation names so cardinality
+// stays fixed. A nil *metrics records nothing.
+type metrics struct {
+	mu sync.Mutex
+
+	requests         map[requestKey]uint64
+	requestDurations map[string]*histogram
+
+	upstreamDurations map[string]*histogram
+	upstreamErrors    map[string]uint64
+	upstreamFailures  map[failureKey]uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:          make(map[requestKey]uint64),
+		requestDurations:  make(map[string]*histogram),
+		upstreamDurations: make(map[string]*histogram),
+		upstreamErrors:    make(map[string]uint64),
+		upstreamFailures:  make(map[failureKey]uint64),
+	}
+}
+
+func (m *metrics) observeRequest(endpoint string, code int, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestKey{endpoint, code}]++
+	observe(m.requestDurations, endpoint, d)
+}
+
+func (m *metrics) observeUpstream(op string, d time.Duration, failed bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	observe(m.upstreamDurations, op, d)
+	if failed {
+		m.upstreamErrors[op]++
+	}
+}
+
+// observeUpstreamFailure counts a failed Dropbox call by kind; an empty kind
+// is a success and isn't counted.
+func (m *metrics) observeUpstreamFailure(op, kind string) {
+	if m == nil || kind == "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.upstreamFailures[failureKey{op, kind}]++
+}
+
+func observe(hs map[string]*histogram, key string, d time.Duration) {
+	h, ok := hs[key]
+	if !ok {
+		h = &histogram{}
+		hs[key] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// withMetrics records every request under the pattern of the route that
+// served it. The mux stores the matched pattern on the request it was given,
+// which is the same one seen here, so it can be read after ServeHTTP returns.
+func (m *metrics) withMetrics(next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		endpoint := r.Pattern
+		if endpoint == "" || endpoint == "/" {
+			endpoint = "other"
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		m.observeRequest(endpoint, rec.status, time.Since(start))
+	})
+}
+
+func (m *metrics) handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.writeTo(w)
+}
+
+func (m *metrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP todosrv_http_requests_total HTTP requests by endpoint and status code.")
+	fmt.Fprintln(w, "# TYPE todosrv_http_requests_total counter")
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].endpoint != keys[j].endpoint {
+			return keys[i].endpoint < keys[j].endpoint
+		}
+		return keys[i].code < keys[j].code
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "todosrv_http_requests_total{endpoint=%q,code=\"%d\"} %d\n", k.endpoint, k.code, m.requests[k])
+	}
+
+	writeHistograms(w, "todosrv_http_request_duration_seconds", "HTTP request latency by endpoint.", "endpoint", m.requestDurations)
+	writeHistograms(w, "todosrv_dropbox_request_duration_seconds", "Dropbox upstream call latency by operation.", "operation", m.upstreamDurations)
+
+	fmt.Fprintln(w, "# HELP todosrv_dropbox_errors_total Dropbox calls that failed in transport or returned 5xx.")
+	fmt.Fprintln(w, "# TYPE todosrv_dropbox_errors_total counter")
+	for _, op := range sortedKeys(m.upstreamErrors) {
+		fmt.Fprintf(w, "todosrv_dropbox_errors_total{operation=%q} %d\n", op, m.upstreamErrors[op])
+	}
+
+	fmt.Fprintln(w, "# HELP todosrv_dropbox_failures_total Failed Dropbox calls by operation and kind: connection, timeout, 4xx, 5xx or invalid_response.")
+	fmt.Fprintln(w, "# TYPE todosrv_dropbox_failures_total counter")
+	failures := make([]failureKey, 0, len(m.upstreamFailures))
+	for k := range m.upstreamFailures {
+		failures = append(failures, k)
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		if failures[i].op != failures[j].op {
+			return failures[i].op < failures[j].op
+		}
+		return failures[i].kind < failures[j].kind
+	})
+	for _, k := range failures {
+		fmt.Fprintf(w, "todosrv_dropbox_failures_total{operation=%q,type=%q} %d\n", k.op, k.kind, m.upstreamFailures[k])
+	}
+}
+
+func writeHistograms(w io.Writer, name, help, label string, hs map[string]*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for _, key := range sortedKeys(hs) {
+		h := hs[key]
+		for i, le := range defaultBuckets {
+			bound := strconv.FormatFloat(le, 'g', -1, 64)
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=%q} %d\n", name, label, key, bound, h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", name, label, key, h.total)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %s\n", name, label, key, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", name, label, key, h.total)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"maps"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpstreamFailureKinds(t *testing.T) {
+	respond := func(status int, body string) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			io.WriteString(w, body)
+		}
+	}
+	for _, tc := range []struct {
+		kind    string
+		handler func(http.ResponseWriter, *http.Request)
+	}{
+		{"", tokenHandler},
+		{failureClientError, respond(http.StatusBadRequest, `{"error":"invalid_grant"}`)},
+		{failureServerError, respond(http.StatusServiceUnavailable, `{"error":"temporarily_unavailable"}`)},
+		{failureInvalidResponse, respond(http.StatusOK, `not json`)},
+		{failureTimeout, func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(200 * time.Millisecond):
+			case <-r.Context().Done():
+			}
+		}},
+		{failureConnection, nil},
+	} {
+		api := "http://" + freeAddr(t)
+		if tc.handler != nil {
+			api = newStubDropbox(t, tc.handler).URL
+		}
+		cfg := testConfig(t, api, "METRICS_ENABLED", "true", "DROPBOX_MAX_ATTEMPTS", "1", "DROPBOX_TIMEOUT", "50ms")
+		s := newServer(cfg, newHTTPClient(cfg), nil, nil, nil)
+		public, _ := s.routes()
+
+		do(public, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"r"}`)
+
+		want := map[failureKey]uint64{}
+		if tc.kind != "" {
+			want[failureKey{"token", tc.kind}] = 1
+		}
+		s.metrics.mu.Lock()
+		got := maps.Clone(s.metrics.upstreamFailures)
+		s.metrics.mu.Unlock()
+		if !maps.Equal(got, want) {
+			t.Errorf("%q outcome: failures = %v, want %v", tc.kind, got, want)
+		}
+
+		if tc.kind == "" {
+			continue
+		}
+		w := do(public, "GET", "/metrics", "", "")
+		if line := `todosrv_dropbox_failures_total{operation="token",type="` + tc.kind + `"} 1`; !strings.Contains(w.Body.String(), line) {
+			t.Errorf("%q outcome: /metrics lacks %s", tc.kind, line)
+		}
+	}
+}
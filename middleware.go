@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	configKey
+	spanKey
+	auditKey
+)
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// logger returns the default logger annotated with the request ID carried by
+// ctx, if any.
+func logger(ctx context.Context) *slog.Logger {
+	if id := requestIDFrom(ctx); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+// withRequestID reuses a well-formed incoming X-Request-ID or generates one,
+// stores it in the request context and echoes it on the response.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// withConfig pins the configuration current when the request arrived, so a
+// reload can't hand one request a mix of old and new settings.
+func (s *server) withConfig(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), configKey, s.cfg.Load())
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// statusRecorder captures the status code and body size written by the
+// wrapped handler. It passes Flush and Hijack through to the writer beneath.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(r.ResponseWriter).Hijack()
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// withLogging emits one access log line per request. Only the path is
+// logged, never the query string or body, so codes and tokens stay out of the
+// logs. bytes counts the body as sent, after any compression.
+func (s *server) withLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		logger(r.Context()).Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"remote_ip", clientIP(r, s.config(r.Context()).TrustProxy),
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	})
+}
+
+// withSecurityHeaders sets baseline hardening headers on every response.
+// Strict-Transport-Security is only sent over TLS (or when a trusted proxy
+// says the client connection was TLS) so local plain-HTTP dev isn't pinned.
+func (s *server) withSecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "no-referrer")
+
+		if cfg := s.config(r.Context()); isHTTPS(r, cfg.TrustProxy) {
+			h.Set("Strict-Transport-Security", cfg.hstsHeader())
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withRecovery turns a handler panic into a logged 500. It must sit inside
+// withLogging so the recorded status reflects the error response.
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			logger(r.Context()).Error("handler panicked",
+				"panic", fmt.Sprint(rec),
+				"stack", string(debug.Stack()),
+			)
+
+			// A response already under way can't be replaced by a clean
+			// error, so drop the connection instead.
+			if sr, ok := w.(*statusRecorder); ok && sr.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			writeError(w, r, errCodeInternal, "internal server error", http.StatusInternalServerError)
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withJSONErrors replaces the mux's plain-text 404 and 405 responses with the
+// JSON error envelope. A catch-all "/" route can't be used for this because
+// it would also match wrong-method requests and turn every 405 into a 404.
+func withJSONErrors(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, pattern := mux.Handler(r)
+		if pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		// Let the mux decide between 404 and 405 (and set Allow), but keep
+		// its body.
+		rec := &discardRecorder{header: w.Header()}
+		h.ServeHTTP(rec, r)
+
+		status := cmp.Or(rec.status, http.StatusNotFound)
+		code := errCodeNotFound
+		if status == http.StatusMethodNotAllowed {
+			code = errCodeMethodNotAllowed
+		}
+		writeError(w, r, code, strings.ToLower(http.StatusText(status)), status)
+	})
+}
+
+// discardRecorder records the status and headers a handler writes and drops
+// the body.
+type discardRecorder struct {
+	header http.Header
+	status int
+}
+
+func (d *discardRecorder) Header() http.Header { return d.header }
+
+func (d *discardRecorder) Write(b []byte) (int, error) { return len(b), nil }
+
+func (d *discardRecorder) WriteHeader(status int) {
+	if d.status == 0 {
+		d.status = status
+	}
+}
+
+// requireAPIKey enforces PROXY_API_KEY when it is configured. Both sides are
+// hashed first so the comparison takes the same time whatever the length of
+// the presented key.
+func (s *server) requireAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := s.config(r.Context()).APIKey
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		want := sha256.Sum256([]byte(key))
+		got := sha256.Sum256([]byte(r.Header.Get("X-API-Key")))
+		if subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+			writeError(w, r, errCodeUnauthorized, "invalid or missing API key", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withCORS applies the CORS policy to next, which serves the routes on mux.
+// The advertised methods are the ones mux has registered for the requested
+// path, unless CORS_ALLOWED_METHODS lists them.
+func (s *server) withCORS(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.config(r.Context())
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); s.originAllowed(r.Context(), origin) {
+			// Only ever an echoed, allowlisted origin, so credentials are
+			// never paired with "*".
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if cfg.CORSAllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods(cfg, mux, r))
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders(cfg, r.Header.Values("Access-Control-Request-Headers")))
+		w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders(cfg))
+
+		if r.Method == http.MethodOptions {
+			if cfg.CORSMaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.CORSMaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corsAlwaysAllowedHeaders are the headers this proxy reads itself, allowed
+// whatever the request or configuration.
+var corsAlwaysAllowedHeaders = []string{"Content-Type", "Authorization", "X-Request-Id", "X-Api-Key", "Idempotency-Key", "Dropbox-Api-Select-User", "Dropbox-Api-Select-Admin"}
+
+// corsCandidateMethods are the methods probed against the routes. HEAD is
+// left out since every GET route answers it implicitly.
+var corsCandidateMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+func corsAllowMethods(cfg *Config, mux *http.ServeMux, r *http.Request) string {
+	if cfg.CORSAllowedMethods != nil {
+		return strings.Join(cfg.CORSAllowedMethods, ", ")
+	}
+
+	var methods []string
+	probe := r.Clone(r.Context())
+	for _, method := range corsCandidateMethods {
+		probe.Method = method
+		if _, pattern := mux.Handler(probe); pattern != "" {
+			methods = append(methods, method)
+		}
+	}
+	return strings.Join(append(methods, http.MethodOptions), ", ")
+}
+
+// corsExposedHeaders are this proxy's own response headers a browser client
+// may read; the forwarded Dropbox headers are added to them.
+var corsExposedHeaders = []string{"X-Request-Id", "Idempotent-Replayed", "X-Dry-Run"}
+
+func corsExposeHeaders(cfg *Config) string {
+	exposed := slices.Clone(corsExposedHeaders)
+	for _, name := range cfg.ForwardedHeaders {
+		if !slices.Contains(exposed, name) {
+			exposed = append(exposed, name)
+		}
+	}
+	return strings.Join(exposed, ", ")
+}
+
+// corsAllowHeaders answers Access-Control-Request-Headers. With no
+// CORS_ALLOWED_HEADERS configured every requested header is reflected, so new
+// custom headers work without a deploy; otherwise only those on the list are.
+func corsAllowHeaders(cfg *Config, requested []string) string {
+	allowed := slices.Clone(corsAlwaysAllowedHeaders)
+	for _, value := range requested {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if !validHeaderName(name) || slices.Contains(allowed, name) {
+				continue
+			}
+			if cfg.CORSAllowedHeaders == nil || slices.Contains(cfg.CORSAllowedHeaders, name) {
+				allowed = append(allowed, name)
+			}
+		}
+	}
+	return strings.Join(allowed, ", ")
+}
+
+func validHeaderName(name string) bool {
+	if name == "" || len(name) > 128 {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// originAllowed reports whether origin is listed in ALLOWED_ORIGINS. Only
+// exact matches count; there is no wildcard.
+func (s *server) originAllowed(ctx context.Context, origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, allowed := range s.config(ctx).AllowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCORSOrigins(t *testing.T) {
+	cfg := testConfig(t, "http://dropbox.invalid", "ALLOWED_ORIGINS", "http://localhost:4200, https://staging.example/,https://app.example")
+	_, h := newTestServer(t, cfg)
+
+	for _, tc := range []struct {
+		origin, want string
+	}{
+		{"https://staging.example", "https://staging.example"},
+		{"https://app.example", "https://app.example"},
+		{"https://evil.example", ""},
+		{"https://app.example.evil", ""},
+		{"", ""},
+	} {
+		r := httptest.NewRequest("GET", "/api/dropbox/state", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tc.want {
+			t.Errorf("Origin %q: Access-Control-Allow-Origin = %q, want %q", tc.origin, got, tc.want)
+		}
+		if !slices.Contains(w.Header().Values("Vary"), "Origin") {
+			t.Errorf("Origin %q: Vary = %q, want Origin", tc.origin, w.Header().Values("Vary"))
+		}
+	}
+}
+
+func preflight(h http.Handler, origin string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodOptions, "/api/dropbox/refresh", nil)
+	r.Header.Set("Origin", origin)
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestCORSPreflight(t *testing.T) {
+	cfg := testConfig(t, "http://dropbox.invalid",
+		"ALLOWED_ORIGINS", "https://app.example",
+		"CORS_MAX_AGE", "90s",
+		"CORS_ALLOW_CREDENTIALS", "true")
+	_, h := newTestServer(t, cfg)
+
+	w := preflight(h, "https://app.example")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204", w.Code)
+	}
+	for name, want := range map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Max-Age":           "90",
+	} {
+		if got := w.Header().Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if methods := w.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(methods, "POST") {
+		t.Errorf("Access-Control-Allow-Methods = %q, want POST listed", methods)
+	}
+
+	w = preflight(h, "https://evil.example")
+	if w.Header().Get("Access-Control-Allow-Origin") != "" || w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("unlisted origin got CORS grants: %v", w.Header())
+	}
+}
+
+func TestCORSMaxAgeDefault(t *testing.T) {
+	_, h := newTestServer(t, testConfig(t, "http://dropbox.invalid"))
+	w := preflight(h, "http://localhost:4200")
+	if got := w.Header().Get("Access-Control-Max-Age"); got != "600" {
+		t.Errorf("Access-Control-Max-Age = %q, want 600", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("Access-Control-Allow-Credentials = %q without CORS_ALLOW_CREDENTIALS", got)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	logs := captureLogs(t)
+	h := withRequestID(withRecovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]int
+		m["boom"]++
+	})))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(requestIDHeader, "req-panic-1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", w.Code)
+	}
+	if got := decodeJSON[map[string]string](t, w)["code"]; got != errCodeInternal {
+		t.Errorf("code = %q", got)
+	}
+	var entry map[string]any
+	if err := json.NewDecoder(logs).Decode(&entry); err != nil {
+		t.Fatalf("log %q: %v", logs, err)
+	}
+	if entry["level"] != "ERROR" || entry["request_id"] != "req-panic-1" || !strings.Contains(entry["stack"].(string), "TestRecovery") {
+		t.Errorf("panic log = %v", entry)
+	}
+}
+
+// Once the status is out, the only honest signal left is a dropped
+// connection.
+func TestRecoveryAfterWriteAborts(t *testing.T) {
+	captureLogs(t)
+	h := withRecovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		panic("late")
+	}))
+	defer func() {
+		if rec := recover(); rec != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", rec)
+		}
+	}()
+	h.ServeHTTP(&statusRecorder{ResponseWriter: httptest.NewRecorder()}, httptest.NewRequest("GET", "/", nil))
+}
+
+func TestAPIKey(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	_, h := newTestServer(t, testConfig(t, stub.URL, "PROXY_API_KEY", "s3cret"))
+
+	for _, tc := range []struct {
+		key  string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"s3cret ", http.StatusUnauthorized},
+		{"s3cret", http.StatusOK},
+	} {
+		r := httptest.NewRequest("POST", "/api/dropbox/refresh", strings.NewReader(`{"refresh_token":"r"}`))
+		r.Header.Set("Content-Type", contentTypeJSON)
+		if tc.key != "" {
+			r.Header.Set("X-API-Key", tc.key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("X-API-Key %q: status = %d, want %d", tc.key, w.Code, tc.want)
+		}
+		if tc.want == http.StatusUnauthorized {
+			if got := decodeJSON[map[string]string](t, w)["code"]; got != errCodeUnauthorized {
+				t.Errorf("X-API-Key %q: code = %q", tc.key, got)
+			}
+		}
+	}
+	if n := stub.calls.Load(); n != 1 {
+		t.Errorf("dropbox called %d times, want only for the right key", n)
+	}
+
+	for _, path := range []string{"/healthz", "/version"} {
+		if w := do(h, "GET", path, "", ""); w.Code != http.StatusOK {
+			t.Errorf("GET %s without a key: status = %d", path, w.Code)
+		}
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	cfg := testConfig(t, "http://dropbox.invalid", "TRUST_PROXY", "true", "HSTS_MAX_AGE", "24h", "HSTS_INCLUDE_SUBDOMAINS", "true")
+	_, h := newTestServer(t, cfg)
+
+	for _, tc := range []struct {
+		name  string
+		setup func(*http.Request)
+		hsts  string
+	}{
+		{"plain http", func(*http.Request) {}, ""},
+		{"tls", func(r *http.Request) { r.TLS = &tls.ConnectionState{} }, "max-age=86400; includeSubDomains"},
+		{"https proxy", func(r *http.Request) { r.Header.Set("X-Forwarded-Proto", "https") }, "max-age=86400; includeSubDomains"},
+	} {
+		// Errors as well as successes carry the headers.
+		for _, path := range []string{"/healthz", "/nonexistent"} {
+			r := httptest.NewRequest("GET", path, nil)
+			tc.setup(r)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			for name, want := range map[string]string{
+				"X-Content-Type-Options":    "nosniff",
+				"X-Frame-Options":           "DENY",
+				"Referrer-Policy":           "no-referrer",
+				"Strict-Transport-Security": tc.hsts,
+			} {
+				if got := w.Header().Get(name); got != want {
+					t.Errorf("%s %s: %s = %q, want %q", tc.name, path, name, got, want)
+				}
+			}
+		}
+	}
+}
+
+func preflightHeaders(h http.Handler, requested string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodOptions, "/api/dropbox/refresh", nil)
+	r.Header.Set("Origin", "http://localhost:4200")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	r.Header.Set("Access-Control-Request-Headers", requested)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestCORSReflectsRequestedHeaders(t *testing.T) {
+	_, h := newTestServer(t, testConfig(t, "http://dropbox.invalid"))
+
+	w := preflightHeaders(h, "x-custom-trace, Content-Type, bad header")
+	allowed := strings.Split(w.Header().Get("Access-Control-Allow-Headers"), ", ")
+	for _, want := range []string{"X-Custom-Trace", "Content-Type", "X-Api-Key"} {
+		if !slices.Contains(allowed, want) {
+			t.Errorf("Access-Control-Allow-Headers = %q, want %s", allowed, want)
+		}
+	}
+	if slices.ContainsFunc(allowed, func(name string) bool { return strings.Contains(name, " ") }) {
+		t.Errorf("malformed header reflected: %q", allowed)
+	}
+	if !slices.Contains(w.Header().Values("Vary"), "Access-Control-Request-Headers") {
+		t.Errorf("Vary = %q", w.Header().Values("Vary"))
+	}
+}
+
+func TestCORSAllowedHeadersList(t *testing.T) {
+	_, h := newTestServer(t, testConfig(t, "http://dropbox.invalid", "CORS_ALLOWED_HEADERS", "X-Custom-Trace"))
+
+	allowed := strings.Split(preflightHeaders(h, "X-Custom-Trace, X-Other").Header().Get("Access-Control-Allow-Headers"), ", ")
+	if !slices.Contains(allowed, "X-Custom-Trace") || slices.Contains(allowed, "X-Other") {
+		t.Errorf("Access-Control-Allow-Headers = %q, want X-Custom-Trace only", allowed)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	logs := captureLogs(t)
+	s, _ := newTestServer(t, testConfig(t, "http://dropbox.invalid"))
+	h := s.withConfig(s.withLogging(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "hello, ")
+		io.WriteString(w, "world")
+	})))
+
+	w := do(h, "PUT", "/things/1", "", "")
+	var entry struct {
+		Msg        string
+		Method     string
+		Path       string
+		Status     int
+		Bytes      int
+		RemoteIP   string `json:"remote_ip"`
+		DurationMS *int64 `json:"duration_ms"`
+	}
+	if err := json.NewDecoder(logs).Decode(&entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Msg != "request" || entry.Method != "PUT" || entry.Path != "/things/1" || entry.RemoteIP != "192.0.2.1" || entry.DurationMS == nil {
+		t.Errorf("log entry = %+v", entry)
+	}
+	if entry.Status != w.Code || entry.Bytes != w.Body.Len() {
+		t.Errorf("logged status %d, %d bytes; handler wrote %d, %d bytes", entry.Status, entry.Bytes, w.Code, w.Body.Len())
+	}
+}
+
+// A handler that never calls WriteHeader sent an implicit 200.
+func TestAccessLogImplicitStatus(t *testing.T) {
+	logs := captureLogs(t)
+	s, _ := newTestServer(t, testConfig(t, "http://dropbox.invalid"))
+	h := s.withConfig(s.withLogging(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})))
+
+	do(h, "GET", "/", "", "")
+	if !strings.Contains(logs.String(), `"status":200,"bytes":0`) {
+		t.Errorf("log = %s", logs)
+	}
+}
+
+// The advertised methods are each path's routes, the same set the mux lists
+// in Allow when a request uses another method.
+func TestCORSAllowMethodsFollowRoutes(t *testing.T) {
+	_, h := newTestServer(t, testConfig(t, "http://dropbox.invalid"))
+
+	for path, want := range map[string]string{
+		"/api/dropbox/refresh":          "POST, OPTIONS",
+		"/api/dropbox/exchange":         "POST, OPTIONS",
+		"/api/dropbox/token/introspect": "POST, OPTIONS",
+		"/api/dropbox/account":          "GET, OPTIONS",
+		"/api/pkce":                     "GET, OPTIONS",
+	} {
+		r := httptest.NewRequest(http.MethodOptions, path, nil)
+		r.Header.Set("Origin", "http://localhost:4200")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		advertised := w.Header().Get("Access-Control-Allow-Methods")
+		if advertised != want {
+			t.Errorf("%s: Access-Control-Allow-Methods = %q, want %q", path, advertised, want)
+		}
+
+		w = do(h, "TRACE", path, "", "")
+		allow := slices.DeleteFunc(strings.Split(w.Header().Get("Allow"), ", "), func(m string) bool { return m == http.MethodHead })
+		if got := strings.Join(append(allow, http.MethodOptions), ", "); w.Code != http.StatusMethodNotAllowed || got != advertised {
+			t.Errorf("%s: TRACE got %d with Allow %q, disagreeing with CORS %q", path, w.Code, w.Header().Get("Allow"), advertised)
+		}
+	}
+
+	_, h = newTestServer(t, testConfig(t, "http://dropbox.invalid", "CORS_ALLOWED_METHODS", "get,POST"))
+	if got := preflight(h, "http://localhost:4200").Header().Get("Access-Control-Allow-Methods"); got != "GET, POST" {
+		t.Errorf("CORS_ALLOWED_METHODS: Access-Control-Allow-Methods = %q, want GET, POST", got)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+)
+
+// PKCEResponse is a fresh state with an RFC 7636 verifier and its S256
+// challenge. The server keeps the verifier under the state for STATE_TTL, so
+// an exchange carrying that state needs no code_verifier of its own.
+type PKCEResponse struct {
+	State               string `json:"state"`
+	CodeVerifier        string `json:"code_verifier"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// pkceVerifierSize random bytes encode to a 43-character verifier, the
+// shortest RFC 7636 allows.
+const pkceVerifierSize = 32
+
+func (s *server) pkceHandler(w http.ResponseWriter, r *http.Request) {
+	b := make([]byte, pkceVerifierSize)
+	rand.Read(b)
+	verifier := base64.RawURLEncoding.EncodeToString(b)
+
+	res := PKCEResponse{
+		State:               s.newState(r.Context(), s.clock.Now()),
+		CodeVerifier:        verifier,
+		CodeChallenge:       pkceChallenge(verifier),
+		CodeChallengeMethod: "S256",
+	}
+	s.verifiers.set(cacheKey("pkce", res.State), verifier, s.config(r.Context()).StateTTL)
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(res)
+}
+
+// pkceChallenge is the S256 transform: base64url(SHA-256(verifier)) without
+// padding.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// storedVerifier returns the verifier pkceHandler issued with state, if it
+// hasn't expired. It is not consumed, so a replayed exchange still matches.
+func (s *server) storedVerifier(state string) (string, bool) {
+	return s.verifiers.get(cacheKey("pkce", state))
+}
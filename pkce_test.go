@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"testing"
+)
+
+// The example from RFC 7636, Appendix B.
+func TestPKCEChallenge(t *testing.T) {
+	const verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	if got, want := pkceChallenge(verifier), "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"; got != want {
+		t.Errorf("pkceChallenge = %q, want %q", got, want)
+	}
+}
+
+func TestPKCEHandler(t *testing.T) {
+	s, h := newTestServer(t, testConfig(t, "http://dropbox.invalid"))
+
+	w := do(h, "GET", "/api/pkce", "", "")
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("status %d, Cache-Control %q", w.Code, w.Header().Get("Cache-Control"))
+	}
+	res := decodeJSON[PKCEResponse](t, w)
+	if len(res.CodeVerifier) != 43 || res.CodeChallengeMethod != "S256" {
+		t.Errorf("verifier %q (%d chars), method %q", res.CodeVerifier, len(res.CodeVerifier), res.CodeChallengeMethod)
+	}
+	sum := sha256.Sum256([]byte(res.CodeVerifier))
+	if want := base64.RawURLEncoding.EncodeToString(sum[:]); res.CodeChallenge != want {
+		t.Errorf("challenge %q, want %q for the verifier", res.CodeChallenge, want)
+	}
+	if stored, ok := s.storedVerifier(res.State); !ok || stored != res.CodeVerifier {
+		t.Errorf("stored verifier for state = %q, %v", stored, ok)
+	}
+
+	if again := decodeJSON[PKCEResponse](t, do(h, "GET", "/api/pkce", "", "")); again.CodeVerifier == res.CodeVerifier {
+		t.Error("verifier repeated across requests")
+	}
+}
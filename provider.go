@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const defaultProvider = "dropbox"
+
+// Provider describes an OAuth 2.0 authorization server whose token endpoint
+// accepts the standard authorization_code and refresh_token grants.
+type Provider struct {
+	Name         string
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	RedirectURI  string
+
+	// RedirectURIs are the alternatives a client may ask for instead of
+	// RedirectURI.
+	RedirectURIs []string
+
+	// RateLimitRPS and RateLimitBurst bound requests made with this
+	// provider's client ID, across all callers. A zero rate disables it.
+	RateLimitRPS   float64
+	RateLimitBurst int
+}
+
+var providerName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// loadProviders builds the provider table. Dropbox is always present and
+// configured from the DROPBOX_* variables; PROVIDERS lists any additional
+// names, each read from <NAME>_TOKEN_URL, <NAME>_CLIENT_ID,
+// <NAME>_CLIENT_SECRET (or <NAME>_CLIENT_SECRET_FILE) and
+// <NAME>_REDIRECT_URI. Every provider's client rate limit defaults to
+// CLIENT_RATE_LIMIT_RPS and CLIENT_RATE_LIMIT_BURST and can be overridden
+// with <NAME>_RATE_LIMIT_RPS and <NAME>_RATE_LIMIT_BURST.
+func loadProviders(cfg Config) (map[string]Provider, []error) {
+	providers := map[string]Provider{
+		defaultProvider: {
+			Name:         defaultProvider,
+			TokenURL:     cfg.DropboxAPIURL + "/oauth2/token",
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURI:  cfg.RedirectURI,
+			RedirectURIs: cfg.RedirectURIs,
+		},
+	}
+
+	var errs []error
+	dropbox := providers[defaultProvider]
+	errs = append(errs, loadClientRateLimit(cfg, &dropbox)...)
+	providers[defaultProvider] = dropbox
+
+	for _, name := range strings.Split(getenv("PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || name == defaultProvider {
+			continue
+		}
+		if !providerName.MatchString(name) {
+			errs = append(errs, fmt.Errorf("PROVIDERS: invalid provider name %q", name))
+			continue
+		}
+
+		prefix := strings.ToUpper(name) + "_"
+		p := Provider{
+			Name:        name,
+			ClientID:    getenv(prefix + "CLIENT_ID"),
+			RedirectURI: getenv(prefix + "REDIRECT_URI"),
+		}
+
+		var err error
+		p.ClientSecret, err = getenvSecret(prefix + "CLIENT_SECRET")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%sCLIENT_SECRET_FILE: %w", prefix, err))
+		}
+
+		tokenURL, err := parseBaseURL(getenv(prefix + "TOKEN_URL"))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%sTOKEN_URL: %w", prefix, err))
+		}
+		p.TokenURL = tokenURL
+
+		p.RedirectURIs, err = parseRedirectURIs(getenv(prefix + "ALLOWED_REDIRECT_URIS"))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%sALLOWED_REDIRECT_URIS: %w", prefix, err))
+		}
+
+		errs = append(errs, loadClientRateLimit(cfg, &p)...)
+
+		if p.ClientID == "" {
+			errs = append(errs, missingVarError(prefix+"CLIENT_ID"))
+		}
+		if p.RedirectURI == "" {
+			errs = append(errs, missingVarError(prefix+"REDIRECT_URI"))
+		}
+
+		providers[name] = p
+	}
+
+	return providers, errs
+}
+
+// loadClientRateLimit reads p's client rate limit overrides. The defaults are
+// checked by Validate, so only explicit overrides are checked here.
+func loadClientRateLimit(cfg Config, p *Provider) []error {
+	prefix := strings.ToUpper(p.Name) + "_"
+
+	var errs []error
+	var err error
+	p.RateLimitRPS, err = envFloat(prefix+"RATE_LIMIT_RPS", cfg.ClientRateLimitRPS)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("%sRATE_LIMIT_RPS: %w", prefix, err))
+	} else if p.RateLimitRPS < 0 && getenv(prefix+"RATE_LIMIT_RPS") != "" {
+		errs = append(errs, errors.New(prefix+"RATE_LIMIT_RPS: must not be negative"))
+	}
+	p.RateLimitBurst, err = envInt(prefix+"RATE_LIMIT_BURST", cfg.ClientRateLimitBurst)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("%sRATE_LIMIT_BURST: %w", prefix, err))
+	} else if p.RateLimitBurst < 1 && getenv(prefix+"RATE_LIMIT_BURST") != "" {
+		errs = append(errs, errors.New(prefix+"RATE_LIMIT_BURST: must be at least 1"))
+	}
+	return errs
+}
+
+// redirectURI picks the redirect_uri to send upstream. An empty request gets
+// the default; anything else must match an allowlisted URI exactly, since
+// Dropbox compares them byte for byte too.
+func (p Provider) redirectURI(requested string) (string, bool) {
+	if requested == "" || requested == p.RedirectURI {
+		return p.RedirectURI, true
+	}
+	if slices.Contains(p.RedirectURIs, requested) {
+		return requested, true
+	}
+	return "", false
+}
+
+// provider resolves the {provider} path segment, answering 404 itself when
+// the name isn't configured.
+func (s *server) provider(w http.ResponseWriter, r *http.Request) (Provider, bool) {
+	p, ok := s.config(r.Context()).Providers[r.PathValue("provider")]
+	if !ok {
+		writeError(w, r, errCodeUnknownProvider, "unknown provider", http.StatusNotFound)
+	}
+	return p, ok
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bucketStore holds token-bucket state for rateLimiter: memoryBuckets in
+// process, redisBuckets shared between replicas.
+type bucketStore interface {
+	// take consumes a token from key's bucket, which refills at rate per
+	// second up to burst. When the bucket is empty it reports how long the
+	// caller should wait before the next token is available.
+	take(key string, rate float64, burst int, now time.Time) (bool, time.Duration, error)
+}
+
+// rateLimiter is a per-client token bucket. A zero rate disables limiting.
+type rateLimiter struct {
+	rate       float64
+	burst      int
+	trustProxy bool
+	store      bucketStore
+	clock      Clock
+}
+
+func newRateLimiter(store bucketStore, clock Clock, rate float64, burst int, trustProxy bool) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: burst, trustProxy: trustProxy, store: store, clock: clock}
+}
+
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	return l.allowAt(key, l.rate, l.burst)
+}
+
+// allowAt fails open: if the store can't be reached the request goes
+// through, since refusing all traffic would be worse than briefly not
+// limiting it.
+func (l *rateLimiter) allowAt(key string, rate float64, burst int) (bool, time.Duration) {
+	if rate <= 0 {
+		return true, 0
+	}
+
+	ok, wait, err := l.store.take(key, rate, burst, l.clock.Now())
+	if err != nil {
+		return true, 0
+	}
+	return ok, wait
+}
+
+type bucket struct {
+	tokens   float64
+	lastSeen time.Time
+	// full is how long the bucket takes to refill from empty.
+	full time.Duration
+}
+
+type memoryBuckets struct {
+	mu      sync.Mutex
+	clock   Clock
+	buckets map[string]*bucket
+}
+
+func newMemoryBuckets(clock Clock) *memoryBuckets {
+	return &memoryBuckets{clock: clock, buckets: make(map[string]*bucket)}
+}
+
+func (m *memoryBuckets) take(key string, rate float64, burst int, now time.Time) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	capacity := float64(burst)
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, lastSeen: now}
+		m.buckets[key] = b
+	}
+
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.lastSeen).Seconds()*rate)
+	b.lastSeen = now
+	b.full = time.Duration(capacity / rate * float64(time.Second))
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+
+	wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	return false, wait, nil
+}
+
+// cleanup periodically drops buckets that have refilled completely, since
+// those are indistinguishable from a fresh bucket. It returns when ctx is done.
+func (m *memoryBuckets) cleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.evict(m.clock.Now())
+		}
+	}
+}
+
+func (m *memoryBuckets) evict(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, b := range m.buckets {
+		if now.Sub(b.lastSeen) > b.full {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+func (l *rateLimiter) limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := l.allow(clientIP(r, l.trustProxy)); !ok {
+			writeRateLimited(w, r, wait, "rate limit exceeded")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitClient applies each provider's own budget, shared by every caller
+// using its client ID, so one app behind the proxy can't exhaust another's.
+// It runs after the per-IP limit, which still applies. Routes without a
+// {provider} segment count against Dropbox.
+func (s *server) limitClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("provider")
+		if name == "" {
+			name = defaultProvider
+		}
+
+		// Unknown providers fall through to the handler's 404.
+		if p, found := s.config(r.Context()).Providers[name]; found {
+			if ok, wait := s.allowClient(p); !ok {
+				logger(r.Context()).Warn("client rate limit exceeded", "provider", p.Name)
+				writeRateLimited(w, r, wait, "rate limit exceeded for "+p.Name)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) allowClient(p Provider) (bool, time.Duration) {
+	return s.limiter.allowAt("client:"+p.Name+":"+p.ClientID, p.RateLimitRPS, p.RateLimitBurst)
+}
+
+// allowExtra charges one more unit of work within a request that limit and
+// limitClient have already charged once, against both the same buckets.
+func (s *server) allowExtra(r *http.Request, p Provider) (bool, time.Duration) {
+	if ok, wait := s.limiter.allow(clientIP(r, s.limiter.trustProxy)); !ok {
+		return false, wait
+	}
+	return s.allowClient(p)
+}
+
+func writeRateLimited(w http.ResponseWriter, r *http.Request, wait time.Duration, message string) {
+	setRetryAfter(w.Header(), wait)
+	writeError(w, r, errCodeRateLimited, message, http.StatusTooManyRequests)
+}
+
+// setRetryAfter sets Retry-After in whole seconds, rounding up.
+func setRetryAfter(h http.Header, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	h.Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+}
+
+// clientIP returns the originating client address. X-Forwarded-For is only
+// trusted when TRUST_PROXY is set, otherwise any client could spoof it. Even
+// then only the rightmost entry is used: that is the one the trusted proxy
+// appended, while everything to its left came from the client.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			forwarded := values[len(values)-1]
+			if i := strings.LastIndex(forwarded, ","); i >= 0 {
+				forwarded = forwarded[i+1:]
+			}
+			if ip := strings.TrimSpace(forwarded); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		forwarded  []string
+		trustProxy bool
+		want       string
+	}{
+		{name: "remote address", want: "192.0.2.1"},
+		{name: "untrusted header", forwarded: []string{"203.0.113.9"}, want: "192.0.2.1"},
+		{name: "single hop", forwarded: []string{"203.0.113.9"}, trustProxy: true, want: "203.0.113.9"},
+		{name: "spoofed prefix", forwarded: []string{"10.0.0.1, 203.0.113.9"}, trustProxy: true, want: "203.0.113.9"},
+		{name: "repeated header", forwarded: []string{"10.0.0.1", "203.0.113.9"}, trustProxy: true, want: "203.0.113.9"},
+		{name: "empty entry", forwarded: []string{"10.0.0.1, "}, trustProxy: true, want: "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			for _, v := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := clientIP(r, tt.trustProxy); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientBucketsPerProvider(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	cfg := testConfig(t, stub.URL,
+		"PROVIDERS", "box",
+		"BOX_TOKEN_URL", stub.URL+"/oauth2/token",
+		"BOX_CLIENT_ID", "box-client",
+		"BOX_CLIENT_SECRET", "box-secret",
+		"BOX_REDIRECT_URI", "https://app.example/box",
+		"RATE_LIMIT_BURST", "100",
+		"CLIENT_RATE_LIMIT_RPS", "0.001",
+		"CLIENT_RATE_LIMIT_BURST", "1",
+		"DROPBOX_RATE_LIMIT_BURST", "2")
+	_, h := newTestServer(t, cfg)
+
+	refresh := func(provider string) int {
+		return do(h, "POST", "/api/"+provider+"/refresh", contentTypeJSON, `{"refresh_token":"r"}`).Code
+	}
+	for i, want := range []int{200, 200, 429} {
+		if got := refresh("dropbox"); got != want {
+			t.Errorf("dropbox refresh %d: status %d, want %d", i, got, want)
+		}
+	}
+	// Dropbox's exhausted quota leaves box's own bucket untouched.
+	for i, want := range []int{200, 429} {
+		if got := refresh("box"); got != want {
+			t.Errorf("box refresh %d: status %d, want %d", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// redisTimeout bounds every Redis round trip. Redis sits on the request path,
+// so a slow server must degrade quickly rather than stall requests.
+const redisTimeout = 500 * time.Millisecond
+
+const redisPoolSize = 16
+
+// redisBackoff is how long calls fail fast after Redis stops answering. A
+// request makes several Redis calls, and without it each would wait out
+// redisTimeout while Redis is down. One call per interval probes again.
+const redisBackoff = time.Second
+
+var errRedisBackoff = errors.New("redis: unavailable, backing off")
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisClient speaks just enough RESP for the rate limiter and token cache,
+// over a small pool of connections. Failures are logged once when Redis
+// becomes unreachable and once when it recovers.
+type redisClient struct {
+	addr     string
+	username string
+	password string
+	db       int
+	tls      *tls.Config
+
+	pool     chan *redisConn
+	degraded atomic.Bool
+	// retryAt is when, in Unix nanoseconds, the next call may try Redis
+	// again after a failure; zero while Redis is healthy.
+	retryAt atomic.Int64
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// newRedisClient accepts redis:// and rediss:// URLs, with optional
+// credentials and a database number as the path.
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &redisClient{addr: u.Host, pool: make(chan *redisConn, redisPoolSize)}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		c.tls = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("%q must be a redis:// or rediss:// URL", rawURL)
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("%q: database must be a number", rawURL)
+		}
+	}
+	return c, nil
+}
+
+// do runs one command and returns its reply: string, int64, nil, []any or a
+// redisError.
+func (c *redisClient) do(args ...string) (any, error) {
+	if retryAt := c.retryAt.Load(); retryAt != 0 {
+		now := time.Now()
+		if now.UnixNano() < retryAt || !c.retryAt.CompareAndSwap(retryAt, now.Add(redisBackoff).UnixNano()) {
+			return nil, errRedisBackoff
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	reply, err := c.roundTrip(ctx, args)
+	if err != nil {
+		var replyErr redisError
+		if !errors.As(err, &replyErr) {
+			c.retryAt.Store(time.Now().Add(redisBackoff).UnixNano())
+			if !c.degraded.Swap(true) {
+				slog.Warn("redis unavailable, falling back", "error", err)
+			}
+		}
+		return nil, err
+	}
+	c.retryAt.Store(0)
+	if c.degraded.Swap(false) {
+		slog.Info("redis reachable again")
+	}
+	return reply, nil
+}
+
+func (c *redisClient) roundTrip(ctx context.Context, args []string) (any, error) {
+	conn, err := c.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	reply, err := conn.command(args)
+	if err != nil {
+		var replyErr redisError
+		if !errors.As(err, &replyErr) {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	select {
+	case c.pool <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+func (c *redisClient) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-c.pool:
+		return conn, nil
+	default:
+	}
+
+	var d net.Dialer
+	raw, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.tls != nil {
+		raw = tls.Client(raw, c.tls)
+	}
+	conn := &redisConn{Conn: raw, r: bufio.NewReader(raw)}
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if c.password != "" {
+		auth := []string{"AUTH", c.password}
+		if c.username != "" {
+			auth = []string{"AUTH", c.username, c.password}
+		}
+		if _, err := conn.command(auth); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.command([]string{"SELECT", strconv.Itoa(c.db)}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisClient) Close() error {
+	for {
+		select {
+		case conn := <-c.pool:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (conn *redisConn) command(args []string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(conn, b.String()); err != nil {
+		return nil, err
+	}
+	return conn.reply()
+}
+
+func (conn *redisConn) reply() (any, error) {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(conn.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			// An error inside an array is part of the reply, not a
+			// failed round trip.
+			if items[i], err = conn.reply(); err != nil {
+				var replyErr redisError
+				if !errors.As(err, &replyErr) {
+					return nil, err
+				}
+				items[i] = err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+// redisBucketScript is the token bucket from memoryBuckets, run atomically
+// inside Redis so every replica draws from the same bucket. It reads the
+// time from Redis, so replicas with skewed clocks still refill it at the same
+// rate. Idle buckets expire once they would have refilled.
+const redisBucketScript = `
+if redis.replicate_commands then redis.replicate_commands() end
+local rate, burst = tonumber(ARGV[1]), tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+local allowed, wait = 0, 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, wait}
+`
+
+type redisBuckets struct {
+	client *redisClient
+}
+
+// take ignores now in favour of the Redis server's clock.
+func (b *redisBuckets) take(key string, rate float64, burst int, _ time.Time) (bool, time.Duration, error) {
+	reply, err := b.client.do("EVAL", redisBucketScript, "1", "todosrv:ratelimit:"+key,
+		strconv.FormatFloat(rate, 'f', -1, 64), strconv.Itoa(burst))
+	if err != nil {
+		return false, 0, err
+	}
+
+	items, ok := reply.([]any)
+	if !ok || len(items) != 2 {
+		return false, 0, fmt.Errorf("redis: unexpected bucket reply %v", reply)
+	}
+	allowed, _ := items[0].(int64)
+	wait, _ := items[1].(int64)
+	return allowed == 1, time.Duration(wait) * time.Millisecond, nil
+}
+
+// redisTokenCache shares refreshed tokens between replicas. A Redis failure
+// reads as a miss, so refreshes fall through to Dropbox.
+type redisTokenCache struct {
+	client *redisClient
+}
+
+// redisCachedToken is the stored form of cachedToken.
+type redisCachedToken struct {
+	Token   DropboxTokenResponse `json:"token"`
+	Expires time.Time            `json:"expires"`
+}
+
+func (c *redisTokenCache) get(key string) (cachedToken, bool) {
+	reply, err := c.client.do("GET", "todosrv:token:"+key)
+	value, ok := reply.(string)
+	if err != nil || !ok {
+		return cachedToken{}, false
+	}
+
+	var stored redisCachedToken
+	if err := json.Unmarshal([]byte(value), &stored); err != nil {
+		return cachedToken{}, false
+	}
+	return cachedToken{token: stored.Token, expires: stored.Expires}, true
+}
+
+func (c *redisTokenCache) set(key string, value cachedToken, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	b, err := json.Marshal(redisCachedToken{Token: value.token, Expires: value.expires})
+	if err != nil {
+		return
+	}
+	c.client.do("SET", "todosrv:token:"+key, string(b), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+}
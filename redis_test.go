@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *redisClient) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	c, err := newRedisClient("redis://" + mr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return mr, c
+}
+
+func TestNewRedisClient(t *testing.T) {
+	tests := []struct {
+		url      string
+		addr     string
+		username string
+		password string
+		db       int
+		tls      bool
+	}{
+		{url: "redis://cache", addr: "cache:6379"},
+		{url: "redis://:pw@cache:6380/2", addr: "cache:6380", password: "pw", db: 2},
+		{url: "rediss://user:pw@cache", addr: "cache:6379", username: "user", password: "pw", tls: true},
+	}
+	for _, tt := range tests {
+		c, err := newRedisClient(tt.url)
+		if err != nil {
+			t.Errorf("%s: %v", tt.url, err)
+			continue
+		}
+		if c.addr != tt.addr || c.username != tt.username || c.password != tt.password || c.db != tt.db || (c.tls != nil) != tt.tls {
+			t.Errorf("%s: got addr=%s user=%s db=%d tls=%v", tt.url, c.addr, c.username, c.db, c.tls != nil)
+		}
+	}
+
+	for _, bad := range []string{"http://cache", "redis://cache/zero"} {
+		if _, err := newRedisClient(bad); err == nil {
+			t.Errorf("%s: no error", bad)
+		}
+	}
+}
+
+func TestRedisCommands(t *testing.T) {
+	mr, c := newTestRedis(t)
+
+	if reply, err := c.do("SET", "k", "v"); err != nil || reply != "OK" {
+		t.Fatalf("SET = %v, %v", reply, err)
+	}
+	if reply, err := c.do("GET", "k"); err != nil || reply != "v" {
+		t.Errorf("GET = %v, %v", reply, err)
+	}
+	if reply, err := c.do("GET", "missing"); err != nil || reply != nil {
+		t.Errorf("GET missing = %v, %v", reply, err)
+	}
+	if reply, err := c.do("INCR", "n"); err != nil || reply != int64(1) {
+		t.Errorf("INCR = %v, %v", reply, err)
+	}
+	if _, err := c.do("NOSUCHCOMMAND"); !errors.As(err, new(redisError)) {
+		t.Errorf("unknown command error = %v, want a redisError", err)
+	}
+	if got, _ := mr.Get("k"); got != "v" {
+		t.Errorf("stored value = %q", got)
+	}
+}
+
+func TestRedisAuthAndSelect(t *testing.T) {
+	mr := miniredis.RunT(t)
+	mr.RequireAuth("pw")
+	c, err := newRedisClient("redis://:pw@" + mr.Addr() + "/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.do("SET", "k", "v"); err != nil {
+		t.Fatalf("SET: %v", err)
+	}
+	mr.Select(3)
+	if got, _ := mr.Get("k"); got != "v" {
+		t.Errorf("db 3 value = %q", got)
+	}
+}
+
+func TestRedisBuckets(t *testing.T) {
+	_, c := newTestRedis(t)
+	b := &redisBuckets{client: c}
+
+	for i := range 3 {
+		if ok, _, err := b.take("ip", 1, 3, time.Time{}); !ok || err != nil {
+			t.Fatalf("take %d = %v, %v", i, ok, err)
+		}
+	}
+	ok, wait, err := b.take("ip", 1, 3, time.Time{})
+	if ok || err != nil {
+		t.Fatalf("take past burst = %v, %v", ok, err)
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Errorf("wait = %s, want up to 1s", wait)
+	}
+	if ok, _, _ := b.take("other", 1, 3, time.Time{}); !ok {
+		t.Error("separate key shares the bucket")
+	}
+}
+
+func TestRedisTokenCache(t *testing.T) {
+	mr, c := newTestRedis(t)
+	cache := &redisTokenCache{client: c}
+	want := cachedToken{token: DropboxTokenResponse{AccessToken: "a", AccountID: "dbid:1"}, expires: time.Unix(2000000000, 0).UTC()}
+
+	cache.set("key", want, time.Minute)
+	got, ok := cache.get("key")
+	if !ok || got.token.AccessToken != "a" || !got.expires.Equal(want.expires) {
+		t.Fatalf("get = %+v, %v", got, ok)
+	}
+
+	mr.FastForward(2 * time.Minute)
+	if _, ok := cache.get("key"); ok {
+		t.Error("entry outlived its TTL")
+	}
+}
+
+func TestRedisBackoff(t *testing.T) {
+	mr, c := newTestRedis(t)
+	mr.Close()
+
+	if _, err := c.do("GET", "k"); err == nil || errors.Is(err, errRedisBackoff) {
+		t.Fatalf("first call error = %v, want a connection error", err)
+	}
+	start := time.Now()
+	if _, err := c.do("GET", "k"); !errors.Is(err, errRedisBackoff) {
+		t.Fatalf("second call error = %v, want errRedisBackoff", err)
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("backed-off call took %s", d)
+	}
+
+	// Once the backoff has passed, a call probes Redis again.
+	if err := mr.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	c.retryAt.Store(time.Now().UnixNano())
+	if _, err := c.do("SET", "k", "v"); err != nil {
+		t.Fatalf("call after recovery: %v", err)
+	}
+	if c.retryAt.Load() != 0 {
+		t.Error("backoff not cleared after success")
+	}
+}
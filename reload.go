@@ -0,0 +1,34 @@
+package main
+
+import "log/slog"
+
+// reload re-reads the env file and the environment and swaps the result in
+// for new requests; requests already running keep the Config they started
+// with. A configuration that fails validation is logged and the current one
+// stays in place.
+func (s *server) reload(envFile string) {
+	if err := loadDotEnv(envFile); err != nil {
+		slog.Error("config reload failed", "error", err)
+		return
+	}
+
+	next, err := LoadConfig()
+	if err != nil {
+		for _, err := range configErrors(err) {
+			slog.Error("config reload rejected", "error", err)
+		}
+		return
+	}
+
+	cur := s.cfg.Load()
+	if len(next.StateSecret) == 0 {
+		next.StateSecret = cur.StateSecret
+	}
+	if ignored := next.keepRestartOnly(cur); len(ignored) > 0 {
+		slog.Warn("config reload ignored settings that need a restart", "settings", ignored)
+	}
+
+	s.cfg.Store(&next)
+	logLevel.Set(next.LogLevel)
+	slog.Info("config reloaded")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useDotEnv writes content to a fresh env file and arranges for the
+// variables it sets to be removed after the test.
+func useDotEnv(t *testing.T) (path string, write func(content string)) {
+	t.Helper()
+	path = filepath.Join(t.TempDir(), ".env")
+	t.Cleanup(func() { loadDotEnv(filepath.Join(t.TempDir(), "missing.env")) })
+	return path, func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	withFlags(t)
+	prevLevel := logLevel.Level()
+	t.Cleanup(func() { logLevel.Set(prevLevel) })
+	for key, value := range map[string]string{
+		"DROPBOX_CLIENT_ID":    "client-id",
+		"DROPBOX_REDIRECT_URI": "https://app.example/callback",
+		"STATE_SECRET":         "0123456789abcdef0123456789abcdef",
+	} {
+		t.Setenv(key, value)
+	}
+	// Unset in the real environment, so the file supplies them.
+	for _, key := range []string{"DROPBOX_CLIENT_SECRET", "LOG_LEVEL", "LISTEN_ADDR", "PORT", "TLS_CERT_FILE", "TLS_KEY_FILE", "RATE_LIMIT_RPS"} {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+
+	path, write := useDotEnv(t)
+	write("DROPBOX_CLIENT_SECRET=old-secret\nLOG_LEVEL=info\nLISTEN_ADDR=:3001\n")
+	if err := loadDotEnv(path); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig()
+	if err != nil || cfg.ClientSecret != "old-secret" {
+		t.Fatalf("startup config: client secret %q, error %v", cfg.ClientSecret, err)
+	}
+	s := newServer(cfg, http.DefaultClient, nil, nil, nil)
+	logs := captureLogs(t)
+
+	certFile, keyFile := writeTestCert(t)
+	write("DROPBOX_CLIENT_SECRET=new-secret\nLOG_LEVEL=debug\nLISTEN_ADDR=:3002\nTLS_CERT_FILE=" + certFile + "\nTLS_KEY_FILE=" + keyFile + "\n")
+	s.reload(path)
+
+	got := s.cfg.Load()
+	if got.ClientSecret != "new-secret" || got.Providers[defaultProvider].ClientSecret != "new-secret" {
+		t.Errorf("client secret %q, provider's %q; want the reloaded one", got.ClientSecret, got.Providers[defaultProvider].ClientSecret)
+	}
+	if got.LogLevel != slog.LevelDebug || logLevel.Level() != slog.LevelDebug {
+		t.Errorf("log level %s, handler level %s; want debug", got.LogLevel, logLevel.Level())
+	}
+	if got.ListenAddr != ":3001" || got.TLSCertFile != "" || got.TLSKeyFile != "" || got.TLSEnabled() {
+		t.Errorf("restart-only settings changed: listen %q, cert %q, key %q", got.ListenAddr, got.TLSCertFile, got.TLSKeyFile)
+	}
+	if !strings.Contains(logs.String(), "config reload ignored settings that need a restart") ||
+		!strings.Contains(logs.String(), "LISTEN_ADDR/PORT") || !strings.Contains(logs.String(), "TLS_CERT_FILE") {
+		t.Errorf("ignored settings not logged:\n%s", logs)
+	}
+
+	logs.Reset()
+	write("DROPBOX_CLIENT_SECRET=rejected-secret\nRATE_LIMIT_RPS=fast\n")
+	s.reload(path)
+	if got := s.cfg.Load(); got.ClientSecret != "new-secret" || got.LogLevel != slog.LevelDebug {
+		t.Errorf("invalid reload applied: client secret %q, log level %s", got.ClientSecret, got.LogLevel)
+	}
+	if !strings.Contains(logs.String(), "config reload rejected") || !strings.Contains(logs.String(), "RATE_LIMIT_RPS") {
+		t.Errorf("rejection not logged:\n%s", logs)
+	}
+
+	logs.Reset()
+	write("DROPBOX_CLIENT_SECRET=\"unterminated\n")
+	s.reload(path)
+	if got := s.cfg.Load(); got.ClientSecret != "new-secret" || !strings.Contains(logs.String(), "config reload failed") {
+		t.Errorf("unreadable file: client secret %q, logs:\n%s", got.ClientSecret, logs)
+	}
+}
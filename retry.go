@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// doWithRetry sends req with exponential backoff and jitter, retrying only on
+// transport errors and 5xx/429 responses. Waiting between attempts aborts as
+// soon as ctx is done.
+func (s *server) doWithRetry(ctx context.Context, req *http.Request) (*http.Response, error) {
+	attempts := max(s.config(ctx).RetryMaxAttempts, 1)
+
+	for attempt := 1; ; attempt++ {
+		try := req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			try.Body = body
+		}
+
+		resp, err := s.client.Do(try)
+		if attempt >= attempts || !retryable(resp, err) {
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		logger(ctx).Debug("retrying dropbox request", "attempt", attempt, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff(s.config(ctx).RetryBaseDelay, attempt)):
+		}
+	}
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// backoff returns a delay in [d/2, d] where d is base doubled for every
+// previous attempt.
+func backoff(base time.Duration, attempt int) time.Duration {
+	d := base << (attempt - 1)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
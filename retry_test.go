@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flakyDropbox fails its first failures token calls with status, then
+// grants tokens.
+func flakyDropbox(t *testing.T, failures int, status int) *stubDropbox {
+	var stub *stubDropbox
+	stub = newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		if stub.calls.Load() <= int64(failures) {
+			w.WriteHeader(status)
+			return
+		}
+		tokenHandler(w, r)
+	})
+	return stub
+}
+
+func TestRetryTransientFailures(t *testing.T) {
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		stub := flakyDropbox(t, 2, status)
+		_, h := newTestServer(t, testConfig(t, stub.URL, "DROPBOX_RETRY_BASE_DELAY", "1ms"))
+
+		w := do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"r"}`)
+		if w.Code != http.StatusOK {
+			t.Errorf("%d twice: status = %d, body %s", status, w.Code, w.Body)
+		}
+		if n := stub.calls.Load(); n != 3 {
+			t.Errorf("%d twice: %d attempts, want 3", status, n)
+		}
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	stub := flakyDropbox(t, 5, http.StatusBadGateway)
+	_, h := newTestServer(t, testConfig(t, stub.URL, "DROPBOX_RETRY_BASE_DELAY", "1ms", "DROPBOX_MAX_ATTEMPTS", "2"))
+
+	w := do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"r"}`)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want the last 502", w.Code)
+	}
+	if n := stub.calls.Load(); n != 2 {
+		t.Errorf("%d attempts, want DROPBOX_MAX_ATTEMPTS=2", n)
+	}
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	stub := flakyDropbox(t, 1, http.StatusBadRequest)
+	_, h := newTestServer(t, testConfig(t, stub.URL, "DROPBOX_RETRY_BASE_DELAY", "1ms"))
+
+	do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"r"}`)
+	if n := stub.calls.Load(); n != 1 {
+		t.Errorf("a 400 was retried: %d attempts", n)
+	}
+}
+
+func TestRetryStopsWhenClientLeaves(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	_, h := newTestServer(t, testConfig(t, stub.URL, "DROPBOX_RETRY_BASE_DELAY", "1h"))
+
+	r := httptest.NewRequest("POST", "/api/dropbox/refresh", strings.NewReader(`{"refresh_token":"r"}`)).WithContext(ctx)
+	r.Header.Set("Content-Type", contentTypeJSON)
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("retry backoff outlived the request")
+	}
+	if n := stub.calls.Load(); n != 1 {
+		t.Errorf("%d attempts after the client left, want 1", n)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	base := 100 * time.Millisecond
+	for attempt, max := range map[int]time.Duration{1: base, 2: 2 * base, 3: 4 * base} {
+		for range 50 {
+			if d := backoff(base, attempt); d < max/2 || d > max {
+				t.Fatalf("backoff(%v, %d) = %v, want within [%v, %v]", base, attempt, d, max/2, max)
+			}
+		}
+	}
+	if d := backoff(0, 3); d != 0 {
+		t.Errorf("backoff(0, 3) = %v", d)
+	}
+}
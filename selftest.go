@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// selfTest sends each provider's token endpoint an authorization code that
+// can't be valid. A well-formed OAuth error proves the URL is right and the
+// host reachable, and anything other than invalid_client means the client
+// credentials were accepted. Transport errors are retried like any other
+// Dropbox call, since the network may still be settling at startup.
+func (s *server) selfTest(ctx context.Context) error {
+	providers := s.cfg.Load().Providers
+	for _, name := range sortedKeys(providers) {
+		if err := s.selfTestProvider(ctx, providers[name]); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (s *server) selfTestProvider(ctx context.Context, provider Provider) error {
+	data := url.Values{
+		"code":          {"todo-srv-self-test"},
+		"grant_type":    {"authorization_code"},
+		"client_id":     {provider.ClientID},
+		"client_secret": {provider.ClientSecret},
+		"redirect_uri":  {provider.RedirectURI},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.TokenURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentTypeForm)
+	req.Header.Set("User-Agent", s.cfg.Load().UserAgent)
+
+	resp, err := s.doWithRetry(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var upstream oauthError
+	if err := json.NewDecoder(io.LimitReader(resp.Body, s.cfg.Load().MaxUpstreamBody)).Decode(&upstream); err != nil || upstream.Error == "" {
+		return fmt.Errorf("token endpoint answered %s without an OAuth error", resp.Status)
+	}
+	if upstream.Error == "invalid_client" || resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("client credentials rejected: %s", upstream.ErrorDescription)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status int
+		body   string
+		err    string
+	}{
+		{"invalid grant", http.StatusBadRequest, `{"error":"invalid_grant","error_description":"code doesn't exist or has expired"}`, ""},
+		{"invalid client", http.StatusBadRequest, `{"error":"invalid_client","error_description":"Invalid client_id or client_secret"}`, "dropbox: client credentials rejected: Invalid client_id or client_secret"},
+		{"401", http.StatusUnauthorized, `{"error":"unauthorized_client"}`, "dropbox: client credentials rejected"},
+		{"non-oauth 200", http.StatusOK, `{"status":"ok"}`, "dropbox: token endpoint answered 200 OK without an OAuth error"},
+		{"html", http.StatusOK, `<html>captive portal</html>`, "without an OAuth error"},
+	} {
+		var form string
+		stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			form = r.PostForm.Get("grant_type") + " " + r.PostForm.Get("code") + " " + r.PostForm.Get("client_secret")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(tc.status)
+			io.WriteString(w, tc.body)
+		})
+		s, _ := newTestServer(t, testConfig(t, stub.URL, "DROPBOX_MAX_ATTEMPTS", "1"))
+
+		err := s.selfTest(context.Background())
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v, want a pass", tc.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: error %v, want %q", tc.name, err, tc.err)
+		}
+		if form != "authorization_code todo-srv-self-test client-secret" {
+			t.Errorf("%s: sent %q", tc.name, form)
+		}
+	}
+}
@@ -0,0 +1,873 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	contentTypeJSON = "application/json"
+	contentTypeForm = "application/x-www-form-urlencoded"
+)
+
+var errTrailingData = errors.New("unexpected data after JSON object")
+
+type AuthCodeRequest struct {
+	Code         string `json:"code"`
+	CodeVerifier string `json:"code_verifier,omitempty"`
+	RedirectURI  string `json:"redirect_uri,omitempty"`
+	State        string `json:"state"`
+
+	// TokenAccessType is Dropbox's token_access_type: online, offline or
+	// legacy. It defaults to offline, the only one that yields a refresh
+	// token.
+	TokenAccessType string `json:"token_access_type,omitempty"`
+}
+
+// tokenAccessTypes are the values Dropbox accepts for token_access_type.
+var tokenAccessTypes = []string{"online", "offline", "legacy"}
+
+const defaultTokenAccessType = "offline"
+
+// RefreshRequest carries either the refresh token itself or, when a
+// TOKEN_STORE is configured, the session ID it is stored under.
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token,omitempty"`
+	SessionID    string `json:"session_id,omitempty"`
+}
+
+// RevokeRequest revokes the access token upstream and ends the session, each
+// when given.
+type RevokeRequest struct {
+	AccessToken string `json:"access_token,omitempty"`
+	SessionID   string `json:"session_id,omitempty"`
+}
+
+// IntrospectRequest names the access token to check, following RFC 7662.
+type IntrospectRequest struct {
+	Token string `json:"token"`
+}
+
+// server holds everything the handlers need so tests can build one against a
+// stub Dropbox without touching package state.
+type server struct {
+	cfg       atomic.Pointer[Config]
+	client    *http.Client
+	limiter   *rateLimiter
+	readiness *readinessChecker
+	breaker   *breaker
+	draining  atomic.Bool
+	metrics   *metrics
+	tracer    *tracer
+	upstream  semaphore
+	tokens    tokenCache
+	refreshes *flightGroup
+
+	idempotent *ttlCache[idempotentResponse]
+	seenCodes  *ttlCache[idempotentResponse]
+	accounts   *ttlCache[*capturedResponse]
+	verifiers  *ttlCache[string]
+	exchanges  *flightGroup
+
+	store TokenStore
+	audit *auditLog
+	clock Clock
+
+	background sync.WaitGroup
+}
+
+// newServer builds the server; redis, when not nil, holds the rate-limit and
+// token-cache state so it is shared between replicas.
+func newServer(cfg Config, client *http.Client, store TokenStore, redis *redisClient, audit *auditLog) *server {
+	return newServerWithClock(cfg, client, store, redis, audit, realClock{})
+}
+
+// newServerWithClock is newServer with the time source used for expiry, TTL
+// and rate-limit decisions.
+func newServerWithClock(cfg Config, client *http.Client, store TokenStore, redis *redisClient, audit *auditLog, clock Clock) *server {
+	s := &server{
+		store:     store,
+		audit:     audit,
+		clock:     clock,
+		client:    client,
+		readiness: newReadinessChecker(client, clock, cfg.DropboxAPIURL),
+		upstream:  newSemaphore(cfg.MaxUpstreamConcurrency),
+		breaker:   newBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown),
+		refreshes: newFlightGroup(),
+
+		idempotent: newTTLCache[idempotentResponse](clock),
+		seenCodes:  newTTLCache[idempotentResponse](clock),
+		accounts:   newTTLCache[*capturedResponse](clock),
+		verifiers:  newTTLCache[string](clock),
+		exchanges:  newFlightGroup(),
+	}
+	s.cfg.Store(&cfg)
+
+	var buckets bucketStore = newMemoryBuckets(clock)
+	if redis != nil {
+		buckets = &redisBuckets{client: redis}
+	}
+	s.limiter = newRateLimiter(buckets, clock, cfg.RateLimitRPS, cfg.RateLimitBurst, cfg.TrustProxy)
+
+	if cfg.MetricsEnabled {
+		s.metrics = newMetrics()
+	}
+	switch {
+	case cfg.TokenCacheEnabled && redis != nil:
+		s.tokens = &redisTokenCache{client: redis}
+	case cfg.TokenCacheEnabled:
+		s.tokens = newTTLCache[cachedToken](clock)
+	}
+	if cfg.TracingEndpoint != "" {
+		s.tracer = newTracer(cfg.TracingEndpoint, cfg.ServiceName, cfg.TracingHeaders)
+	}
+	return s
+}
+
+// config returns the configuration pinned to ctx by withConfig, or the
+// current one outside a request.
+func (s *server) config(ctx context.Context) *Config {
+	if cfg, ok := ctx.Value(configKey).(*Config); ok {
+		return cfg
+	}
+	return s.cfg.Load()
+}
+
+// start launches the server's long-running goroutines. They stop when ctx is
+// cancelled; wait blocks until they have.
+func (s *server) start(ctx context.Context) {
+	s.background.Go(func() { s.idempotent.cleanup(ctx, time.Minute) })
+	s.background.Go(func() { s.seenCodes.cleanup(ctx, time.Minute) })
+	s.background.Go(func() { s.accounts.cleanup(ctx, time.Minute) })
+	s.background.Go(func() { s.verifiers.cleanup(ctx, time.Minute) })
+	// In-memory state needs sweeping; Redis expires its own keys.
+	for _, v := range []any{s.limiter.store, s.tokens} {
+		if sw, ok := v.(sweeper); ok {
+			s.background.Go(func() { sw.cleanup(ctx, time.Minute) })
+		}
+	}
+	if s.tracer != nil {
+		s.background.Go(func() { s.tracer.run(ctx, 5*time.Second) })
+	}
+}
+
+func (s *server) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.background.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// routes builds the handlers. Normally public serves everything and admin is
+// nil. With ADMIN_ADDR set, the admin, health, version and metrics endpoints
+// move to admin, for a listener that isn't exposed to the internet.
+func (s *server) routes() (public, admin http.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle("POST /api/{provider}/exchange", s.limiter.limit(s.limitClient(s.audited("exchange", http.HandlerFunc(s.exchangeHanlder)))))
+	mux.Handle("POST /api/{provider}/refresh", s.limiter.limit(s.limitClient(s.audited("refresh", http.HandlerFunc(s.refreshHandler)))))
+	mux.Handle("POST /api/{provider}/refresh/batch", s.limiter.limit(s.limitClient(s.audited("refresh_batch", http.HandlerFunc(s.batchRefreshHandler)))))
+	mux.Handle("POST /api/dropbox/revoke", s.limiter.limit(s.limitClient(s.audited("revoke", http.HandlerFunc(s.revokeHandler)))))
+	mux.Handle("POST /api/dropbox/token/introspect", s.limiter.limit(s.limitClient(http.HandlerFunc(s.introspectHandler))))
+	mux.Handle("GET /api/dropbox/account", s.limiter.limit(s.limitClient(http.HandlerFunc(s.accountHandler))))
+	mux.Handle("GET /api/dropbox/state", s.limiter.limit(http.HandlerFunc(s.stateHandler)))
+	mux.Handle("GET /api/pkce", s.limiter.limit(http.HandlerFunc(s.pkceHandler)))
+
+	root := http.NewServeMux()
+	// The callback is a top-level browser navigation from the provider, so it
+	// can't carry X-API-Key and has no use for CORS.
+	if s.cfg.Load().FrontendURL != nil {
+		root.Handle("GET /api/{provider}/callback", s.limiter.limit(s.limitClient(s.audited("exchange", http.HandlerFunc(s.callbackHandler)))))
+	}
+	// Dropbox calls the webhook itself; the signature stands in for the API
+	// key.
+	root.HandleFunc("GET /api/dropbox/webhook", s.webhookHandler)
+	root.HandleFunc("POST /api/dropbox/webhook", s.webhookHandler)
+	// Preflight requests never reach mux: withCORS answers every OPTIONS
+	// request before routing.
+	root.Handle("/", s.withCORS(mux, s.requireAPIKey(withJSONErrors(mux))))
+
+	if s.cfg.Load().AdminAddr == "" {
+		s.adminRoutes(mux, root)
+		return s.middleware(s.withHTTPSRedirect(root)), nil
+	}
+
+	adminMux := http.NewServeMux()
+	adminRoot := http.NewServeMux()
+	s.adminRoutes(adminMux, adminRoot)
+	// Validate refuses PPROF_ENABLED without ADMIN_ADDR, so profiles are
+	// only ever registered here.
+	if s.cfg.Load().PprofEnabled {
+		s.pprofRoutes(adminMux)
+	}
+	adminRoot.Handle("/", s.requireAPIKey(withJSONErrors(adminMux)))
+	return s.middleware(s.withHTTPSRedirect(root)), s.middleware(adminRoot)
+}
+
+// adminRoutes registers the operational endpoints: the /admin API on mux,
+// behind the API key, and the probes and metrics on root.
+func (s *server) adminRoutes(mux, root *http.ServeMux) {
+	mux.Handle("GET /admin/config", s.limiter.limit(http.HandlerFunc(s.adminConfigHandler)))
+	mux.Handle("POST /admin/drain", s.limiter.limit(http.HandlerFunc(s.drainHandler)))
+	mux.Handle("DELETE /admin/drain", s.limiter.limit(http.HandlerFunc(s.drainHandler)))
+
+	root.HandleFunc("GET /healthz", healthHandler)
+	root.HandleFunc("GET /readyz", s.readyHandler)
+	root.HandleFunc("GET /version", versionHandler)
+	if s.metrics != nil {
+		root.HandleFunc("GET /metrics", s.metrics.handler)
+	}
+}
+
+// middleware wraps a listener's routes in the per-request middleware.
+func (s *server) middleware(root http.Handler) http.Handler {
+	return withRequestID(s.withConfig(s.tracer.withTracing(s.withSecurityHeaders(s.withLogging(s.metrics.withMetrics(withRecovery(withGzip(s.withBodyLogging(s.withTimeout(root))))))))))
+}
+
+func (s *server) exchangeHanlder(w http.ResponseWriter, r *http.Request) {
+	provider, ok := s.provider(w, r)
+	if !ok {
+		return
+	}
+
+	var req AuthCodeRequest
+	if !s.decodeBody(w, r, &req) {
+		return
+	}
+
+	if !validGrantValue(req.Code) {
+		writeError(w, r, errCodeInvalidRequest, "code is missing or malformed", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.verifyState(r.Context(), req.State, s.clock.Now()); err != nil {
+		logger(r.Context()).Warn("rejected exchange state", "error", err)
+		writeError(w, r, errCodeInvalidState, "invalid state", http.StatusBadRequest)
+		return
+	}
+
+	if req.TokenAccessType == "" {
+		req.TokenAccessType = defaultTokenAccessType
+	}
+	if !slices.Contains(tokenAccessTypes, req.TokenAccessType) {
+		writeError(w, r, errCodeInvalidRequest, "token_access_type must be online, offline or legacy", http.StatusBadRequest)
+		return
+	}
+
+	redirectURI, ok := provider.redirectURI(req.RedirectURI)
+	if !ok {
+		logger(r.Context()).Warn("rejected redirect_uri", "redirect_uri", req.RedirectURI)
+		writeError(w, r, errCodeInvalidRequest, "redirect_uri not allowed", http.StatusBadRequest)
+		return
+	}
+
+	data := url.Values{
+		"code":         {req.Code},
+		"grant_type":   {"authorization_code"},
+		"client_id":    {provider.ClientID},
+		"redirect_uri": {redirectURI},
+	}
+	// token_access_type is a Dropbox extension other providers may reject.
+	if provider.Name == defaultProvider {
+		data.Set("token_access_type", req.TokenAccessType)
+	}
+
+	// PKCE public clients prove possession with the verifier instead of the
+	// app secret. One issued by /api/pkce is found through the state.
+	if req.CodeVerifier == "" {
+		req.CodeVerifier, _ = s.storedVerifier(req.State)
+	}
+	if req.CodeVerifier != "" {
+		data.Set("code_verifier", req.CodeVerifier)
+	} else {
+		data.Set("client_secret", provider.ClientSecret)
+	}
+
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+		auditAccount(r.Context(), s.idempotentExchange(w, r, provider, data, key))
+		return
+	}
+	if s.config(r.Context()).ExchangeDedupWindow > 0 {
+		auditAccount(r.Context(), s.dedupedExchange(w, r, provider, data))
+		return
+	}
+	auditAccount(r.Context(), s.exchange(w, r, provider, data))
+}
+
+func (s *server) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := s.provider(w, r)
+	if !ok {
+		return
+	}
+
+	var req RefreshRequest
+	if !s.decodeBody(w, r, &req) {
+		return
+	}
+
+	if req.SessionID == "" {
+		if !validGrantValue(req.RefreshToken) {
+			writeError(w, r, errCodeInvalidRequest, "refresh_token is missing or malformed", http.StatusBadRequest)
+			return
+		}
+		auditAccount(r.Context(), s.refresh(w, r, provider, req.RefreshToken))
+		return
+	}
+
+	stored, ok := s.session(w, r, provider, req.SessionID)
+	if !ok {
+		return
+	}
+	rec := newCapturedResponse()
+	if token := s.refresh(rec, r, provider, stored.RefreshToken); token != nil {
+		auditAccount(r.Context(), s.writeSessionToken(w, r, rec.header, req.SessionID, provider, stored.RefreshToken, token))
+		return
+	}
+	rec.replay(w)
+}
+
+// refresh runs a refresh grant, from the token cache when possible, and
+// returns the token written to w or nil on failure.
+func (s *server) refresh(w http.ResponseWriter, r *http.Request, provider Provider, refreshToken string) *DropboxTokenResponse {
+	key := cacheKey(provider.Name, refreshToken)
+	if token := s.cachedRefresh(w, r, key); token != nil {
+		return token
+	}
+
+	data := url.Values{
+		"refresh_token": {refreshToken},
+		"grant_type":    {"refresh_token"},
+		"client_id":     {provider.ClientID},
+		"client_secret": {provider.ClientSecret},
+	}
+
+	// Concurrent refreshes of the same token share one upstream call, since
+	// Dropbox may invalidate a token that is refreshed twice at once. The
+	// shared call must outlive whichever client happened to start it.
+	res, shared := s.refreshes.do(r.Context(), key, func() *capturedResponse {
+		rec := newCapturedResponse()
+		rec.token = s.callDropbox(rec, r.WithContext(context.WithoutCancel(r.Context())), provider, data)
+		s.cacheRefresh(r.Context(), key, rec.token)
+		return rec
+	})
+	if res == nil {
+		writeUpstreamError(w, r, "failed to contact dropbox")
+		return nil
+	}
+	if shared {
+		logger(r.Context()).Debug("shared in-flight refresh")
+	}
+	res.replay(w)
+	return res.token
+}
+
+func (s *server) revokeHandler(w http.ResponseWriter, r *http.Request) {
+	var req RevokeRequest
+	if !s.decodeBody(w, r, &req) {
+		return
+	}
+
+	if req.AccessToken == "" && req.SessionID == "" {
+		writeError(w, r, errCodeInvalidRequest, "access_token or session_id is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.SessionID != "" {
+		if !s.endSession(w, r, req.SessionID) {
+			return
+		}
+		if req.AccessToken == "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	log := logger(r.Context()).With("upstream", "revoke")
+
+	upstream, err := http.NewRequestWithContext(r.Context(), http.MethodPost, s.config(r.Context()).DropboxAPIURL+"/2/auth/token/revoke", nil)
+	if err != nil {
+		log.Error("failed to build dropbox request", "error", err)
+		writeError(w, r, errCodeUpstreamError, "failed to contact dropbox", http.StatusBadGateway)
+		return
+	}
+	upstream.Header.Set("Authorization", "Bearer "+req.AccessToken)
+
+	// A revoked token must not keep answering from the account cache.
+	s.accounts.deletePrefix(accountCachePrefix(req.AccessToken))
+	s.proxyDropbox(w, r, "revoke", upstream, log)
+}
+
+func (s *server) accountHandler(w http.ResponseWriter, r *http.Request) {
+	token, ok := bearerToken(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, r, errCodeUnauthorized, "missing bearer token", http.StatusUnauthorized)
+		return
+	}
+
+	upstream, err := http.NewRequestWithContext(r.Context(), http.MethodPost, s.config(r.Context()).DropboxAPIURL+"/2/users/get_current_account", nil)
+	if err != nil {
+		logger(r.Context()).Error("failed to build dropbox request", "error", err)
+		writeError(w, r, errCodeUpstreamError, "failed to contact dropbox", http.StatusBadGateway)
+		return
+	}
+	upstream.Header.Set("Authorization", "Bearer "+token)
+
+	// A team token acts on behalf of one member, named by a select header;
+	// at most one of them makes sense.
+	selected := 0
+	for _, name := range teamSelectHeaders {
+		value := r.Header.Get(name)
+		if value == "" {
+			continue
+		}
+		if !validTeamMemberID(value) {
+			writeError(w, r, errCodeInvalidRequest, name+" must be a team member ID", http.StatusBadRequest)
+			return
+		}
+		upstream.Header.Set(name, value)
+		selected++
+	}
+	if selected > 1 {
+		writeError(w, r, errCodeInvalidRequest, "send only one of "+strings.Join(teamSelectHeaders, " and "), http.StatusBadRequest)
+		return
+	}
+
+	// The selected member changes the answer, so it is part of the key.
+	key := accountCachePrefix(token) + cacheKey(upstream.Header.Get(teamSelectHeaders[0]), upstream.Header.Get(teamSelectHeaders[1]))
+	s.cachedAccount(w, r, key, upstream)
+}
+
+// teamSelectHeaders pick the member a Dropbox Business team token acts as.
+var teamSelectHeaders = []string{"Dropbox-API-Select-User", "Dropbox-API-Select-Admin"}
+
+// validTeamMemberID accepts Dropbox team member IDs: dbmid: followed by
+// URL-safe base64.
+func validTeamMemberID(v string) bool {
+	id, ok := strings.CutPrefix(v, "dbmid:")
+	if !ok || id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// maxGrantValueLength is far above the length of any Dropbox code or token,
+// while keeping junk from costing an upstream round trip.
+const maxGrantValueLength = 2048
+
+// validGrantValue reports whether an authorization code or refresh token is
+// plausible: non-empty, not oversized, and printable ASCII without spaces.
+func validGrantValue(v string) bool {
+	if v == "" || len(v) > maxGrantValueLength {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		if v[i] <= ' ' || v[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// decodeBody reads a size-limited request body into v. JSON is the default;
+// application/x-www-form-urlencoded bodies are accepted for clients that can't
+// send JSON and are held to the same rules. On failure it writes the error
+// response itself and returns false.
+func (s *server) decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, s.config(r.Context()).MaxBodyBytes)
+
+	var err error
+	switch mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType {
+	case "", contentTypeJSON:
+		err = decodeStrictJSON(r.Body, v)
+	case contentTypeForm:
+		err = decodeForm(r, v)
+	default:
+		writeError(w, r, errCodeUnsupportedMediaType, "unsupported content type", http.StatusUnsupportedMediaType)
+		return false
+	}
+	if err == nil {
+		return true
+	}
+
+	if isMaxBytesError(err) {
+		writeError(w, r, errCodeRequestTooLarge, "request body too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+
+	logger(r.Context()).Warn("invalid request body", "path", r.URL.Path, "error", err)
+
+	message := "invalid request body"
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		message += ": unknown field " + field
+	} else if err == errTrailingData {
+		message += ": " + err.Error()
+	}
+	writeError(w, r, errCodeInvalidRequest, message, http.StatusBadRequest)
+	return false
+}
+
+// decodeStrictJSON decodes exactly one JSON object into v, rejecting unknown
+// fields and trailing data.
+func decodeStrictJSON(body io.Reader, v any) error {
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+
+	switch extra := dec.Decode(&struct{}{}); {
+	case extra == io.EOF:
+		return nil
+	case isMaxBytesError(extra):
+		return extra
+	default:
+		return errTrailingData
+	}
+}
+
+// decodeForm maps form fields onto v's JSON field names by round-tripping
+// through JSON, so forms get the same unknown-field checks.
+func decodeForm(r *http.Request, v any) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	fields := make(map[string]string, len(r.PostForm))
+	for key, values := range r.PostForm {
+		fields[key] = values[0]
+	}
+
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return decodeStrictJSON(bytes.NewReader(b), v)
+}
+
+func isMaxBytesError(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
+
+// Error codes carried in the "code" field of error responses. Clients branch
+// on these; the "error" message is for people and may change.
+const (
+	errCodeInvalidRequest       = "invalid_request"
+	errCodeInvalidState         = "invalid_state"
+	errCodeInvalidSession       = "invalid_session"
+	errCodeRequestTooLarge      = "request_too_large"
+	errCodeUnsupportedMediaType = "unsupported_media_type"
+	errCodeUnauthorized         = "unauthorized"
+	errCodeForbidden            = "forbidden"
+	errCodeNotFound             = "not_found"
+	errCodeUnknownProvider      = "unknown_provider"
+	errCodeMethodNotAllowed     = "method_not_allowed"
+	errCodeIdempotencyConflict  = "idempotency_key_reused"
+	errCodeCodeReused           = "code_already_used"
+	errCodeRateLimited          = "rate_limited"
+	errCodeOverloaded           = "overloaded"
+	errCodeUpstreamError        = "upstream_error"
+	errCodeUpstreamUnavailable  = "upstream_unavailable"
+	errCodeDraining             = "draining"
+	errCodeTimeout              = "timeout"
+	errCodeInternal             = "internal_error"
+)
+
+// writeError writes the JSON error envelope. The body is marshaled before
+// the status is committed so Content-Length is exact. Marshaling a map of
+// strings can't fail: invalid UTF-8 in message becomes U+FFFD.
+func writeError(w http.ResponseWriter, r *http.Request, code, message string, status int) {
+	log := logger(r.Context())
+	log.Debug("error response", "status", status, "code", code, "message", message)
+
+	body, _ := json.Marshal(map[string]string{
+		"code":  code,
+		"error": message,
+	})
+	body = append(body, '\n')
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if _, err := w.Write(body); err != nil {
+		log.Debug("failed to write error response", "error", err)
+	}
+}
+
+// callDropbox posts a token grant to the provider's token endpoint and writes
+// the result to w. Dropbox is the default provider, hence the name. The
+// normalized token is returned on success, nil otherwise.
+func (s *server) callDropbox(w http.ResponseWriter, r *http.Request, provider Provider, data url.Values) *DropboxTokenResponse {
+	log := logger(r.Context()).With("provider", provider.Name, "grant_type", data.Get("grant_type"))
+	if s.config(r.Context()).DryRun {
+		return dryRunToken(w, provider, data, log, s.clock.Now())
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, provider.TokenURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		log.Error("failed to build token request", "error", err)
+		writeError(w, r, errCodeUpstreamError, "failed to contact dropbox", http.StatusBadGateway)
+		return nil
+	}
+	req.Header.Set("Content-Type", contentTypeForm)
+
+	resp, body, log, ok := s.sendDropbox(w, r, "token", req, log)
+	if !ok {
+		return nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		writeOAuthError(w, resp, body, log)
+		return nil
+	}
+
+	token := writeTokenResponse(w, r, resp, body, log, s.clock.Now())
+	if token == nil {
+		s.metrics.observeUpstreamFailure("token", failureInvalidResponse)
+	}
+	return token
+}
+
+// proxyDropbox sends req upstream and relays the status and body to w. op
+// names the Dropbox operation in metrics.
+func (s *server) proxyDropbox(w http.ResponseWriter, r *http.Request, op string, req *http.Request, log *slog.Logger) {
+	resp, body, log, ok := s.sendDropbox(w, r, op, req, log)
+	if !ok {
+		return
+	}
+	defer resp.Body.Close()
+
+	relayDropbox(w, resp, body, log)
+}
+
+// sendDropbox performs req and checks the response is usable JSON. When it
+// returns false the error response has been written; otherwise the caller
+// owns resp.Body and should read it through body. The returned logger carries
+// the upstream request ID.
+func (s *server) sendDropbox(w http.ResponseWriter, r *http.Request, op string, req *http.Request, log *slog.Logger) (*http.Response, *bufio.Reader, *slog.Logger, bool) {
+	resp, raw, log, ok := s.fetchDropbox(w, r, op, req, log)
+	if !ok {
+		return nil, nil, nil, false
+	}
+	body, ok := s.dropboxJSON(w, r, op, resp, raw, log)
+	if !ok {
+		return nil, nil, nil, false
+	}
+	return resp, body, log, true
+}
+
+// fetchDropbox performs req and reads the whole response body, without
+// looking at what it holds. It reports failure like sendDropbox; on success
+// the caller should pass the body to dropboxJSON before trusting it.
+func (s *server) fetchDropbox(w http.ResponseWriter, r *http.Request, op string, req *http.Request, log *slog.Logger) (*http.Response, []byte, *slog.Logger, bool) {
+	if ok, wait := s.breaker.allow(s.clock.Now()); !ok {
+		log.Warn("circuit open, not calling dropbox")
+		setRetryAfter(w.Header(), wait)
+		writeError(w, r, errCodeUpstreamUnavailable, "dropbox is unavailable", http.StatusServiceUnavailable)
+		return nil, nil, nil, false
+	}
+
+	release, ok := s.upstream.acquire(r.Context(), s.config(r.Context()).UpstreamQueueTimeout)
+	if !ok {
+		s.breaker.abandon()
+	}
+	if !ok && r.Context().Err() != nil {
+		writeUpstreamError(w, r, "failed to contact dropbox")
+		return nil, nil, nil, false
+	}
+	if !ok {
+		log.Warn("upstream concurrency limit reached")
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, errCodeOverloaded, "too many concurrent requests", http.StatusServiceUnavailable)
+		return nil, nil, nil, false
+	}
+
+	_, span := s.tracer.start(r.Context(), "dropbox "+op, spanKindClient, spanContext{})
+	defer span.end()
+	span.set("http.request.method", req.Method)
+	span.set("server.address", req.URL.Host)
+	span.inject(req.Header)
+	req.Header.Set("User-Agent", s.config(r.Context()).UserAgent)
+
+	start := time.Now()
+	resp, err := s.doWithRetry(r.Context(), req)
+	elapsed := time.Since(start)
+	// A client that went away says nothing about Dropbox, so it is kept out
+	// of the upstream metrics and the breaker.
+	canceled := errors.Is(err, context.Canceled)
+	if canceled {
+		s.breaker.abandon()
+	} else {
+		s.metrics.observeUpstream(op, elapsed, err != nil || resp.StatusCode >= 500)
+		s.metrics.observeUpstreamFailure(op, classifyUpstream(resp, err))
+		s.breaker.record(err != nil || resp.StatusCode >= 500, s.clock.Now())
+	}
+	if err != nil {
+		span.fail("transport", err.Error())
+		release()
+		if !canceled {
+			log.Error("dropbox request failed", "error", err, "duration_ms", elapsed.Milliseconds())
+		}
+		writeUpstreamError(w, r, "failed to contact dropbox")
+		return nil, nil, nil, false
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+
+	// Dropbox support asks for this ID; logging it next to our own request ID
+	// links a browser report to the upstream call.
+	if id := resp.Header.Get("X-Dropbox-Request-Id"); id != "" {
+		log = log.With("dropbox_request_id", id)
+	}
+	// The duration covers retries, so it is the whole of this request's time
+	// spent waiting on Dropbox.
+	log.Debug("dropbox responded", "op", op, "status", resp.StatusCode, "duration_ms", elapsed.Milliseconds())
+	span.set("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		span.fail(strconv.Itoa(resp.StatusCode), resp.Status)
+	}
+
+	// Read the whole body, up to DROPBOX_MAX_RESPONSE_BYTES, before
+	// committing the status so an upstream that fails mid-body or sends too
+	// much still gets a clean 502.
+	limit := s.config(r.Context()).MaxUpstreamBody
+	if resp.ContentLength > limit {
+		resp.Body.Close()
+		s.failBody(op, resp, failureInvalidResponse)
+		log.Error("dropbox response too large", "status", resp.StatusCode, "content_length", resp.ContentLength)
+		writeError(w, r, errCodeUpstreamError, "dropbox response too large", http.StatusBadGateway)
+		return nil, nil, nil, false
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		resp.Body.Close()
+		if r.Context().Err() == nil {
+			log.Error("failed to read dropbox response", "status", resp.StatusCode, "error", err)
+			s.failBody(op, resp, classifyUpstream(nil, err))
+		}
+		writeUpstreamError(w, r, "failed to read dropbox response")
+		return nil, nil, nil, false
+	}
+	if int64(len(raw)) > limit {
+		resp.Body.Close()
+		s.failBody(op, resp, failureInvalidResponse)
+		log.Error("dropbox response too large", "status", resp.StatusCode, "limit", limit)
+		writeError(w, r, errCodeUpstreamError, "dropbox response too large", http.StatusBadGateway)
+		return nil, nil, nil, false
+	}
+	return resp, raw, log, true
+}
+
+// failBody counts a response whose body was unusable. An error status has
+// already been counted as a failure, so this only adds one for a success.
+func (s *server) failBody(op string, resp *http.Response, kind string) {
+	if resp.StatusCode < 400 {
+		s.metrics.observeUpstreamFailure(op, kind)
+	}
+}
+
+// dropboxJSON checks that a body read by fetchDropbox is JSON, and relays
+// the forwarded headers if it is. It reports failure like sendDropbox.
+func (s *server) dropboxJSON(w http.ResponseWriter, r *http.Request, op string, resp *http.Response, raw []byte, log *slog.Logger) (*bufio.Reader, bool) {
+	if len(raw) > 0 && !isJSONContentType(resp.Header.Get("Content-Type")) {
+		snippet := raw[:min(len(raw), 256)]
+		resp.Body.Close()
+		s.failBody(op, resp, failureInvalidResponse)
+		log.Error("dropbox returned non-JSON response",
+			"status", resp.StatusCode,
+			"content_type", resp.Header.Get("Content-Type"),
+			"body", string(snippet),
+		)
+		writeError(w, r, errCodeUpstreamError, "unexpected response from dropbox", http.StatusBadGateway)
+		return nil, false
+	}
+
+	if resp.StatusCode >= 400 {
+		log.Warn("dropbox returned error", "status", resp.StatusCode)
+	}
+
+	copyUpstreamHeaders(w.Header(), resp.Header, s.config(r.Context()).ForwardedHeaders)
+	return bufio.NewReader(bytes.NewReader(raw)), true
+}
+
+func relayDropbox(w http.ResponseWriter, resp *http.Response, body io.Reader, log *slog.Logger) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(resp.StatusCode)
+
+	// The status is already on the wire, so a failure here can only be
+	// signalled by aborting the connection rather than sending a body that
+	// looks complete.
+	if _, err := io.Copy(w, body); err != nil {
+		log.Error("failed to relay dropbox response", "status", resp.StatusCode, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// defaultForwardedHeaders are the upstream response headers relayed to
+// clients unless FORWARDED_HEADERS says otherwise.
+var defaultForwardedHeaders = []string{"Retry-After", "X-Dropbox-Request-Id"}
+
+// hopByHopHeaders describe a single connection and are never relayed,
+// whatever FORWARDED_HEADERS lists.
+var hopByHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// copyUpstreamHeaders relays the named headers from a Dropbox response.
+// Everything else from Dropbox is dropped.
+func copyUpstreamHeaders(dst, src http.Header, names []string) {
+	for _, name := range names {
+		if slices.Contains(hopByHopHeaders, name) {
+			continue
+		}
+		if values := src.Values(name); len(values) > 0 {
+			dst[name] = slices.Clone(values)
+		}
+	}
+}
+
+func isJSONContentType(value string) bool {
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return false
+	}
+	return mediaType == contentTypeJSON || strings.HasSuffix(mediaType, "+json")
+}
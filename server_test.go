@@ -0,0 +1,690 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testConfig loads the configuration the way main does, from an environment
+// holding the required variables with Dropbox at api, plus extra as
+// alternating names and values.
+func testConfig(t testing.TB, api string, extra ...string) Config {
+	t.Helper()
+	env := map[string]string{
+		"DROPBOX_CLIENT_ID":     "client-id",
+		"DROPBOX_CLIENT_SECRET": "client-secret",
+		"DROPBOX_REDIRECT_URI":  "https://app.example/callback",
+		"DROPBOX_API_URL":       api,
+		"STATE_SECRET":          "0123456789abcdef0123456789abcdef",
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		env[extra[i]] = extra[i+1]
+	}
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	return cfg
+}
+
+// stubDropbox is a fake Dropbox that counts the requests it serves.
+type stubDropbox struct {
+	*httptest.Server
+	calls atomic.Int64
+}
+
+func newStubDropbox(t *testing.T, handler http.HandlerFunc) *stubDropbox {
+	t.Helper()
+	stub := &stubDropbox{}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stub.calls.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+// tokenHandler answers every token grant with a fresh token.
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, `{"access_token":"sl.access","token_type":"bearer","expires_in":14400,"refresh_token":"refresh","account_id":"dbid:1","uid":"1"}`)
+}
+
+// newTestServer builds a server for cfg and returns it with its public
+// handler.
+func newTestServer(t *testing.T, cfg Config) (*server, http.Handler) {
+	t.Helper()
+	s := newServer(cfg, http.DefaultClient, nil, nil, nil)
+	public, _ := s.routes()
+	return s, public
+}
+
+// do sends a request through h and returns the recorded response.
+func do(h http.Handler, method, target, contentType, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.RemoteAddr = "192.0.2.1:1234"
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func decodeJSON[T any](t *testing.T, w *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decode %q: %v", w.Body.String(), err)
+	}
+	return v
+}
+
+// failingWriter records the status and headers but refuses the body, like a
+// connection the client has dropped.
+type failingWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *failingWriter) Header() http.Header    { return w.header }
+func (w *failingWriter) WriteHeader(status int) { w.status = status }
+func (w *failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestWriteError(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+
+	w := httptest.NewRecorder()
+	writeError(w, r, errCodeInvalidRequest, "bad \xff byte", http.StatusBadRequest)
+	if w.Code != http.StatusBadRequest || w.Header().Get("Content-Length") != strconv.Itoa(w.Body.Len()) {
+		t.Errorf("status %d, Content-Length %q for %d bytes", w.Code, w.Header().Get("Content-Length"), w.Body.Len())
+	}
+	got := decodeJSON[map[string]string](t, w)
+	if got["code"] != errCodeInvalidRequest || got["error"] != "bad � byte" {
+		t.Errorf("envelope = %v", got)
+	}
+
+	fw := &failingWriter{header: http.Header{}}
+	writeError(fw, r, errCodeInternal, "boom", http.StatusInternalServerError)
+	if fw.status != http.StatusInternalServerError || fw.header.Get("Content-Type") != contentTypeJSON {
+		t.Errorf("failing writer: status %d, Content-Type %q", fw.status, fw.header.Get("Content-Type"))
+	}
+}
+
+// grantRecorder is a Dropbox token endpoint that keeps the last form it was
+// sent.
+func grantRecorder(t *testing.T) (*stubDropbox, *url.Values) {
+	grant := new(url.Values)
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		*grant = r.PostForm
+		tokenHandler(w, r)
+	})
+	return stub, grant
+}
+
+// exchangeBody is an exchange request for code with a freshly issued state
+// and any extra JSON fields.
+func exchangeBody(s *server, code, fields string) string {
+	state := s.newState(context.Background(), s.clock.Now())
+	return `{"code":"` + code + `","state":"` + state + `"` + fields + `}`
+}
+
+func TestExchangePKCE(t *testing.T) {
+	stub, grant := grantRecorder(t)
+	s, h := newTestServer(t, testConfig(t, stub.URL))
+
+	w := do(h, "POST", "/api/dropbox/exchange", contentTypeJSON, exchangeBody(s, "public", `,"code_verifier":"verifier"`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	if grant.Get("code_verifier") != "verifier" || grant.Has("client_secret") {
+		t.Errorf("PKCE grant = %v, want code_verifier and no client_secret", *grant)
+	}
+
+	w = do(h, "POST", "/api/dropbox/exchange", contentTypeJSON, exchangeBody(s, "confidential", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	if grant.Has("code_verifier") || grant.Get("client_secret") != "client-secret" {
+		t.Errorf("confidential grant = %v, want client_secret and no code_verifier", *grant)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// The handlers use only the client they are given, so Dropbox can be faked
+// without a listener.
+func TestRefreshWithInjectedClient(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		upstream func() (*http.Response, error)
+		want     int
+	}{
+		{"granted", func() (*http.Response, error) {
+			return jsonResponse(http.StatusOK, `{"access_token":"sl.a","token_type":"bearer","expires_in":14400}`), nil
+		}, http.StatusOK},
+		{"invalid grant", func() (*http.Response, error) {
+			return jsonResponse(http.StatusBadRequest, `{"error":"invalid_grant"}`), nil
+		}, http.StatusBadRequest},
+		{"outage", func() (*http.Response, error) {
+			return jsonResponse(http.StatusInternalServerError, `{}`), nil
+		}, http.StatusBadGateway},
+		{"unreachable", func() (*http.Response, error) {
+			return nil, errors.New("connection refused")
+		}, http.StatusBadGateway},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var host string
+			client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				host = r.URL.Host
+				return tc.upstream()
+			})}
+			cfg := testConfig(t, "http://dropbox.test", "DROPBOX_MAX_ATTEMPTS", "1")
+			public, _ := newServer(cfg, client, nil, nil, nil).routes()
+
+			w := do(public, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"r"}`)
+			if w.Code != tc.want {
+				t.Errorf("status = %d, want %d; body %s", w.Code, tc.want, w.Body)
+			}
+			if host != "dropbox.test" {
+				t.Errorf("request went to %q, not through the injected client", host)
+			}
+		})
+	}
+}
+
+func jsonResponse(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {contentTypeJSON}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func TestRefreshContentType(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	_, h := newTestServer(t, testConfig(t, stub.URL))
+
+	w := do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"r"}`)
+	if got := w.Header().Get("Content-Type"); w.Code != http.StatusOK || got != "application/json" {
+		t.Errorf("status %d, Content-Type %q", w.Code, got)
+	}
+}
+
+func TestTokenEndpointsRejectOtherMethods(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	_, h := newTestServer(t, testConfig(t, stub.URL))
+
+	for _, path := range []string{"/api/dropbox/exchange", "/api/dropbox/refresh"} {
+		for _, method := range []string{"GET", "PUT"} {
+			w := do(h, method, path, "", "")
+			if w.Code != http.StatusMethodNotAllowed {
+				t.Errorf("%s %s: status = %d, want 405", method, path, w.Code)
+			}
+			if allow := w.Header().Get("Allow"); !strings.Contains(allow, "POST") {
+				t.Errorf("%s %s: Allow = %q", method, path, allow)
+			}
+			if got := decodeJSON[map[string]string](t, w)["code"]; got != errCodeMethodNotAllowed {
+				t.Errorf("%s %s: code = %q", method, path, got)
+			}
+		}
+		if w := do(h, "OPTIONS", path, "", ""); w.Code != http.StatusNoContent {
+			t.Errorf("OPTIONS %s: status = %d, want the preflight's 204", path, w.Code)
+		}
+	}
+	if n := stub.calls.Load(); n != 0 {
+		t.Errorf("dropbox called %d times", n)
+	}
+}
+
+func TestOversizedBody(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	_, h := newTestServer(t, testConfig(t, stub.URL, "MAX_BODY_BYTES", "64"))
+
+	body := `{"refresh_token":"` + strings.Repeat("r", 100) + `"}`
+	w := do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, body)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want 413", w.Code)
+	}
+	if got := decodeJSON[map[string]string](t, w)["code"]; got != errCodeRequestTooLarge {
+		t.Errorf("code = %q", got)
+	}
+	if stub.calls.Load() != 0 {
+		t.Errorf("oversized body reached dropbox")
+	}
+}
+
+// An upstream body over DROPBOX_MAX_RESPONSE_BYTES is a 502 whether or not
+// Dropbox declared its length up front.
+func TestOversizedUpstreamBody(t *testing.T) {
+	oversized := `{"access_token":"` + strings.Repeat("a", 2048) + `"}`
+	for _, tc := range []struct {
+		name  string
+		write func(w http.ResponseWriter)
+	}{
+		{"content length", func(w http.ResponseWriter) {
+			w.Header().Set("Content-Length", strconv.Itoa(len(oversized)))
+			io.WriteString(w, oversized)
+		}},
+		{"chunked", func(w http.ResponseWriter) {
+			io.WriteString(w, oversized[:10])
+			w.(http.Flusher).Flush()
+			io.WriteString(w, oversized[10:])
+		}},
+	} {
+		stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			tc.write(w)
+		})
+		_, h := newTestServer(t, testConfig(t, stub.URL, "DROPBOX_MAX_RESPONSE_BYTES", "1024"))
+
+		w := do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"r"}`)
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("%s: status = %d, want 502", tc.name, w.Code)
+			continue
+		}
+		if got := decodeJSON[map[string]string](t, w); got["code"] != errCodeUpstreamError || got["error"] != "dropbox response too large" {
+			t.Errorf("%s: body = %v", tc.name, got)
+		}
+	}
+}
+
+func TestStrictJSONBodies(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	s, h := newTestServer(t, testConfig(t, stub.URL))
+
+	for _, tc := range []struct{ path, body string }{
+		{"/api/dropbox/refresh", `{"refresh_token":"r","refresh_tokne":"r"}`},
+		{"/api/dropbox/refresh", `{"refresh_token":"r"} {"refresh_token":"s"}`},
+		{"/api/dropbox/refresh", `{"refresh_token":"r"}garbage`},
+		{"/api/dropbox/exchange", strings.TrimSuffix(exchangeBody(s, "c", ""), "}") + `,"extra":1}`},
+	} {
+		w := do(h, "POST", tc.path, contentTypeJSON, tc.body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s %s: status = %d, want 400", tc.path, tc.body, w.Code)
+			continue
+		}
+		if msg := decodeJSON[map[string]string](t, w)["error"]; msg == "" {
+			t.Errorf("%s %s: no error message", tc.path, tc.body)
+		}
+	}
+	if w := do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"r","extra":1}`); !strings.Contains(w.Body.String(), "extra") {
+		t.Errorf("unknown field not named: %s", w.Body)
+	}
+	if n := stub.calls.Load(); n != 0 {
+		t.Errorf("dropbox called %d times", n)
+	}
+}
+
+func TestForwardedUpstreamHeaders(t *testing.T) {
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "30")
+		w.Header().Set("X-Dropbox-Request-Id", "req-1")
+		w.Header().Set("Set-Cookie", "upstream=1")
+		w.WriteHeader(http.StatusTooManyRequests)
+		io.WriteString(w, `{"error":"too_many_requests"}`)
+	})
+	_, h := newTestServer(t, testConfig(t, stub.URL, "DROPBOX_MAX_ATTEMPTS", "1"))
+
+	w := do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"r"}`)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want Dropbox's 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %q, want 30", got)
+	}
+	if got := w.Header().Get("X-Dropbox-Request-Id"); got != "req-1" {
+		t.Errorf("X-Dropbox-Request-Id = %q", got)
+	}
+	if got := w.Header().Get("Set-Cookie"); got != "" {
+		t.Errorf("unlisted Set-Cookie forwarded: %q", got)
+	}
+}
+
+// FORWARDED_HEADERS replaces the default list rather than adding to it.
+func TestCustomForwardedHeaders(t *testing.T) {
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.Header().Set("X-Custom", "kept")
+		w.Header().Set("X-Dropbox-Quota", "42")
+		tokenHandler(w, r)
+	})
+	_, h := newTestServer(t, testConfig(t, stub.URL, "FORWARDED_HEADERS", "x-custom, X-Dropbox-Quota"))
+
+	w := do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"r"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	for name, want := range map[string]string{"X-Custom": "kept", "X-Dropbox-Quota": "42", "Retry-After": ""} {
+		if got := w.Header().Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	for value, want := range map[string]string{
+		"Connection":             "hop-by-hop",
+		"X-Custom, bad header":   "not a valid header name",
+		"Transfer-Encoding,X-Ok": "hop-by-hop",
+	} {
+		t.Setenv("FORWARDED_HEADERS", value)
+		if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("FORWARDED_HEADERS=%q: error %v, want %q", value, err, want)
+		}
+	}
+}
+
+// captureLogs sends the default logger's JSON records to the returned buffer
+// until the test ends.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &buf
+}
+
+// Method dispatch is the mux's: every route answers other methods with 405
+// and its own Allow list.
+func TestRouteMethods(t *testing.T) {
+	_, h := newTestServer(t, testConfig(t, "http://dropbox.invalid"))
+
+	for _, tc := range []struct{ method, path, allow string }{
+		{"POST", "/api/pkce", "GET, HEAD"},
+		{"DELETE", "/api/dropbox/state", "GET, HEAD"},
+		{"GET", "/api/dropbox/revoke", "POST"},
+		{"PATCH", "/api/dropbox/refresh/batch", "POST"},
+	} {
+		w := do(h, tc.method, tc.path, "", "")
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != tc.allow {
+			t.Errorf("%s %s: status %d, Allow %q; want 405, %q", tc.method, tc.path, w.Code, w.Header().Get("Allow"), tc.allow)
+		}
+	}
+	if w := do(h, "GET", "/api/dropbox/state", "", ""); w.Code != http.StatusOK {
+		t.Errorf("GET /api/dropbox/state: status %d", w.Code)
+	}
+}
+
+func TestNotFoundJSON(t *testing.T) {
+	_, h := newTestServer(t, testConfig(t, "http://dropbox.invalid", "ALLOWED_ORIGINS", "https://app.example"))
+
+	r := httptest.NewRequest("GET", "/nonexistent", nil)
+	r.Header.Set("Origin", "https://app.example")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != contentTypeJSON {
+		t.Fatalf("status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	body := decodeJSON[map[string]string](t, w)
+	if len(body) != 2 || body["code"] != errCodeNotFound || body["error"] == "" {
+		t.Errorf("body = %v, want the code and error envelope", body)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example" {
+		t.Errorf("Access-Control-Allow-Origin = %q", got)
+	}
+}
+
+func TestDropboxRequestIDLogged(t *testing.T) {
+	logs := captureLogs(t)
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Dropbox-Request-Id", "dbx-42")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error":"invalid_grant"}`)
+	})
+	_, h := newTestServer(t, testConfig(t, stub.URL))
+
+	r := httptest.NewRequest("POST", "/api/dropbox/refresh", strings.NewReader(`{"refresh_token":"r"}`))
+	r.Header.Set("Content-Type", contentTypeJSON)
+	r.Header.Set(requestIDHeader, "ours-1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if got := w.Header().Get("X-Dropbox-Request-Id"); got != "dbx-42" {
+		t.Errorf("X-Dropbox-Request-Id = %q", got)
+	}
+	found := false
+	for line := range strings.Lines(logs.String()) {
+		if strings.Contains(line, `"dropbox_request_id":"dbx-42"`) && strings.Contains(line, `"request_id":"ours-1"`) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("no log line pairs our request ID with Dropbox's:\n%s", logs)
+	}
+}
+
+// The logged and recorded upstream duration covers the whole Dropbox call,
+// so a stub that takes 50ms shows up as at least that.
+func TestDropboxDurationRecorded(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	logs := captureLogs(t)
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		tokenHandler(w, r)
+	})
+	s, h := newTestServer(t, testConfig(t, stub.URL, "METRICS_ENABLED", "true"))
+
+	if w := do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"r"}`); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+
+	var logged struct {
+		Msg        string `json:"msg"`
+		Op         string `json:"op"`
+		Status     int    `json:"status"`
+		DurationMS int64  `json:"duration_ms"`
+	}
+	for line := range strings.Lines(logs.String()) {
+		if strings.Contains(line, `"msg":"dropbox responded"`) {
+			json.Unmarshal([]byte(line), &logged)
+		}
+	}
+	if logged.Op != "token" || logged.Status != http.StatusOK || logged.DurationMS < delay.Milliseconds() {
+		t.Errorf("logged op %q, status %d, duration_ms %d; want token, 200, >= %d\n%s", logged.Op, logged.Status, logged.DurationMS, delay.Milliseconds(), logs)
+	}
+
+	s.metrics.mu.Lock()
+	hist := s.metrics.upstreamDurations["token"]
+	s.metrics.mu.Unlock()
+	if hist == nil || hist.total != 1 || hist.sum < delay.Seconds() {
+		t.Errorf("upstream duration histogram = %+v, want one observation >= %v", hist, delay)
+	}
+}
+
+func TestRefreshBodyEncodings(t *testing.T) {
+	stub, grant := grantRecorder(t)
+	_, h := newTestServer(t, testConfig(t, stub.URL, "RATE_LIMIT_BURST", "100"))
+
+	for _, tc := range []struct{ contentType, body string }{
+		{contentTypeForm, "refresh_token=abc"},
+		{contentTypeJSON, `{"refresh_token":"abc"}`},
+		{"application/json; charset=utf-8", `{"refresh_token":"abc"}`},
+		{"", `{"refresh_token":"abc"}`},
+	} {
+		// The token cache is off, so every repeat reaches Dropbox.
+		*grant = nil
+		w := do(h, "POST", "/api/dropbox/refresh", tc.contentType, tc.body)
+		if w.Code != http.StatusOK {
+			t.Errorf("%q: status = %d, body %s", tc.contentType, w.Code, w.Body)
+			continue
+		}
+		if got := decodeJSON[DropboxTokenResponse](t, w); got.AccessToken != "sl.access" {
+			t.Errorf("%q: access_token = %q", tc.contentType, got.AccessToken)
+		}
+		if grant.Get("grant_type") != "refresh_token" || grant.Get("refresh_token") != "abc" || grant.Get("client_secret") != "client-secret" {
+			t.Errorf("%q: upstream grant = %v", tc.contentType, *grant)
+		}
+	}
+}
+
+func TestExchangeFormBody(t *testing.T) {
+	stub, grant := grantRecorder(t)
+	s, h := newTestServer(t, testConfig(t, stub.URL))
+
+	form := url.Values{"code": {"form-code"}, "state": {s.newState(context.Background(), s.clock.Now())}}
+	w := do(h, "POST", "/api/dropbox/exchange", contentTypeForm, form.Encode())
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	if grant.Get("code") != "form-code" || grant.Get("grant_type") != "authorization_code" {
+		t.Errorf("upstream grant = %v", *grant)
+	}
+
+	form.Set("extra", "1")
+	if w := do(h, "POST", "/api/dropbox/exchange", contentTypeForm, form.Encode()); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown form field: status = %d, want 400", w.Code)
+	}
+}
+
+func TestUnsupportedMediaType(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	_, h := newTestServer(t, testConfig(t, stub.URL))
+
+	for _, contentType := range []string{"text/plain", "multipart/form-data; boundary=x", "application/xml"} {
+		w := do(h, "POST", "/api/dropbox/refresh", contentType, `{"refresh_token":"abc"}`)
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("%q: status = %d, want 415", contentType, w.Code)
+		}
+	}
+	if n := stub.calls.Load(); n != 0 {
+		t.Errorf("dropbox called %d times", n)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+
+	for _, tc := range []struct {
+		name        string
+		api         string
+		env         []string
+		method      string
+		path        string
+		contentType string
+		body        string
+		status      int
+		code        string
+	}{
+		{"missing code", stub.URL, nil, "POST", "/api/dropbox/exchange", contentTypeJSON, `{"state":"s"}`, 400, errCodeInvalidRequest},
+		{"bad state", stub.URL, nil, "POST", "/api/dropbox/exchange", contentTypeJSON, `{"code":"c","state":"forged"}`, 400, errCodeInvalidState},
+		{"no sessions", stub.URL, nil, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"session_id":"s"}`, 400, errCodeInvalidRequest},
+		{"too large", stub.URL, []string{"MAX_BODY_BYTES", "16"}, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"0123456789"}`, 413, errCodeRequestTooLarge},
+		{"media type", stub.URL, nil, "POST", "/api/dropbox/refresh", "text/plain", `r`, 415, errCodeUnsupportedMediaType},
+		{"api key", stub.URL, []string{"PROXY_API_KEY", "k"}, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"r"}`, 401, errCodeUnauthorized},
+		{"admin without key", stub.URL, nil, "GET", "/admin/config", "", "", 403, errCodeForbidden},
+		{"unknown path", stub.URL, nil, "GET", "/nonexistent", "", "", 404, errCodeNotFound},
+		{"unknown provider", stub.URL, nil, "POST", "/api/nope/refresh", contentTypeJSON, `{"refresh_token":"r"}`, 404, errCodeUnknownProvider},
+		{"method", stub.URL, nil, "GET", "/api/dropbox/refresh", "", "", 405, errCodeMethodNotAllowed},
+		{"unreachable", gone.URL, []string{"DROPBOX_MAX_ATTEMPTS", "1"}, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"r"}`, 502, errCodeUpstreamError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, h := newTestServer(t, testConfig(t, tc.api, tc.env...))
+			w := do(h, tc.method, tc.path, tc.contentType, tc.body)
+			if w.Code != tc.status {
+				t.Errorf("status = %d, want %d; body %s", w.Code, tc.status, w.Body)
+			}
+			if got := decodeJSON[map[string]string](t, w)["code"]; got != tc.code {
+				t.Errorf("code = %q, want %q", got, tc.code)
+			}
+		})
+	}
+}
+
+func TestErrorCodeRateLimited(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	_, h := newTestServer(t, testConfig(t, stub.URL, "RATE_LIMIT_RPS", "0.001", "RATE_LIMIT_BURST", "1"))
+
+	do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"r"}`)
+	w := do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"r"}`)
+	if got := decodeJSON[map[string]string](t, w)["code"]; w.Code != http.StatusTooManyRequests || got != errCodeRateLimited {
+		t.Errorf("status %d, code %q", w.Code, got)
+	}
+}
+
+func TestErrorCodeInvalidSession(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	public, _ := newServer(testConfig(t, stub.URL), http.DefaultClient, newMemoryStore(), nil, nil).routes()
+
+	w := do(public, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"session_id":"unknown"}`)
+	if got := decodeJSON[map[string]string](t, w)["code"]; w.Code != http.StatusUnauthorized || got != errCodeInvalidSession {
+		t.Errorf("status %d, code %q", w.Code, got)
+	}
+}
+
+func TestGrantValueValidation(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	s, h := newTestServer(t, testConfig(t, stub.URL, "RATE_LIMIT_BURST", "100"))
+	state := s.newState(context.Background(), s.clock.Now())
+
+	for name, value := range map[string]string{
+		"empty":     "",
+		"oversized": strings.Repeat("a", maxGrantValueLength+1),
+		"space":     "abc def",
+		"control":   "abc\x07",
+		"non-ascii": "abcé",
+	} {
+		refresh, _ := json.Marshal(map[string]string{"refresh_token": value})
+		if w := do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, string(refresh)); w.Code != http.StatusBadRequest {
+			t.Errorf("refresh_token %s: status %d, want 400", name, w.Code)
+		}
+		exchange, _ := json.Marshal(map[string]string{"code": value, "state": state})
+		if w := do(h, "POST", "/api/dropbox/exchange", contentTypeJSON, string(exchange)); w.Code != http.StatusBadRequest {
+			t.Errorf("code %s: status %d, want 400", name, w.Code)
+		}
+	}
+	if n := stub.calls.Load(); n != 0 {
+		t.Errorf("dropbox called %d times for invalid values", n)
+	}
+
+	longest := strings.Repeat("a", maxGrantValueLength)
+	if w := do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"`+longest+`"}`); w.Code != http.StatusOK {
+		t.Errorf("refresh_token at the limit: status %d", w.Code)
+	}
+}
+
+func TestExchangeTokenAccessType(t *testing.T) {
+	stub, grant := grantRecorder(t)
+	s, h := newTestServer(t, testConfig(t, stub.URL, "RATE_LIMIT_BURST", "100"))
+
+	for i, tc := range []struct{ field, want string }{
+		{"", "offline"},
+		{`,"token_access_type":"online"`, "online"},
+		{`,"token_access_type":"legacy"`, "legacy"},
+	} {
+		w := do(h, "POST", "/api/dropbox/exchange", contentTypeJSON, exchangeBody(s, fmt.Sprintf("code-%d", i), tc.field))
+		if w.Code != http.StatusOK || grant.Get("token_access_type") != tc.want {
+			t.Errorf("%q: status %d, token_access_type %q; want %q", tc.field, w.Code, grant.Get("token_access_type"), tc.want)
+		}
+	}
+
+	w := do(h, "POST", "/api/dropbox/exchange", contentTypeJSON, exchangeBody(s, "code-x", `,"token_access_type":"forever"`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown token_access_type: status %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// exchange runs an authorization-code grant. With a TOKEN_STORE the refresh
+// token is kept server-side and the client gets an opaque session_id in its
+// place.
+func (s *server) exchange(w http.ResponseWriter, r *http.Request, provider Provider, data url.Values) *DropboxTokenResponse {
+	if s.store == nil {
+		return s.callDropbox(w, r, provider, data)
+	}
+
+	rec := newCapturedResponse()
+	token := s.callDropbox(rec, r, provider, data)
+	if token == nil || token.RefreshToken == "" {
+		rec.replay(w)
+		return token
+	}
+	return s.writeSessionToken(w, r, rec.header, newSessionID(), provider, "", token)
+}
+
+// session looks up a stored session for provider, answering 401 itself when
+// there is none.
+func (s *server) session(w http.ResponseWriter, r *http.Request, provider Provider, sessionID string) (StoredToken, bool) {
+	if s.store == nil {
+		writeError(w, r, errCodeInvalidRequest, "sessions are not enabled", http.StatusBadRequest)
+		return StoredToken{}, false
+	}
+
+	stored, err := s.store.Get(r.Context(), sessionID)
+	if errors.Is(err, errSessionNotFound) || (err == nil && stored.Provider != provider.Name) {
+		writeError(w, r, errCodeInvalidSession, "unknown or expired session", http.StatusUnauthorized)
+		return StoredToken{}, false
+	}
+	if err != nil {
+		logger(r.Context()).Error("failed to load session", "error", err)
+		writeError(w, r, errCodeInternal, "failed to load session", http.StatusInternalServerError)
+		return StoredToken{}, false
+	}
+	return stored, true
+}
+
+// writeSessionToken stores token's refresh token under sessionID, unless it
+// is unchanged from previous, and writes token to w with the refresh token
+// swapped for the session ID. header holds the upstream headers to relay.
+func (s *server) writeSessionToken(w http.ResponseWriter, r *http.Request, header http.Header, sessionID string, provider Provider, previous string, token *DropboxTokenResponse) *DropboxTokenResponse {
+	if token.RefreshToken != "" && token.RefreshToken != previous {
+		err := s.store.Save(r.Context(), sessionID, StoredToken{
+			Provider:     provider.Name,
+			RefreshToken: token.RefreshToken,
+			AccountID:    token.AccountID,
+			UpdatedAt:    s.clock.Now(),
+		})
+		if err != nil {
+			logger(r.Context()).Error("failed to save session", "error", err)
+			writeError(w, r, errCodeInternal, "failed to save session", http.StatusInternalServerError)
+			return nil
+		}
+	}
+
+	out := *token
+	out.RefreshToken = ""
+	out.SessionID = sessionID
+
+	for key, values := range header {
+		if key != "Content-Type" && key != "Cache-Control" {
+			w.Header()[key] = values
+		}
+	}
+	writeToken(w, &out)
+	return &out
+}
+
+// endSession deletes a stored session, answering the error itself.
+func (s *server) endSession(w http.ResponseWriter, r *http.Request, sessionID string) bool {
+	if s.store == nil {
+		writeError(w, r, errCodeInvalidRequest, "sessions are not enabled", http.StatusBadRequest)
+		return false
+	}
+	if err := s.store.Delete(r.Context(), sessionID); err != nil {
+		logger(r.Context()).Error("failed to delete session", "error", err)
+		writeError(w, r, errCodeInternal, "failed to delete session", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
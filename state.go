@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const stateNonceSize = 16
+
+var (
+	errStateMissing   = errors.New("state missing")
+	errStateMalformed = errors.New("state malformed")
+	errStateSignature = errors.New("state signature mismatch")
+	errStateExpired   = errors.New("state expired")
+)
+
+// newState returns "<payload>.<mac>" where payload is a random nonce followed
+// by the issue time in unix seconds, both base64url encoded.
+func (s *server) newState(ctx context.Context, now time.Time) string {
+	payload := make([]byte, stateNonceSize+8)
+	rand.Read(payload[:stateNonceSize])
+	binary.BigEndian.PutUint64(payload[stateNonceSize:], uint64(now.Unix()))
+
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(s.signState(ctx, payload))
+}
+
+func (s *server) verifyState(ctx context.Context, state string, now time.Time) error {
+	if state == "" {
+		return errStateMissing
+	}
+
+	encodedPayload, encodedMAC, ok := strings.Cut(state, ".")
+	if !ok {
+		return errStateMalformed
+	}
+
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(encodedPayload)
+	if err != nil || len(payload) != stateNonceSize+8 {
+		return errStateMalformed
+	}
+
+	mac, err := enc.DecodeString(encodedMAC)
+	if err != nil {
+		return errStateMalformed
+	}
+
+	if !hmac.Equal(mac, s.signState(ctx, payload)) {
+		return errStateSignature
+	}
+
+	issued := time.Unix(int64(binary.BigEndian.Uint64(payload[stateNonceSize:])), 0)
+	if now.Sub(issued) > s.config(ctx).StateTTL || issued.After(now.Add(time.Minute)) {
+		return errStateExpired
+	}
+
+	return nil
+}
+
+func (s *server) signState(ctx context.Context, payload []byte) []byte {
+	h := hmac.New(sha256.New, s.config(ctx).StateSecret)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+func (s *server) stateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{
+		"state": s.newState(r.Context(), s.clock.Now()),
+	})
+}
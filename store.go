@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var errSessionNotFound = errors.New("session not found")
+
+// StoredToken is what a session holds in place of the browser: the refresh
+// token and enough context to use it.
+type StoredToken struct {
+	Provider     string
+	RefreshToken string
+	AccountID    string
+	UpdatedAt    time.Time
+}
+
+// TokenStore persists refresh tokens server-side, keyed by the opaque session
+// ID handed to the client instead. Get returns errSessionNotFound for unknown
+// IDs; Delete of an unknown ID is not an error.
+type TokenStore interface {
+	Save(ctx context.Context, sessionID string, token StoredToken) error
+	Get(ctx context.Context, sessionID string) (StoredToken, error)
+	Delete(ctx context.Context, sessionID string) error
+}
+
+// openTokenStore builds the store named by TOKEN_STORE, or returns nil when
+// sessions are disabled.
+func openTokenStore(cfg Config) (TokenStore, error) {
+	switch cfg.TokenStore {
+	case "":
+		return nil, nil
+	case "memory":
+		return newMemoryStore(), nil
+	case "sqlite":
+		return openSQLiteStore(cfg.TokenStorePath)
+	default:
+		return nil, fmt.Errorf("unknown token store %q", cfg.TokenStore)
+	}
+}
+
+func newSessionID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// memoryStore keeps sessions for the life of the process. It suits a single
+// instance that can afford to sign everyone out on restart.
+type memoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]StoredToken
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{sessions: make(map[string]StoredToken)}
+}
+
+func (m *memoryStore) Save(ctx context.Context, sessionID string, token StoredToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[sessionID] = token
+	return nil
+}
+
+func (m *memoryStore) Get(ctx context.Context, sessionID string) (StoredToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.sessions[sessionID]
+	if !ok {
+		return StoredToken{}, errSessionNotFound
+	}
+	return token, nil
+}
+
+func (m *memoryStore) Delete(ctx context.Context, sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, sessionID)
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations are applied in order, each exactly once; append new ones,
+// never edit old ones.
+var sqliteMigrations = []string{
+	`CREATE TABLE sessions (
+		id            TEXT PRIMARY KEY,
+		provider      TEXT NOT NULL,
+		refresh_token TEXT NOT NULL,
+		account_id    TEXT NOT NULL DEFAULT '',
+		updated_at    INTEGER NOT NULL
+	)`,
+}
+
+// sqliteStore keeps sessions in a local SQLite database so they survive
+// restarts.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time; a single connection turns
+	// contention into queueing instead of SQLITE_BUSY errors.
+	db.SetMaxOpenConns(1)
+
+	if err := migrateSQLite(context.Background(), db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating %s: %w", path, err)
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func migrateSQLite(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+
+	var applied int
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&applied); err != nil {
+		return err
+	}
+
+	for version := applied + 1; version <= len(sqliteMigrations); version++ {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, sqliteMigrations[version-1]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES (?)`, version); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) Save(ctx context.Context, sessionID string, token StoredToken) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO sessions (id, provider, refresh_token, account_id, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			provider = excluded.provider,
+			refresh_token = excluded.refresh_token,
+			account_id = excluded.account_id,
+			updated_at = excluded.updated_at`,
+		sessionID, token.Provider, token.RefreshToken, token.AccountID, token.UpdatedAt.Unix(),
+	)
+	return err
+}
+
+func (s *sqliteStore) Get(ctx context.Context, sessionID string) (StoredToken, error) {
+	var token StoredToken
+	var updated int64
+	err := s.db.QueryRowContext(ctx,
+		`SELECT provider, refresh_token, account_id, updated_at FROM sessions WHERE id = ?`, sessionID,
+	).Scan(&token.Provider, &token.RefreshToken, &token.AccountID, &updated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return StoredToken{}, errSessionNotFound
+	}
+	if err != nil {
+		return StoredToken{}, err
+	}
+	token.UpdatedAt = time.Unix(updated, 0)
+	return token, nil
+}
+
+func (s *sqliteStore) Delete(ctx context.Context, sessionID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE id = ?`, sessionID)
+	return err
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testTokenStore checks the TokenStore contract every backend must meet.
+func testTokenStore(t *testing.T, store TokenStore) {
+	ctx := context.Background()
+	if _, err := store.Get(ctx, "missing"); !errors.Is(err, errSessionNotFound) {
+		t.Errorf("Get of an unknown session: %v, want errSessionNotFound", err)
+	}
+
+	want := StoredToken{Provider: "dropbox", RefreshToken: "r1", AccountID: "dbid:1", UpdatedAt: time.Unix(1700000000, 0)}
+	if err := store.Save(ctx, "s1", want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Get(ctx, "s1")
+	if err != nil || got.Provider != want.Provider || got.RefreshToken != want.RefreshToken || got.AccountID != want.AccountID || !got.UpdatedAt.Equal(want.UpdatedAt) {
+		t.Errorf("Get = %+v, %v; want %+v", got, err, want)
+	}
+
+	want.RefreshToken = "r2"
+	if err := store.Save(ctx, "s1", want); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.Get(ctx, "s1"); got.RefreshToken != "r2" {
+		t.Errorf("after overwrite, refresh token = %q", got.RefreshToken)
+	}
+
+	if err := store.Delete(ctx, "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "s1"); !errors.Is(err, errSessionNotFound) {
+		t.Errorf("Get after Delete: %v", err)
+	}
+	if err := store.Delete(ctx, "s1"); err != nil {
+		t.Errorf("Delete of an unknown session: %v", err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testTokenStore(t, newMemoryStore())
+}
+
+func TestSQLiteStore(t *testing.T) {
+	store, err := openSQLiteStore(filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	testTokenStore(t, store)
+}
+
+// Reopening applies no migration twice and keeps the sessions.
+func TestSQLiteStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	ctx := context.Background()
+
+	store, err := openSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Save(ctx, "s1", StoredToken{Provider: "dropbox", RefreshToken: "r1"})
+	store.Close()
+
+	store, err = openSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+	if got, err := store.Get(ctx, "s1"); err != nil || got.RefreshToken != "r1" {
+		t.Errorf("after reopen: %+v, %v", got, err)
+	}
+	var version int
+	store.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+	if version != len(sqliteMigrations) {
+		t.Errorf("schema version %d, want %d", version, len(sqliteMigrations))
+	}
+}
+
+// With a store the browser only ever sees a session ID, and refreshes by it.
+func TestSessionFlow(t *testing.T) {
+	stub, grant := grantRecorder(t)
+	store := newMemoryStore()
+	s := newServer(testConfig(t, stub.URL), http.DefaultClient, store, nil, nil)
+	h, _ := s.routes()
+
+	w := do(h, "POST", "/api/dropbox/exchange", contentTypeJSON, exchangeBody(s, "c", ""))
+	token := decodeJSON[DropboxTokenResponse](t, w)
+	if token.SessionID == "" || token.RefreshToken != "" {
+		t.Fatalf("exchange returned session %q, refresh token %q", token.SessionID, token.RefreshToken)
+	}
+	if stored, err := store.Get(context.Background(), token.SessionID); err != nil || stored.RefreshToken != "refresh" {
+		t.Fatalf("stored session = %+v, %v", stored, err)
+	}
+
+	w = do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"session_id":"`+token.SessionID+`"}`)
+	if w.Code != http.StatusOK || grant.Get("refresh_token") != "refresh" {
+		t.Errorf("refresh by session: status %d, upstream refresh_token %q", w.Code, grant.Get("refresh_token"))
+	}
+}
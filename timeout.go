@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// withTimeout gives every request REQUEST_TIMEOUT to finish. The deadline
+// travels in the request context, so the upstream call is cancelled with it
+// and writeUpstreamError answers 504 rather than 502. Shared refreshes keep
+// running for the other callers and the cache. A zero timeout disables it.
+func (s *server) withTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := s.config(r.Context()).RequestTimeout
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		inner := r.WithContext(ctx)
+		next.ServeHTTP(w, inner)
+		// The mux records the matched route on the copy it was given;
+		// withMetrics and withTracing read it from r.
+		r.Pattern = inner.Pattern
+	})
+}
+
+// statusClientClosedRequest is nginx's status for a client that disconnected
+// before the response. It is written like any other status, but with the
+// connection gone it rarely reaches anyone; what it reliably does is mark the
+// request in the access log, metrics and audit records.
+const statusClientClosedRequest = 499
+
+// writeUpstreamError reports a failed Dropbox call: 504 if the request ran
+// out of time, 502 otherwise. If the client has gone away there is no one to
+// answer, so only the status is recorded.
+func writeUpstreamError(w http.ResponseWriter, r *http.Request, message string) {
+	if errors.Is(r.Context().Err(), context.Canceled) {
+		logger(r.Context()).Info("client canceled", "path", r.URL.Path)
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	}
+	if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		logger(r.Context()).Warn("request timed out", "path", r.URL.Path)
+		writeError(w, r, errCodeTimeout, "request timed out", http.StatusGatewayTimeout)
+		return
+	}
+	writeError(w, r, errCodeUpstreamError, message, http.StatusBadGateway)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A browser that navigates away mid-exchange is recorded as 499, and
+// Dropbox isn't blamed for it.
+func TestClientCanceledMidFlight(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+		<-release
+	})
+	defer close(release)
+	s, h := newTestServer(t, testConfig(t, stub.URL, "METRICS_ENABLED", "true"))
+
+	r := httptest.NewRequest("POST", "/api/dropbox/refresh", strings.NewReader(`{"refresh_token":"r"}`)).WithContext(ctx)
+	r.Header.Set("Content-Type", contentTypeJSON)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != statusClientClosedRequest || w.Body.Len() != 0 {
+		t.Errorf("status %d, body %q; want a bare 499", w.Code, w.Body)
+	}
+	s.metrics.mu.Lock()
+	defer s.metrics.mu.Unlock()
+	if n := len(s.metrics.upstreamErrors) + len(s.metrics.upstreamFailures); n != 0 {
+		t.Errorf("cancellation counted as %d dropbox failures", n)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	defer close(release)
+	_, h := newTestServer(t, testConfig(t, stub.URL, "REQUEST_TIMEOUT", "50ms", "DROPBOX_MAX_ATTEMPTS", "1"))
+
+	for _, tc := range []struct{ method, path, body string }{
+		{"POST", "/api/dropbox/refresh", `{"refresh_token":"r"}`},
+		{"POST", "/api/dropbox/revoke", `{"access_token":"t"}`},
+	} {
+		start := time.Now()
+		w := do(h, tc.method, tc.path, contentTypeJSON, tc.body)
+		if w.Code != http.StatusGatewayTimeout {
+			t.Errorf("%s: status %d, want 504", tc.path, w.Code)
+		}
+		if got := decodeJSON[map[string]string](t, w)["code"]; got != errCodeTimeout {
+			t.Errorf("%s: code %q", tc.path, got)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: answered after %v, long past REQUEST_TIMEOUT", tc.path, elapsed)
+		}
+	}
+}
+
+// The mux records the matched route on the request withTimeout hands it;
+// metrics and tracing, outside withTimeout, must still see it under the
+// default REQUEST_TIMEOUT.
+func TestRoutePatternSurvivesTimeout(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	cfg := testConfig(t, stub.URL, "METRICS_ENABLED", "true", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "http://collector.invalid")
+	if cfg.RequestTimeout <= 0 {
+		t.Fatalf("default REQUEST_TIMEOUT = %v, want the timeout in the chain", cfg.RequestTimeout)
+	}
+	s, h := newTestServer(t, cfg)
+
+	if w := do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"r"}`); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+
+	const route = "POST /api/{provider}/refresh"
+	s.metrics.mu.Lock()
+	count := s.metrics.requests[requestKey{route, http.StatusOK}]
+	s.metrics.mu.Unlock()
+	if count != 1 {
+		t.Errorf("requests{endpoint=%q} = %d, want 1", route, count)
+	}
+
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	var server *span
+	for _, sp := range s.tracer.queue {
+		if sp.kind == spanKindServer {
+			server = sp
+		}
+	}
+	if server == nil || server.name != route || server.attrs["http.route"] != route {
+		t.Errorf("server span = %+v, want it named for %s", server, route)
+	}
+}
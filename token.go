@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// DropboxTokenResponse is the normalized body returned for successful
+// exchanges and refreshes. Unknown upstream fields are dropped so clients see
+// the same shape whatever the provider adds. id_token is kept for OpenID
+// Connect providers.
+type DropboxTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	AccountID    string `json:"account_id,omitempty"`
+	UID          string `json:"uid,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+
+	// ExpiresAt is computed here from ExpiresIn so clients don't have to do
+	// clock arithmetic themselves.
+	ExpiresAt string `json:"expires_at,omitempty"`
+
+	// SessionID replaces RefreshToken when a TOKEN_STORE keeps refresh
+	// tokens server-side.
+	SessionID string `json:"session_id,omitempty"`
+}
+
+// writeTokenResponse normalizes a successful upstream token response and
+// writes it to w. It returns the token, or nil if the upstream body was
+// unusable and an error was written instead.
+func writeTokenResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, body io.Reader, log *slog.Logger, now time.Time) *DropboxTokenResponse {
+	var token DropboxTokenResponse
+	if err := json.NewDecoder(body).Decode(&token); err != nil {
+		log.Error("failed to decode token response", "error", err)
+		writeError(w, r, errCodeUpstreamError, "unexpected response from dropbox", http.StatusBadGateway)
+		return nil
+	}
+
+	token.SessionID = ""
+	if token.AccessToken == "" {
+		log.Error("token response has no access_token")
+		writeError(w, r, errCodeUpstreamError, "unexpected response from dropbox", http.StatusBadGateway)
+		return nil
+	}
+
+	if token.ExpiresIn > 0 {
+		expiresAt := now.UTC().Add(time.Duration(token.ExpiresIn) * time.Second)
+		token.ExpiresAt = expiresAt.Format(time.RFC3339)
+	}
+
+	writeToken(w, &token)
+	return &token
+}
+
+// oauthError is the envelope for a token grant that didn't produce a token.
+// A 4xx status means Dropbox rejected the grant itself (invalid_grant and
+// friends), so the user has to sign in again; a 5xx means Dropbox or the path
+// to it failed and the same request may succeed later.
+type oauthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+	UpstreamStatus   int    `json:"upstream_status"`
+}
+
+// writeOAuthError re-emits a failed Dropbox token response as an oauthError.
+// Dropbox 4xx statuses are kept; anything else becomes a 502.
+func writeOAuthError(w http.ResponseWriter, resp *http.Response, body io.Reader, log *slog.Logger) {
+	var upstream oauthError
+	if err := json.NewDecoder(body).Decode(&upstream); err != nil && err != io.EOF {
+		log.Warn("failed to decode dropbox error response", "error", err)
+	}
+	upstream.UpstreamStatus = resp.StatusCode
+
+	status := resp.StatusCode
+	if status < 400 || status >= 500 {
+		status = http.StatusBadGateway
+		if upstream.Error == "" {
+			upstream.Error = "server_error"
+		}
+	} else if upstream.Error == "" {
+		upstream.Error = "invalid_request"
+	}
+	log.Info("token grant failed", "oauth_error", upstream.Error, "upstream_status", resp.StatusCode)
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(upstream)
+}
+
+func writeToken(w http.ResponseWriter, token *DropboxTokenResponse) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(token)
+}
+
+type cachedToken struct {
+	token   DropboxTokenResponse
+	expires time.Time
+}
+
+// tokenCache holds refreshed tokens: a ttlCache in process, or
+// redisTokenCache when REDIS_URL is set.
+type tokenCache interface {
+	get(key string) (cachedToken, bool)
+	set(key string, value cachedToken, ttl time.Duration)
+}
+
+// cachedRefresh answers a refresh from the token cache. expires_in is
+// rewritten to the time actually left on the cached access token.
+func (s *server) cachedRefresh(w http.ResponseWriter, r *http.Request, key string) *DropboxTokenResponse {
+	if s.tokens == nil {
+		return nil
+	}
+
+	cached, ok := s.tokens.get(key)
+	if !ok {
+		return nil
+	}
+
+	token := cached.token
+	if token.ExpiresIn > 0 {
+		token.ExpiresIn = int64(cached.expires.Sub(s.clock.Now()).Seconds())
+	}
+
+	logger(r.Context()).Debug("served refresh from token cache")
+	writeToken(w, &token)
+	return &token
+}
+
+// cacheRefresh keeps token until TOKEN_CACHE_TTL passes or it gets within
+// TOKEN_CACHE_MARGIN of expiring, whichever is sooner.
+func (s *server) cacheRefresh(ctx context.Context, key string, token *DropboxTokenResponse) {
+	if s.tokens == nil || token == nil {
+		return
+	}
+
+	cfg := s.config(ctx)
+	ttl := cfg.TokenCacheTTL
+	expires := s.clock.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	if token.ExpiresIn > 0 {
+		ttl = min(ttl, time.Duration(token.ExpiresIn)*time.Second-cfg.TokenCacheMargin)
+	}
+
+	s.tokens.set(key, cachedToken{token: *token, expires: expires}, ttl)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenExpiresAt(t *testing.T) {
+	stub := newStubDropbox(t, tokenHandler)
+	_, h := newTestServer(t, testConfig(t, stub.URL))
+
+	before := time.Now().Truncate(time.Second)
+	w := do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"r"}`)
+	after := time.Now()
+
+	got := decodeJSON[DropboxTokenResponse](t, w)
+	expiresAt, err := time.Parse(time.RFC3339, got.ExpiresAt)
+	if err != nil {
+		t.Fatalf("expires_at %q: %v", got.ExpiresAt, err)
+	}
+	if lo, hi := before.Add(4*time.Hour), after.Add(4*time.Hour); expiresAt.Before(lo) || expiresAt.After(hi) {
+		t.Errorf("expires_at = %v, want 4h from now, between %v and %v", expiresAt, lo, hi)
+	}
+	if got.ExpiresIn != 14400 || got.RefreshToken != "refresh" || got.AccountID != "dbid:1" {
+		t.Errorf("Dropbox's fields lost in re-encoding: %+v", got)
+	}
+}
+
+func TestTokenWithoutExpiry(t *testing.T) {
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"access_token":"sl.legacy","token_type":"bearer"}`)
+	})
+	_, h := newTestServer(t, testConfig(t, stub.URL))
+
+	w := do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"r"}`)
+	if got := decodeJSON[map[string]any](t, w); got["expires_at"] != nil {
+		t.Errorf("expires_at = %v for a token that doesn't expire", got["expires_at"])
+	}
+}
+
+// Dropbox has no request that turns a legacy long-lived token into a
+// short-lived one, so a legacy install migrates by authorizing again with
+// offline access and refreshing from then on.
+func TestLegacyTokenReauthorization(t *testing.T) {
+	var grants []string
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		grants = append(grants, r.PostForm.Get("grant_type")+" "+r.PostForm.Get("token_access_type")+r.PostForm.Get("refresh_token"))
+		w.Header().Set("Content-Type", "application/json")
+		if r.PostForm.Get("grant_type") == "refresh_token" {
+			io.WriteString(w, `{"access_token":"sl.second","token_type":"bearer","expires_in":14400}`)
+			return
+		}
+		io.WriteString(w, `{"access_token":"sl.first","token_type":"bearer","expires_in":14400,"refresh_token":"long-lived-refresh","account_id":"dbid:1","uid":"1"}`)
+	})
+	s, h := newTestServer(t, testConfig(t, stub.URL))
+
+	w := do(h, "POST", "/api/dropbox/exchange", contentTypeJSON, exchangeBody(s, "reauth-code", `,"token_access_type":"offline"`))
+	token := decodeJSON[DropboxTokenResponse](t, w)
+	if w.Code != http.StatusOK || token.AccessToken != "sl.first" || token.RefreshToken != "long-lived-refresh" || token.ExpiresAt == "" {
+		t.Fatalf("exchange: status %d, token %+v", w.Code, token)
+	}
+
+	w = do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"`+token.RefreshToken+`"}`)
+	if refreshed := decodeJSON[DropboxTokenResponse](t, w); w.Code != http.StatusOK || refreshed.AccessToken != "sl.second" || refreshed.ExpiresAt == "" {
+		t.Errorf("refresh: status %d, token %+v", w.Code, refreshed)
+	}
+	if want := []string{"authorization_code offline", "refresh_token long-lived-refresh"}; !slices.Equal(grants, want) {
+		t.Errorf("grants sent = %q, want %q", grants, want)
+	}
+}
+
+func TestOAuthErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		status         int
+		body           string
+		want           int
+		wantErr        string
+		wantDesc       string
+		upstreamStatus int
+	}{
+		{"invalid grant", 400, `{"error":"invalid_grant","error_description":"refresh token is malformed"}`, 400, "invalid_grant", "refresh token is malformed", 400},
+		{"bare 401", 401, ``, 401, "invalid_request", "", 401},
+		{"server error", 500, `{"error":"temporarily_unavailable"}`, 502, "temporarily_unavailable", "", 500},
+		{"empty 503", 503, ``, 502, "server_error", "", 503},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tc.status)
+				io.WriteString(w, tc.body)
+			})
+			_, h := newTestServer(t, testConfig(t, stub.URL, "DROPBOX_MAX_ATTEMPTS", "1"))
+
+			w := do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"r"}`)
+			if w.Code != tc.want {
+				t.Errorf("status = %d, want %d", w.Code, tc.want)
+			}
+			got := decodeJSON[oauthError](t, w)
+			if got != (oauthError{tc.wantErr, tc.wantDesc, tc.upstreamStatus}) {
+				t.Errorf("envelope = %+v", got)
+			}
+		})
+	}
+}
+
+func TestTokenCache(t *testing.T) {
+	var expiresIn atomic.Int64
+	expiresIn.Store(14400)
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"sl.access","token_type":"bearer","expires_in":%d}`, expiresIn.Load())
+	})
+	_, h, clock := newClockedTestServer(t, testConfig(t, stub.URL,
+		"TOKEN_CACHE_ENABLED", "true", "TOKEN_CACHE_TTL", "10m", "TOKEN_CACHE_MARGIN", "1m", "RATE_LIMIT_BURST", "100"))
+	refresh := func(token string) DropboxTokenResponse {
+		t.Helper()
+		w := do(h, "POST", "/api/dropbox/refresh", contentTypeJSON, `{"refresh_token":"`+token+`"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("refresh: status %d, body %s", w.Code, w.Body)
+		}
+		return decodeJSON[DropboxTokenResponse](t, w)
+	}
+
+	first := refresh("r1")
+	clock.Advance(30 * time.Second)
+	if hit := refresh("r1"); hit.ExpiresIn != 14370 || hit.ExpiresAt != first.ExpiresAt || hit.AccessToken != first.AccessToken {
+		t.Errorf("cache hit = %+v, want expires_in counted down to 14370 and the same expires_at", hit)
+	}
+	if n := stub.calls.Load(); n != 1 {
+		t.Errorf("dropbox called %d times, want the repeat served from cache", n)
+	}
+	refresh("r2")
+	if n := stub.calls.Load(); n != 2 {
+		t.Errorf("another refresh token: %d dropbox calls, want its own", n)
+	}
+
+	clock.Advance(10 * time.Minute)
+	refresh("r1")
+	if n := stub.calls.Load(); n != 3 {
+		t.Errorf("after TOKEN_CACHE_TTL: %d dropbox calls, want 3", n)
+	}
+
+	// A token expiring in 2m is kept only until TOKEN_CACHE_MARGIN before
+	// that, not for the whole TOKEN_CACHE_TTL.
+	expiresIn.Store(120)
+	refresh("short")
+	clock.Advance(30 * time.Second)
+	if hit := refresh("short"); hit.ExpiresIn != 90 || stub.calls.Load() != 4 {
+		t.Errorf("short-lived hit: expires_in %d after %d calls, want 90 from cache", hit.ExpiresIn, stub.calls.Load())
+	}
+	clock.Advance(31 * time.Second)
+	refresh("short")
+	if n := stub.calls.Load(); n != 5 {
+		t.Errorf("past expiry minus margin: %d dropbox calls, want 5", n)
+	}
+}
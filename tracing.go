@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OTLP span kinds and status codes.
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+
+	spanStatusError = 2
+)
+
+// maxQueuedSpans bounds memory when the collector is slow or down; spans
+// beyond it are dropped and counted.
+const maxQueuedSpans = 2048
+
+// tracer records OpenTelemetry spans and exports them to an OTLP/HTTP
+// collector in the JSON encoding, which keeps the SDK and its dependency tree
+// out of the build. Trace context travels in W3C traceparent headers. A nil
+// *tracer is valid and records nothing.
+type tracer struct {
+	client   *http.Client
+	endpoint string
+	service  string
+	headers  http.Header
+
+	mu      sync.Mutex
+	queue   []*span
+	dropped int
+}
+
+func newTracer(endpoint, service string, headers http.Header) *tracer {
+	return &tracer{
+		client:   &http.Client{Timeout: 10 * time.Second},
+		endpoint: endpoint,
+		service:  service,
+		headers:  headers,
+	}
+}
+
+// traceFlagSampled is the W3C trace flag recording the sampling decision.
+const traceFlagSampled = 0x01
+
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	flags   byte
+}
+
+func (sc spanContext) sampled() bool { return sc.flags&traceFlagSampled != 0 }
+
+type span struct {
+	tracer *tracer
+	ctx    spanContext
+	parent [8]byte
+	name   string
+	kind   int
+	start  time.Time
+	finish time.Time
+	attrs  map[string]any
+	err    string
+}
+
+func spanFrom(ctx context.Context) *span {
+	sp, _ := ctx.Value(spanKey).(*span)
+	return sp
+}
+
+// start opens a span that is a child of the span in ctx, or of remote when ctx
+// has none, and inherits its sampling decision. A zero remote starts a new
+// trace, which is sampled.
+func (t *tracer) start(ctx context.Context, name string, kind int, remote spanContext) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	sp := &span{tracer: t, name: name, kind: kind, start: time.Now(), attrs: make(map[string]any)}
+	if parent := spanFrom(ctx); parent != nil {
+		remote = parent.ctx
+	}
+	if remote.traceID != ([16]byte{}) {
+		sp.ctx.traceID = remote.traceID
+		sp.ctx.flags = remote.flags
+		sp.parent = remote.spanID
+	} else {
+		rand.Read(sp.ctx.traceID[:])
+		sp.ctx.flags = traceFlagSampled
+	}
+	rand.Read(sp.ctx.spanID[:])
+
+	return context.WithValue(ctx, spanKey, sp), sp
+}
+
+func (sp *span) set(key string, value any) {
+	if sp != nil {
+		sp.attrs[key] = value
+	}
+}
+
+// fail marks the span as an error. errorType follows the semantic
+// conventions: the status code for HTTP errors, otherwise a short class name.
+func (sp *span) fail(errorType, message string) {
+	if sp != nil {
+		sp.attrs["error.type"] = errorType
+		sp.err = message
+	}
+}
+
+// inject propagates the span, and the trace's flags unchanged, to an
+// outbound request.
+func (sp *span) inject(h http.Header) {
+	if sp != nil {
+		h.Set("traceparent", fmt.Sprintf("00-%x-%x-%02x", sp.ctx.traceID, sp.ctx.spanID, sp.ctx.flags))
+	}
+}
+
+// end queues a sampled span for export. Unsampled spans only carry the trace
+// context along and are dropped here.
+func (sp *span) end() {
+	if sp == nil || !sp.ctx.sampled() {
+		return
+	}
+	sp.finish = time.Now()
+
+	t := sp.tracer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.queue) >= maxQueuedSpans {
+		t.dropped++
+		return
+	}
+	t.queue = append(t.queue, sp)
+}
+
+// parseTraceparent reads a W3C traceparent header, keeping its flags so an
+// unsampled parent stays unsampled. Anything malformed yields the zero
+// spanContext and a fresh trace.
+func parseTraceparent(value string) spanContext {
+	var sc spanContext
+	if len(value) != 55 || value[:3] != "00-" || value[35] != '-' || value[52] != '-' {
+		return sc
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(value[3:35])); err != nil {
+		return spanContext{}
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(value[36:52])); err != nil {
+		return spanContext{}
+	}
+	flags, err := strconv.ParseUint(value[53:], 16, 8)
+	if err != nil || sc.traceID == ([16]byte{}) || sc.spanID == ([8]byte{}) {
+		return spanContext{}
+	}
+	sc.flags = byte(flags)
+	return sc
+}
+
+// withTracing opens the server span for each request, continuing the trace
+// from an incoming traceparent header. It is named after the matched route
+// once routing has run.
+func (t *tracer) withTracing(next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, sp := t.start(r.Context(), "HTTP "+r.Method, spanKindServer, parseTraceparent(r.Header.Get("traceparent")))
+		defer sp.end()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		r = r.WithContext(ctx)
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if r.Pattern != "" && r.Pattern != "/" {
+			sp.name = r.Pattern
+			sp.set("http.route", r.Pattern)
+		}
+		sp.set("http.request.method", r.Method)
+		sp.set("url.path", r.URL.Path)
+		sp.set("http.response.status_code", rec.status)
+		sp.set("request_id", requestIDFrom(ctx))
+		if rec.status >= 500 {
+			sp.fail(strconv.Itoa(rec.status), http.StatusText(rec.status))
+		}
+	})
+}
+
+// run exports queued spans every interval until ctx is cancelled, then makes
+// one last attempt to flush.
+func (t *tracer) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.flush(ctx)
+		case <-ctx.Done():
+			final, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+			t.flush(final)
+			cancel()
+			return
+		}
+	}
+}
+
+func (t *tracer) flush(ctx context.Context) {
+	t.mu.Lock()
+	spans, dropped := t.queue, t.dropped
+	t.queue, t.dropped = nil, 0
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		slog.Warn("dropped trace spans", "count", dropped)
+	}
+	if len(spans) == 0 {
+		return
+	}
+
+	if err := t.export(ctx, spans); err != nil {
+		slog.Warn("failed to export trace spans", "count", len(spans), "error", err)
+	}
+}
+
+func (t *tracer) export(ctx context.Context, spans []*span) error {
+	body, err := json.Marshal(t.encode(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range t.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", contentTypeJSON)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// OTLP/JSON wire types, trimmed to the fields this proxy sets.
+type (
+	otlpExport struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            *otlpStatus     `json:"status,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string         `json:"key"`
+		Value map[string]any `json:"value"`
+	}
+)
+
+func (t *tracer) encode(spans []*span) otlpExport {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, sp := range spans {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(sp.ctx.traceID[:]),
+			SpanID:            hex.EncodeToString(sp.ctx.spanID[:]),
+			Name:              sp.name,
+			Kind:              sp.kind,
+			StartTimeUnixNano: strconv.FormatInt(sp.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(sp.finish.UnixNano(), 10),
+		}
+		if sp.parent != ([8]byte{}) {
+			o.ParentSpanID = hex.EncodeToString(sp.parent[:])
+		}
+		for _, key := range sortedKeys(sp.attrs) {
+			o.Attributes = append(o.Attributes, otlpAttr(key, sp.attrs[key]))
+		}
+		if sp.err != "" {
+			o.Status = &otlpStatus{Code: spanStatusError, Message: sp.err}
+		}
+		out = append(out, o)
+	}
+
+	return otlpExport{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			otlpAttr("service.name", t.service),
+			otlpAttr("service.version", version),
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "todosrv", Version: version},
+			Spans: out,
+		}},
+	}}}
+}
+
+func otlpAttr(key string, value any) otlpAttribute {
+	switch v := value.(type) {
+	case int:
+		return otlpAttribute{Key: key, Value: map[string]any{"intValue": strconv.Itoa(v)}}
+	case bool:
+		return otlpAttribute{Key: key, Value: map[string]any{"boolValue": v}}
+	default:
+		return otlpAttribute{Key: key, Value: map[string]any{"stringValue": fmt.Sprint(v)}}
+	}
+}
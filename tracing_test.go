@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID  = "00f067aa0ba902b7"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		value   string
+		valid   bool
+		sampled bool
+	}{
+		{value: "00-" + testTraceID + "-" + testSpanID + "-01", valid: true, sampled: true},
+		{value: "00-" + testTraceID + "-" + testSpanID + "-00", valid: true},
+		{value: "00-" + testTraceID + "-" + testSpanID + "-zz"},
+		{value: "00-00000000000000000000000000000000-" + testSpanID + "-01"},
+		{value: "01-" + testTraceID + "-" + testSpanID + "-01"},
+		{value: ""},
+	}
+	for _, tt := range tests {
+		sc := parseTraceparent(tt.value)
+		if valid := sc.traceID != ([16]byte{}); valid != tt.valid || sc.sampled() != tt.sampled {
+			t.Errorf("%q: valid=%v sampled=%v, want %v %v", tt.value, valid, sc.sampled(), tt.valid, tt.sampled)
+		}
+	}
+}
+
+func TestSpanKeepsParentSampling(t *testing.T) {
+	tr := newTracer("http://collector.invalid", "test", nil)
+	for _, flags := range []string{"00", "01"} {
+		remote := parseTraceparent("00-" + testTraceID + "-" + testSpanID + "-" + flags)
+		_, sp := tr.start(context.Background(), "op", spanKindServer, remote)
+
+		h := http.Header{}
+		sp.inject(h)
+		got := h.Get("traceparent")
+		if !strings.HasPrefix(got, "00-"+testTraceID+"-") || !strings.HasSuffix(got, "-"+flags) {
+			t.Errorf("flags %s: injected %q", flags, got)
+		}
+		sp.end()
+	}
+
+	if len(tr.queue) != 1 || !tr.queue[0].ctx.sampled() {
+		t.Errorf("queued %d spans, want only the sampled one", len(tr.queue))
+	}
+}
+
+func TestNewTraceIsSampled(t *testing.T) {
+	tr := newTracer("http://collector.invalid", "test", nil)
+	_, sp := tr.start(context.Background(), "op", spanKindServer, spanContext{})
+	h := http.Header{}
+	sp.inject(h)
+	if got := h.Get("traceparent"); !strings.HasSuffix(got, "-01") || len(got) != 55 {
+		t.Errorf("traceparent = %q", got)
+	}
+}
+
+func TestTracingPropagatesUpstream(t *testing.T) {
+	var upstream string
+	stub := newStubDropbox(t, func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Get("traceparent")
+		tokenHandler(w, r)
+	})
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer collector.Close()
+	_, h := newTestServer(t, testConfig(t, stub.URL, "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", collector.URL))
+
+	r := httptest.NewRequest("POST", "/api/dropbox/refresh", strings.NewReader(`{"refresh_token":"r"}`))
+	r.Header.Set("Content-Type", contentTypeJSON)
+	r.Header.Set("traceparent", "00-"+testTraceID+"-"+testSpanID+"-00")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if !strings.HasPrefix(upstream, "00-"+testTraceID+"-") || !strings.HasSuffix(upstream, "-00") {
+		t.Errorf("upstream traceparent = %q, want the caller's trace, unsampled", upstream)
+	}
+}
+
+func TestExportSendsHeaders(t *testing.T) {
+	var got http.Header
+	var body otlpExport
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer collector.Close()
+
+	headers, err := parseOTLPHeaders("api-key=secret%20value, X-Tenant = acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := newTracer(collector.URL, "test", headers)
+	_, sp := tr.start(context.Background(), "op", spanKindServer, spanContext{})
+	sp.end()
+	tr.flush(context.Background())
+
+	if got.Get("Api-Key") != "secret value" || got.Get("X-Tenant") != "acme" {
+		t.Errorf("collector headers = %v", got)
+	}
+	if spans := body.ResourceSpans[0].ScopeSpans[0].Spans; len(spans) != 1 || spans[0].Name != "op" {
+		t.Errorf("exported spans = %+v", spans)
+	}
+}
+
+func TestParseOTLPHeadersErrors(t *testing.T) {
+	for _, value := range []string{"novalue", "bad name=x", "k=%zz"} {
+		if _, err := parseOTLPHeaders(value); err == nil {
+			t.Errorf("%q: no error", value)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// dropboxNotification is the body of a Dropbox webhook POST: the accounts
+// whose files changed, under both the current and the legacy field names.
+type dropboxNotification struct {
+	ListFolder struct {
+		Accounts []string `json:"accounts"`
+	} `json:"list_folder"`
+	Delta struct {
+		Users []int64 `json:"users"`
+	} `json:"delta"`
+}
+
+// webhookHandler receives Dropbox file-change notifications. A GET is the
+// verification handshake, answered by echoing challenge; a POST must carry an
+// X-Dropbox-Signature HMAC of the body keyed with the app secret. Dropbox
+// retries slow webhooks, so the changed accounts are only logged for
+// downstream processing and the answer goes out right away.
+func (s *server) webhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		challenge := r.URL.Query().Get("challenge")
+		if challenge == "" {
+			writeError(w, r, errCodeInvalidRequest, "challenge is required", http.StatusBadRequest)
+			return
+		}
+		// withSecurityHeaders has set nosniff, so the echo can't be
+		// interpreted as markup.
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, challenge)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.config(r.Context()).MaxBodyBytes))
+	if err != nil {
+		if isMaxBytesError(err) {
+			writeError(w, r, errCodeRequestTooLarge, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		writeError(w, r, errCodeInvalidRequest, "failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	secret := s.config(r.Context()).Providers[defaultProvider].ClientSecret
+	if !validWebhookSignature(secret, body, r.Header.Get("X-Dropbox-Signature")) {
+		logger(r.Context()).Warn("rejected dropbox webhook signature")
+		writeError(w, r, errCodeForbidden, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	var note dropboxNotification
+	if err := json.Unmarshal(body, &note); err != nil {
+		logger(r.Context()).Warn("invalid dropbox webhook body", "error", err)
+		writeError(w, r, errCodeInvalidRequest, "invalid notification", http.StatusBadRequest)
+		return
+	}
+
+	logger(r.Context()).Info("dropbox webhook notification",
+		"accounts", note.ListFolder.Accounts,
+		"users", note.Delta.Users,
+	)
+	w.WriteHeader(http.StatusOK)
+}
+
+func validWebhookSignature(secret string, body []byte, signature string) bool {
+	got, err := hex.DecodeString(signature)
+	if err != nil || secret == "" {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
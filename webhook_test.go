@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func signWebhook(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookChallenge(t *testing.T) {
+	_, h := newTestServer(t, testConfig(t, "http://dropbox.invalid", "PROXY_API_KEY", "api-key"))
+
+	w := do(h, "GET", "/api/dropbox/webhook?challenge=abc123", "", "")
+	if w.Code != http.StatusOK || w.Body.String() != "abc123" {
+		t.Errorf("status %d, body %q; want the challenge echoed without an API key", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("Content-Type %q, X-Content-Type-Options %q", ct, w.Header().Get("X-Content-Type-Options"))
+	}
+
+	if w := do(h, "GET", "/api/dropbox/webhook", "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("no challenge: status %d, want 400", w.Code)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	_, h := newTestServer(t, testConfig(t, "http://dropbox.invalid", "DROPBOX_CLIENT_SECRET", "app-secret"))
+	body := `{"list_folder":{"accounts":["dbid:1"]},"delta":{"users":[1]}}`
+
+	for _, tc := range []struct {
+		name      string
+		signature string
+		want      int
+	}{
+		{"valid", signWebhook("app-secret", body), http.StatusOK},
+		{"missing", "", http.StatusForbidden},
+		{"wrong secret", signWebhook("other-secret", body), http.StatusForbidden},
+		{"not hex", "zz" + signWebhook("app-secret", body)[2:], http.StatusForbidden},
+		{"other body", signWebhook("app-secret", body+" "), http.StatusForbidden},
+	} {
+		r := httptest.NewRequest("POST", "/api/dropbox/webhook", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentTypeJSON)
+		if tc.signature != "" {
+			r.Header.Set("X-Dropbox-Signature", tc.signature)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s signature: status %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+}